@@ -3,10 +3,11 @@ package local
 import (
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/rjoleary/backup/internal/fsutil"
 )
 
 type Local struct {
@@ -33,27 +34,8 @@ func (l *Local) Archive(diskImage string) error {
 	// The .sparseimage extension is expected by OSX's Finder to identify the
 	// file type.
 	fileName := filepath.Join(l.Directory, formattedTime+".sparseimage")
-	if err := copyFile(fileName, diskImage); err != nil {
+	if err := fsutil.CopyFile(diskImage, fileName, os.O_TRUNC, 0666); err != nil {
 		return fmt.Errorf("failed to move file: %v", err)
 	}
 	return nil
 }
-
-func copyFile(dest, src string) error {
-	r, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("could not open: %v", err)
-	}
-	defer r.Close()
-
-	w, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("could not open: %v", err)
-	}
-	defer w.Close()
-
-	if _, err := io.Copy(w, r); err != nil {
-		return fmt.Errorf("could not copy: %v", err)
-	}
-	return nil
-}
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/rjoleary/backup/config"
 	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/fetcher/git"
+	"github.com/rjoleary/backup/fetcher/secrets"
+	"github.com/rjoleary/backup/hook"
+	"github.com/rjoleary/backup/lister/github"
+	"github.com/rjoleary/backup/precondition"
+	"github.com/rjoleary/backup/report"
 	"github.com/rjoleary/backup/staging"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
@@ -39,17 +49,29 @@ func (s *sliceFlag) Set(value string) error {
 	return nil
 }
 
-// checkDeps checks whether the dependencies are installed.
-// TODO: Move into plugins.
-func checkDeps() error {
-	deps := []struct {
-		name string
-		cmd  []string
-	}{
-		{"git", []string{"git", "--version"}},
-		{"rsync", []string{"rsync", "--version"}},
-		{"vim", []string{"vim", "--version"}},
-		{"hdiutil", []string{"hdiutil", "help"}},
+// checkDeps checks whether the dependencies, including those of the plugins
+// in the config, are installed.
+func checkDeps(c *config.Config) error {
+	deps := map[string][]string{
+		"vim":     {"vim", "--version"},
+		"hdiutil": {"hdiutil", "help"},
+	}
+	plugins := []any{}
+	for _, p := range c.Preconditions() {
+		plugins = append(plugins, p)
+	}
+	for _, l := range c.Listers() {
+		plugins = append(plugins, l)
+	}
+	for _, f := range c.Fetchers() {
+		plugins = append(plugins, f)
+	}
+	for _, p := range plugins {
+		if d, ok := p.(fetcher.Dependent); ok {
+			for name, cmd := range d.Deps() {
+				deps[name] = cmd
+			}
+		}
 	}
 
 	// Check all the deps in parallel.
@@ -60,11 +82,11 @@ func checkDeps() error {
 		err     error
 	}
 	errs := make(chan depResult)
-	for _, dep := range deps {
+	for name, cmd := range deps {
 		go func() {
 			errs <- depResult{
-				depName: dep.name,
-				err:     exec.CommandContext(ctx, dep.cmd[0], dep.cmd[1:]...).Run(),
+				depName: name,
+				err:     exec.CommandContext(ctx, cmd[0], cmd[1:]...).Run(),
 			}
 		}()
 	}
@@ -77,6 +99,7 @@ func checkDeps() error {
 		}
 	}
 	if len(missingDeps) > 0 {
+		sort.Strings(missingDeps)
 		return fmt.Errorf("missing dependencies: %v", missingDeps)
 	}
 	return nil
@@ -108,33 +131,62 @@ func mask(fetchers []fetcher.Fetcher, mask []string) []fetcher.Fetcher {
 	return filteredFetchers
 }
 
-func backupCommand(f flags, c *config.Config, args []string) error {
+func backupCommand(f flags, c *config.Config, args []string) (retErr error) {
 	if len(c.Listers()) == 0 && len(c.Fetchers()) == 0 {
 		log.Println("Config is empty")
 		return nil
 	}
 
-	numErrors := 0
+	rep := report.New()
+	defer func() {
+		log.Println("Summary:")
+		rep.Summary(os.Stderr)
+	}()
+
+	// The after_backup hooks run before the staging area is cleaned up, so
+	// they can use the disk image.
+	env := hook.Env{Status: hook.Running}
+	var sa *staging.StagingArea
+	defer func() {
+		env.Event = "after_backup"
+		env.Status = hook.Success
+		if retErr != nil || rep.Num(report.Error) != 0 {
+			env.Status = hook.Failure
+		}
+		if err := hook.Run(context.Background(), c.Hooks.AfterBackup, env, rep); err != nil && retErr == nil {
+			retErr = err
+		}
+		if sa != nil {
+			sa.Cleanup()
+		}
+	}()
+
+	if err := precondition.Run(context.Background(), c.Preconditions(), rep); err != nil {
+		return err
+	}
 
 	log.Println("Creating staging area...")
 	sa, err := staging.New(f.password, 512)
 	if err != nil {
 		return fmt.Errorf("failed to create staging directory: %v", err)
 	}
-	defer sa.Cleanup()
 	mp, err := sa.MountPoint()
 	if err != nil {
 		return fmt.Errorf("failed to get mount point: %v", err)
 	}
+	env.MountPoint = mp
 
-	allFetchers := c.Fetchers()
+	env.Event = "before_backup"
+	if err := hook.Run(context.Background(), c.Hooks.BeforeBackup, env, rep); err != nil {
+		return err
+	}
 
+	listed := []fetcher.Fetcher{}
 	for _, l := range c.Listers() {
 		log.Printf("Listing %s...", l)
 		fetchers, err := l.List()
 		if err != nil {
-			log.Println("Error:", err)
-			numErrors++
+			rep.Source(l.String()).Errorf("%v", err)
 			continue
 		}
 
@@ -146,10 +198,21 @@ func backupCommand(f flags, c *config.Config, args []string) error {
 			log.Printf("Found %d %s fetchers", count, name)
 		}
 
-		allFetchers = append(allFetchers, fetchers...)
+		listed = append(listed, fetchers...)
 	}
 
-	allFetchers = mask(allFetchers, f.fetcherMask)
+	configured := mask(c.Fetchers(), f.fetcherMask)
+	// Listed fetchers may collide with each other or the config, for
+	// example a repo with the same name on GitHub and BitBucket. Only the
+	// colliding ones are skipped.
+	listed = fetcher.SkipOverlapping(configured, mask(listed, f.fetcherMask), rep)
+	allFetchers := append(configured, listed...)
+
+	for _, f := range allFetchers {
+		if g, ok := f.(*git.Git); ok {
+			g.KnownHosts = c.KnownHosts
+		}
+	}
 
 	if len(allFetchers) == 0 {
 		log.Println("Nothing to fetch")
@@ -162,29 +225,50 @@ func backupCommand(f flags, c *config.Config, args []string) error {
 
 	for _, f := range allFetchers {
 		log.Printf("Fetching %s...", f)
-		if err := f.Fetch(mp); err != nil {
-			log.Printf("Error fetching %s: %v", f, err)
-			numErrors++
-			continue
+		src := rep.Source(f.String())
+		fetchEnv := env
+		fetchEnv.Event = "after_fetch"
+		fetchEnv.Status = hook.Success
+		fetchEnv.Fetcher = f.String()
+		fetchEnv.FetcherName = f.Name()
+		if err := f.Fetch(mp, src); err != nil {
+			src.Errorf("error fetching: %v", err)
+			fetchEnv.Status = hook.Failure
+		}
+		if err := hook.Run(context.Background(), c.Hooks.AfterFetch, fetchEnv, rep); err != nil {
+			return err
 		}
 	}
+	git.CheckSubmodules(allFetchers, rep)
+
+	// The report is saved to the image so it serves as a manifest of the
+	// backup. Archiver errors are only in the summary.
+	if err := rep.Save(filepath.Join(mp, "report.json")); err != nil {
+		rep.Source("report").Errorf("failed to save report: %v", err)
+	}
 
 	log.Println("Unmounting staging area...")
 	diskImage, err := sa.Unmount()
 	if err != nil {
 		return fmt.Errorf("failed to unmount staging area: %v", err)
 	}
+	env.MountPoint = ""
+	env.DiskImage = diskImage
+
+	env.Event = "before_archive"
+	if err := hook.Run(context.Background(), c.Hooks.BeforeArchive, env, rep); err != nil {
+		return err
+	}
 
 	for _, a := range c.Archivers() {
 		log.Printf("Archiving %s...", a)
 		if err := a.Archive(diskImage); err != nil {
-			log.Printf("Error archiving %s: %v", a, err)
-			numErrors++
+			rep.Source(a.String()).Errorf("error archiving: %v", err)
 			continue
 		}
 	}
 
-	if numErrors != 0 {
+	if numErrors := rep.Num(report.Error); numErrors != 0 {
 		return fmt.Errorf("encountered %d error(s)", numErrors)
 	}
 	return nil
@@ -198,6 +282,65 @@ func changePasswordCommand(f flags, c *config.Config, args []string) error {
 	return c.Save(f.configFile, newPassword)
 }
 
+func refreshHostKeysCommand(f flags, c *config.Config, args []string) error {
+	log.Println("Downloading GitHub's SSH host keys...")
+	lines, err := github.KnownHosts(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		_, _, pubKey, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("github.com %s %s\n", pubKey.Type(), ssh.FingerprintSHA256(pubKey))
+	}
+
+	fmt.Print("Save these host keys? [y/N] ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(strings.ToLower(answer)) != "y" {
+		log.Println("Host keys not saved")
+		return nil
+	}
+
+	c.KnownHosts = git.ReplaceKnownHosts(c.KnownHosts, "github.com", lines)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return c.Save(f.configFile, f.password)
+}
+
+func restoreSecretsCommand(f flags, c *config.Config, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return errors.New("usage: restore-secrets <image> [<secrets dir> [<root>]]")
+	}
+	dir := secrets.DefaultDest()
+	if len(args) >= 2 {
+		dir = args[1]
+	}
+	root := "/"
+	if len(args) == 3 {
+		root = args[2]
+	}
+
+	log.Println("Opening backup image...")
+	sa, err := staging.Open(f.password, args[0])
+	if err != nil {
+		return err
+	}
+	defer sa.Cleanup()
+	mp, err := sa.MountPoint()
+	if err != nil {
+		return fmt.Errorf("failed to get mount point: %v", err)
+	}
+
+	log.Printf("Restoring secrets from %s to %s...", dir, root)
+	return secrets.Restore(filepath.Join(mp, dir), root)
+}
+
 func editCommand(f flags, c *config.Config, args []string) error {
 	// Serialize json config.
 	data, err := json.MarshalIndent(c, "", "  ")
@@ -256,14 +399,6 @@ func realMain() error {
 	flag.Var(&f.fetcherMask, "fetcher-mask", "Skip these fetchers")
 	flag.Parse()
 
-	// Check dependencies.
-	if !f.skipCheckDeps {
-		log.Println("Checking dependencies...")
-		if err := checkDeps(); err != nil {
-			return err
-		}
-	}
-
 	// Decrypt config file.
 	log.Println("Decrypting config file...")
 	var err error
@@ -275,10 +410,21 @@ func realMain() error {
 		return err
 	}
 
+	// Check dependencies. This happens after decrypting because the
+	// dependencies depend on the config.
+	if !f.skipCheckDeps {
+		log.Println("Checking dependencies...")
+		if err := checkDeps(c); err != nil {
+			return err
+		}
+	}
+
 	availableCmds := map[string]func(flags, *config.Config, []string) error{
-		"backup":          backupCommand,
-		"change-password": changePasswordCommand,
-		"edit":            editCommand,
+		"backup":            backupCommand,
+		"change-password":   changePasswordCommand,
+		"edit":              editCommand,
+		"refresh-host-keys": refreshHostKeysCommand,
+		"restore-secrets":   restoreSecretsCommand,
 	}
 
 	// Default to "backup" command.
@@ -10,24 +10,66 @@ import (
 	"github.com/rjoleary/backup/archiver/gcs"
 	localarchiver "github.com/rjoleary/backup/archiver/local"
 	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/fetcher/browser"
+	"github.com/rjoleary/backup/fetcher/command"
+	"github.com/rjoleary/backup/fetcher/database"
+	"github.com/rjoleary/backup/fetcher/dav"
+	"github.com/rjoleary/backup/fetcher/docker"
 	"github.com/rjoleary/backup/fetcher/git"
+	"github.com/rjoleary/backup/fetcher/gomod"
+	"github.com/rjoleary/backup/fetcher/imap"
+	"github.com/rjoleary/backup/fetcher/inventory"
 	localfetcher "github.com/rjoleary/backup/fetcher/local"
+	"github.com/rjoleary/backup/fetcher/s3"
+	"github.com/rjoleary/backup/fetcher/secrets"
+	"github.com/rjoleary/backup/fetcher/web"
+	"github.com/rjoleary/backup/hook"
 	"github.com/rjoleary/backup/lister"
 	"github.com/rjoleary/backup/lister/bitbucket"
 	"github.com/rjoleary/backup/lister/github"
+	"github.com/rjoleary/backup/lister/localgit"
+	"github.com/rjoleary/backup/precondition"
 )
 
 type Config struct {
 	Version int    `json:"version"`
 	Name    string `json:"name"`
 
+	// KnownHosts are lines in the known_hosts format which are merged with
+	// the git fetcher's built-in keys.
+	KnownHosts []string `json:"known_hosts,omitempty"`
+
+	// Preconditions
+	ProcessNotRunning []precondition.ProcessNotRunning `json:"process_not_running"`
+	SyncIdle          []precondition.SyncIdle          `json:"sync_idle"`
+	PathExists        []precondition.PathExists        `json:"path_exists"`
+	Mounted           []precondition.Mounted           `json:"mounted"`
+	CommandSucceeds   []precondition.Command           `json:"command_succeeds"`
+
+	// Hooks run commands at points of the backup.
+	Hooks hook.Hooks `json:"hooks"`
+
 	// Listers
 	BitBucket []bitbucket.BitBucket `json:"bitbucket"`
 	GitHub    []github.GitHub       `json:"github"`
+	LocalGit  []localgit.LocalGit   `json:"local_git"`
 
 	// Fetchers
-	Git          []git.Git            `json:"git"`
-	LocalFetcher []localfetcher.Local `json:"local_fetcher"`
+	Git          []git.Git             `json:"git"`
+	LocalFetcher []localfetcher.Local  `json:"local_fetcher"`
+	Browser      []browser.Browser     `json:"browser"`
+	Secrets      []secrets.Secrets     `json:"secrets"`
+	Postgres     []database.Postgres   `json:"postgres"`
+	MySQL        []database.MySQL      `json:"mysql"`
+	SQLite       []database.SQLite     `json:"sqlite"`
+	Command      []command.Command     `json:"command"`
+	Web          []web.Web             `json:"web"`
+	S3           []s3.S3               `json:"s3"`
+	IMAP         []imap.IMAP           `json:"imap"`
+	DAV          []dav.DAV             `json:"dav"`
+	Docker       []docker.Docker       `json:"docker"`
+	Inventory    []inventory.Inventory `json:"inventory"`
+	GoModules    []gomod.GoModules     `json:"go_modules"`
 
 	// Archiver
 	GCS           []gcs.GCS             `json:"gcs"`
@@ -110,6 +152,17 @@ func (c *Config) Validate() error {
 	if c.Version != 1 {
 		return errors.New("'version' field must be set to 1")
 	}
+	if err := git.ValidateKnownHosts(c.KnownHosts); err != nil {
+		return err
+	}
+	if err := c.Hooks.Validate(); err != nil {
+		return err
+	}
+	for _, p := range c.Preconditions() {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
 	for _, l := range c.Listers() {
 		if err := l.Validate(); err != nil {
 			return err
@@ -120,6 +173,9 @@ func (c *Config) Validate() error {
 			return err
 		}
 	}
+	if err := fetcher.CheckDestinations(c.Fetchers()); err != nil {
+		return err
+	}
 	for _, a := range c.Archivers() {
 		if err := a.Validate(); err != nil {
 			return err
@@ -128,6 +184,26 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+func (c *Config) Preconditions() []precondition.Precondition {
+	preconditions := []precondition.Precondition{}
+	for _, p := range c.ProcessNotRunning {
+		preconditions = append(preconditions, &p)
+	}
+	for _, p := range c.SyncIdle {
+		preconditions = append(preconditions, &p)
+	}
+	for _, p := range c.PathExists {
+		preconditions = append(preconditions, &p)
+	}
+	for _, p := range c.Mounted {
+		preconditions = append(preconditions, &p)
+	}
+	for _, p := range c.CommandSucceeds {
+		preconditions = append(preconditions, &p)
+	}
+	return preconditions
+}
+
 func (c *Config) Listers() []lister.Lister {
 	listers := []lister.Lister{}
 	for _, l := range c.GitHub {
@@ -136,6 +212,9 @@ func (c *Config) Listers() []lister.Lister {
 	for _, l := range c.BitBucket {
 		listers = append(listers, &l)
 	}
+	for _, l := range c.LocalGit {
+		listers = append(listers, &l)
+	}
 	return listers
 }
 
@@ -147,6 +226,45 @@ func (c *Config) Fetchers() []fetcher.Fetcher {
 	for _, f := range c.Git {
 		fetchers = append(fetchers, &f)
 	}
+	for _, f := range c.Browser {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Secrets {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Postgres {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.MySQL {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.SQLite {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Command {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Web {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.S3 {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.IMAP {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.DAV {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Docker {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.Inventory {
+		fetchers = append(fetchers, &f)
+	}
+	for _, f := range c.GoModules {
+		fetchers = append(fetchers, &f)
+	}
 	return fetchers
 }
 
@@ -0,0 +1,421 @@
+// Package bitbucket fetches the BitBucket metadata which is not stored in the
+// git repository: pull requests, issues, downloads and snippets.
+package bitbucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// apiURL is overridden by tests.
+var apiURL = "https://api.bitbucket.org/2.0"
+
+// Account holds the credentials for the BitBucket API.
+type Account struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (a *Account) validate() error {
+	if a.Username == "" {
+		return errors.New("username is not set")
+	}
+	if a.Password == "" {
+		return errors.New("password is not set")
+	}
+	return nil
+}
+
+func (a *Account) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(a.Username, a.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP error: %s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+func (a *Account) getJSON(u string, v any) error {
+	resp, err := a.get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getAll follows the "next" links of a paginated response and returns the
+// values from every page.
+func (a *Account) getAll(u string) ([]json.RawMessage, error) {
+	values := []json.RawMessage{}
+	for u != "" {
+		page := struct {
+			Values []json.RawMessage `json:"values"`
+			Next   string            `json:"next"`
+		}{}
+		if err := a.getJSON(u, &page); err != nil {
+			return nil, err
+		}
+		values = append(values, page.Values...)
+		u = page.Next
+	}
+	return values, nil
+}
+
+// download saves the content at the given url to a file.
+func (a *Account) download(u, file string) error {
+	resp, err := a.get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fileName returns the last element of a name supplied by the server, and
+// false if it is not a safe file name, such as "", "." or "..".
+func fileName(name string) (string, bool) {
+	base := filepath.Base(name)
+	return base, filepath.IsLocal(name) && base != "." && base != ".."
+}
+
+// link is the format BitBucket uses for hyperlinks.
+type link struct {
+	Href string `json:"href"`
+}
+
+// withComments pairs an object with its comments.
+type withComments struct {
+	Object   json.RawMessage   `json:"object"`
+	Comments []json.RawMessage `json:"comments"`
+}
+
+func writeJSON(file string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0666)
+}
+
+func repoURL(repo string, elem ...string) string {
+	return apiURL + "/repositories/" + repo + "/" + filepath.ToSlash(filepath.Join(elem...))
+}
+
+// PullRequests fetches every pull request of a repo along with its comments.
+type PullRequests struct {
+	Account
+	Dir  string `json:"dir"`
+	Repo string `json:"repo"`
+}
+
+func (p *PullRequests) String() string {
+	return p.Repo + " pull requests"
+}
+
+func (p *PullRequests) Name() string {
+	return "BitBucketPullRequests"
+}
+
+func (p *PullRequests) Destinations() []string {
+	return []string{filepath.Join(p.Dir, "pullrequests.json")}
+}
+
+func (p *PullRequests) Validate() error {
+	return validateRepo(&p.Account, p.Dir, p.Repo)
+}
+
+func (p *PullRequests) Fetch(stagingDir string, rep *report.Source) error {
+	dir := filepath.Join(stagingDir, p.Dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	// By default, only open pull requests are listed.
+	q := url.Values{"state": {"OPEN", "MERGED", "DECLINED", "SUPERSEDED"}}
+	prs, err := p.getAll(repoURL(p.Repo, "pullrequests") + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+
+	out := make([]withComments, 0, len(prs))
+	for _, pr := range prs {
+		id := struct {
+			ID int `json:"id"`
+		}{}
+		if err := json.Unmarshal(pr, &id); err != nil {
+			return err
+		}
+		comments, err := p.getAll(repoURL(p.Repo, "pullrequests", fmt.Sprint(id.ID), "comments"))
+		if err != nil {
+			return err
+		}
+		out = append(out, withComments{pr, comments})
+	}
+	rep.Count("pull requests", int64(len(prs)))
+	return writeJSON(filepath.Join(dir, "pullrequests.json"), out)
+}
+
+// Issues fetches the issue tracker of a repo including comments and
+// attachments.
+type Issues struct {
+	Account
+	Dir  string `json:"dir"`
+	Repo string `json:"repo"`
+}
+
+func (i *Issues) String() string {
+	return i.Repo + " issues"
+}
+
+func (i *Issues) Name() string {
+	return "BitBucketIssues"
+}
+
+func (i *Issues) Destinations() []string {
+	return []string{filepath.Join(i.Dir, "issues.json"), filepath.Join(i.Dir, "issues")}
+}
+
+func (i *Issues) Validate() error {
+	return validateRepo(&i.Account, i.Dir, i.Repo)
+}
+
+func (i *Issues) Fetch(stagingDir string, rep *report.Source) error {
+	dir := filepath.Join(stagingDir, i.Dir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	issues, err := i.getAll(repoURL(i.Repo, "issues"))
+	if err != nil {
+		return err
+	}
+
+	out := make([]withComments, 0, len(issues))
+	for _, issue := range issues {
+		id := struct {
+			ID int `json:"id"`
+		}{}
+		if err := json.Unmarshal(issue, &id); err != nil {
+			return err
+		}
+		comments, err := i.getAll(repoURL(i.Repo, "issues", fmt.Sprint(id.ID), "comments"))
+		if err != nil {
+			return err
+		}
+		out = append(out, withComments{issue, comments})
+
+		// Attachments are binaries saved to issues/<id>/.
+		attachments, err := i.getAll(repoURL(i.Repo, "issues", fmt.Sprint(id.ID), "attachments"))
+		if err != nil {
+			return err
+		}
+		for _, raw := range attachments {
+			a := struct {
+				Name  string `json:"name"`
+				Links struct {
+					Self link `json:"self"`
+				} `json:"links"`
+			}{}
+			if err := json.Unmarshal(raw, &a); err != nil {
+				return err
+			}
+			name, ok := fileName(a.Name)
+			if !ok {
+				rep.Warnf("skipping attachment of issue %d with invalid name %q", id.ID, a.Name)
+				continue
+			}
+			attachmentDir := filepath.Join(dir, "issues", fmt.Sprint(id.ID))
+			if err := os.MkdirAll(attachmentDir, 0777); err != nil {
+				return err
+			}
+			if err := i.download(a.Links.Self.Href, filepath.Join(attachmentDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	rep.Count("issues", int64(len(issues)))
+	return writeJSON(filepath.Join(dir, "issues.json"), out)
+}
+
+// Downloads fetches the files uploaded to the downloads section of a repo.
+type Downloads struct {
+	Account
+	Dir  string `json:"dir"`
+	Repo string `json:"repo"`
+}
+
+func (d *Downloads) String() string {
+	return d.Repo + " downloads"
+}
+
+func (d *Downloads) Name() string {
+	return "BitBucketDownloads"
+}
+
+func (d *Downloads) Destinations() []string {
+	return []string{filepath.Join(d.Dir, "downloads.json"), filepath.Join(d.Dir, "downloads")}
+}
+
+func (d *Downloads) Validate() error {
+	return validateRepo(&d.Account, d.Dir, d.Repo)
+}
+
+func (d *Downloads) Fetch(stagingDir string, rep *report.Source) error {
+	dir := filepath.Join(stagingDir, d.Dir, "downloads")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	downloads, err := d.getAll(repoURL(d.Repo, "downloads"))
+	if err != nil {
+		return err
+	}
+	for _, raw := range downloads {
+		dl := struct {
+			Name  string `json:"name"`
+			Links struct {
+				Self link `json:"self"`
+			} `json:"links"`
+		}{}
+		if err := json.Unmarshal(raw, &dl); err != nil {
+			return err
+		}
+		name, ok := fileName(dl.Name)
+		if !ok {
+			rep.Warnf("skipping download with invalid name %q", dl.Name)
+			continue
+		}
+		if err := d.download(dl.Links.Self.Href, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	rep.Count("downloads", int64(len(downloads)))
+	return writeJSON(filepath.Join(stagingDir, d.Dir, "downloads.json"), downloads)
+}
+
+// Snippets fetches every snippet of a workspace. Each snippet is saved to
+// its own directory containing the metadata and files.
+type Snippets struct {
+	Account
+	Dir       string `json:"dir"`
+	Workspace string `json:"workspace"`
+}
+
+func (s *Snippets) String() string {
+	return s.Workspace + " snippets"
+}
+
+func (s *Snippets) Name() string {
+	return "BitBucketSnippets"
+}
+
+func (s *Snippets) Destinations() []string {
+	return []string{s.Dir}
+}
+
+func (s *Snippets) Validate() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if s.Workspace == "" {
+		return errors.New("workspace is required")
+	}
+	return nil
+}
+
+func (s *Snippets) Fetch(stagingDir string, rep *report.Source) error {
+	snippets, err := s.getAll(apiURL + "/snippets/" + s.Workspace)
+	if err != nil {
+		return err
+	}
+	for _, raw := range snippets {
+		listed := struct {
+			ID    int `json:"id"`
+			Links struct {
+				Self link `json:"self"`
+			} `json:"links"`
+		}{}
+		if err := json.Unmarshal(raw, &listed); err != nil {
+			return err
+		}
+		dir := filepath.Join(stagingDir, s.Dir, fmt.Sprint(listed.ID))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+
+		// The listing omits the files, so the snippet is requested
+		// individually. The API addresses snippets by their encoded
+		// id, not the numeric id.
+		snippet := json.RawMessage{}
+		if err := s.getJSON(listed.Links.Self.Href, &snippet); err != nil {
+			return err
+		}
+		files := struct {
+			Files map[string]struct {
+				Links struct {
+					Self link `json:"self"`
+				} `json:"links"`
+			} `json:"files"`
+		}{}
+		if err := json.Unmarshal(snippet, &files); err != nil {
+			return err
+		}
+		for raw, f := range files.Files {
+			name, ok := fileName(raw)
+			if !ok {
+				rep.Warnf("skipping file of snippet %d with invalid name %q", listed.ID, raw)
+				continue
+			}
+			if err := s.download(f.Links.Self.Href, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		if err := writeJSON(filepath.Join(dir, "snippet.json"), snippet); err != nil {
+			return err
+		}
+	}
+	rep.Count("snippets", int64(len(snippets)))
+	return nil
+}
+
+func validateRepo(a *Account, dir, repo string) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	if dir == "" {
+		return errors.New("dir is required")
+	}
+	if repo == "" {
+		return errors.New("repo is required")
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package bitbucket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	reply := func(pattern, body string) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, body, srv.URL)
+		})
+	}
+
+	// Pull requests are split across two pages.
+	reply("GET /repositories/user/repo/pullrequests", `{"values": [{"id": 1}], "next": "%s/page2"}`)
+	reply("GET /page2", `{"values": [{"id": 2}]}`)
+	reply("GET /repositories/user/repo/pullrequests/1/comments", `{"values": [{"content": "lgtm"}]}`)
+	reply("GET /repositories/user/repo/pullrequests/2/comments", `{"values": []}`)
+
+	reply("GET /repositories/user/repo/issues", `{"values": [{"id": 7}]}`)
+	reply("GET /repositories/user/repo/issues/7/comments", `{"values": [{"content": "me too"}]}`)
+	reply("GET /repositories/user/repo/issues/7/attachments", `{"values": [{"name": "log.txt", "links": {"self": {"href": "%s/files/log.txt"}}}]}`)
+
+	// Names which are not safe file names are skipped.
+	reply("GET /repositories/user/repo/downloads", `{"values": [
+		{"name": "v1.tar.gz", "links": {"self": {"href": "%[1]s/files/v1.tar.gz"}}},
+		{"name": "..", "links": {"self": {"href": "%[1]s/files/up"}}}
+	]}`)
+
+	// Snippets are addressed by their encoded id.
+	reply("GET /snippets/user", `{"values": [{"id": 3, "links": {"self": {"href": "%s/snippets/user/kypj"}}}]}`)
+	reply("GET /snippets/user/kypj", `{"id": 3, "files": {
+		"main.go": {"links": {"self": {"href": "%[1]s/files/main.go"}}},
+		".": {"links": {"self": {"href": "%[1]s/files/dot"}}}
+	}}`)
+
+	reply("GET /files/{name}", "content")
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	apiURL = srv.URL
+	return srv
+}
+
+func TestFetch(t *testing.T) {
+	newTestServer(t)
+	account := Account{Username: "user", Password: "pass"}
+	stagingDir := t.TempDir()
+	rep := report.New()
+
+	for _, f := range []fetcher.Fetcher{
+		&PullRequests{account, "user/repo.metadata", "user/repo"},
+		&Issues{account, "user/repo.metadata", "user/repo"},
+		&Downloads{account, "user/repo.metadata", "user/repo"},
+		&Snippets{account, "user.snippets", "user"},
+	} {
+		if err := f.Validate(); err != nil {
+			t.Fatalf("Validate() = %v", err)
+		}
+		if err := f.Fetch(stagingDir, rep.Source(f.String())); err != nil {
+			t.Fatalf("Fetch() = %v", err)
+		}
+	}
+	if got := rep.Num(report.Warning); got != 2 {
+		t.Errorf("got %d warnings; want 2 for the invalid names", got)
+	}
+
+	for _, file := range []string{
+		"user/repo.metadata/issues/7/log.txt",
+		"user/repo.metadata/downloads/v1.tar.gz",
+		"user.snippets/3/main.go",
+		"user.snippets/3/snippet.json",
+		"user/repo.metadata/downloads.json",
+	} {
+		if _, err := os.Stat(filepath.Join(stagingDir, file)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for dir, want := range map[string]string{
+		"user/repo.metadata/downloads": "[v1.tar.gz]",
+		"user.snippets/3":              "[main.go snippet.json]",
+	} {
+		entries, err := os.ReadDir(filepath.Join(stagingDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if fmt.Sprint(names) != want {
+			t.Errorf("%s contains %v; want %s", dir, names, want)
+		}
+	}
+
+	// All pages must be fetched.
+	data, err := os.ReadFile(filepath.Join(stagingDir, "user/repo.metadata/pullrequests.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prs := []withComments{}
+	if err := json.Unmarshal(data, &prs); err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 {
+		t.Fatalf("got %d pull requests; want 2", len(prs))
+	}
+	if len(prs[0].Comments) != 1 {
+		t.Errorf("got %d comments on first pull request; want 1", len(prs[0].Comments))
+	}
+}
+
+func TestFetchUnauthorized(t *testing.T) {
+	newTestServer(t)
+	p := &PullRequests{Account{"user", "wrong"}, "user/repo.metadata", "user/repo"}
+	if err := p.Fetch(t.TempDir(), nil); err == nil {
+		t.Fatal("Fetch() with wrong password succeeded")
+	}
+}
@@ -0,0 +1,337 @@
+// Package browser fetches the profiles of Firefox and Chromium based browsers.
+package browser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/fetcher/local"
+	"github.com/rjoleary/backup/internal/fsutil"
+	"github.com/rjoleary/backup/internal/sqlite"
+	"github.com/rjoleary/backup/report"
+)
+
+// pollInterval is how often the lock is checked. It is overridden by tests.
+var pollInterval = 10 * time.Second
+
+// defaultWait is how long to wait for the browser to close.
+const defaultWait = 30 * time.Minute
+
+// dataDirs are the default data directories relative to the home directory.
+var dataDirs = map[string]map[string]string{
+	"firefox": {
+		"darwin": "Library/Application Support/Firefox",
+		"linux":  ".mozilla/firefox",
+	},
+	"chrome": {
+		"darwin": "Library/Application Support/Google/Chrome",
+		"linux":  ".config/google-chrome",
+	},
+	"chromium": {
+		"darwin": "Library/Application Support/Chromium",
+		"linux":  ".config/chromium",
+	},
+}
+
+// excludes are the caches and lock files in a profile, in the syntax of the
+// local fetcher. SQLite journals are skipped because the databases are copied
+// with the backup API.
+var excludes = map[string][]string{
+	"firefox": {
+		"cache2/", "startupCache/", "thumbnails/", "shader-cache/", "safebrowsing/",
+		"/lock", "/.parentlock",
+		"*-wal", "*-shm", "*-journal",
+	},
+	"chromium": {
+		"Cache/", "Code Cache/", "GPUCache/", "DawnCache/", "DawnGraphiteCache/",
+		"DawnWebGPUCache/", "Service Worker/CacheStorage/", "Service Worker/ScriptCache/",
+		"*-wal", "*-shm", "*-journal",
+	},
+}
+
+// sqliteHeader starts every SQLite database file.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Browser copies the profiles of a browser once it is closed.
+type Browser struct {
+	// Browser is one of "firefox", "chrome" or "chromium".
+	Browser string `json:"browser"`
+	// DataDir contains Firefox's profiles.ini or Chromium's Local State.
+	// It defaults to the browser's directory in the home directory.
+	DataDir string `json:"data_dir,omitempty"`
+	// Dest is the directory in the staging area. It defaults to the
+	// hostname followed by the browser, for example "laptop/firefox".
+	Dest string `json:"dest,omitempty"`
+	// Profiles are the names of the profiles to copy. All profiles are
+	// copied by default.
+	Profiles []string `json:"profiles,omitempty"`
+	// WaitMinutes is how long to wait for the browser to close. It
+	// defaults to 30 minutes.
+	WaitMinutes int `json:"wait_minutes,omitempty"`
+}
+
+func (b *Browser) String() string {
+	return b.Browser + " profiles"
+}
+
+func (b *Browser) Name() string {
+	return "Browser"
+}
+
+func (b *Browser) Validate() error {
+	if _, ok := dataDirs[b.Browser]; !ok {
+		return fmt.Errorf("browser must be firefox, chrome or chromium, got %q", b.Browser)
+	}
+	// sqlite3 runs in the staging area, so a relative path would be
+	// resolved against the wrong directory.
+	if b.DataDir != "" && !filepath.IsAbs(b.DataDir) {
+		return fmt.Errorf("data_dir must be absolute, got %q", b.DataDir)
+	}
+	if b.Dest != "" {
+		if err := fetcher.ValidateDest("dest", b.Dest); err != nil {
+			return err
+		}
+	}
+	if b.WaitMinutes < 0 {
+		return errors.New("wait_minutes must not be negative")
+	}
+	return nil
+}
+
+func (b *Browser) Deps() map[string][]string {
+	return map[string][]string{"sqlite3": {"sqlite3", "-version"}}
+}
+
+func (b *Browser) Destinations() []string {
+	return []string{b.dest()}
+}
+
+func (b *Browser) dest() string {
+	if b.Dest != "" {
+		return b.Dest
+	}
+	return fetcher.HostDir(b.Browser)
+}
+
+func (b *Browser) dataDir() (string, error) {
+	if b.DataDir != "" {
+		return b.DataDir, nil
+	}
+	dir, ok := dataDirs[b.Browser][runtime.GOOS]
+	if !ok {
+		return "", fmt.Errorf("data_dir is required for %s on %s", b.Browser, runtime.GOOS)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, dir), nil
+}
+
+// indexFile returns the file listing the profiles.
+func (b *Browser) indexFile() string {
+	if b.Browser == "firefox" {
+		return "profiles.ini"
+	}
+	return "Local State"
+}
+
+func (b *Browser) excludes() []string {
+	if b.Browser == "firefox" {
+		return excludes["firefox"]
+	}
+	return excludes["chromium"]
+}
+
+func (b *Browser) profiles(dataDir string, rep *report.Source) ([]profile, error) {
+	var profiles []profile
+	if b.Browser == "firefox" {
+		var warnings []string
+		var err error
+		profiles, warnings, err = firefoxProfiles(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			rep.Warnf("%s", w)
+		}
+	} else {
+		var err error
+		if profiles, err = chromiumProfiles(dataDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(b.Profiles) == 0 {
+		return profiles, nil
+	}
+	selected := []profile{}
+	for _, name := range b.Profiles {
+		i := slices.IndexFunc(profiles, func(p profile) bool { return p.Name == name })
+		if i == -1 {
+			return nil, fmt.Errorf("profile %q not found in %s", name, dataDir)
+		}
+		selected = append(selected, profiles[i])
+	}
+	return selected, nil
+}
+
+// locked returns true if the browser is using any of the profiles.
+func (b *Browser) locked(dataDir string, profiles []profile) (bool, error) {
+	if b.Browser != "firefox" {
+		// Chromium has a single lock for all profiles.
+		return symlinkLockHeld(filepath.Join(dataDir, "SingletonLock"))
+	}
+	for _, p := range profiles {
+		held, err := symlinkLockHeld(filepath.Join(dataDir, p.Dir, "lock"))
+		if err != nil || held {
+			return held, err
+		}
+		held, err = fcntlLockHeld(filepath.Join(dataDir, p.Dir, ".parentlock"))
+		if err != nil || held {
+			return held, err
+		}
+	}
+	return false, nil
+}
+
+// wait waits until the browser is closed.
+func (b *Browser) wait(dataDir string, profiles []profile, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for logged := false; ; logged = true {
+		held, err := b.locked(dataDir, profiles)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is still running after %v", b.Browser, timeout)
+		}
+		if !logged {
+			log.Printf("Waiting up to %v for %s to close...", timeout, b.Browser)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (b *Browser) Fetch(stagingDir string, rep *report.Source) error {
+	dataDir, err := b.dataDir()
+	if err != nil {
+		return err
+	}
+	profiles, err := b.profiles(dataDir, rep)
+	if err != nil {
+		return err
+	}
+	timeout := defaultWait
+	if b.WaitMinutes != 0 {
+		timeout = time.Duration(b.WaitMinutes) * time.Minute
+	}
+	if err := b.wait(dataDir, profiles, timeout); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(stagingDir, b.dest())
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	if err := fsutil.CopyFile(filepath.Join(dataDir, b.indexFile()), filepath.Join(dest, b.indexFile()), os.O_TRUNC, 0600); err != nil {
+		return err
+	}
+
+	for _, p := range profiles {
+		l := &local.Local{
+			Dir:     filepath.Join(dataDir, p.Dir),
+			Dest:    filepath.Join(b.dest(), p.Dir),
+			Exclude: b.excludes(),
+			Backend: "go",
+		}
+		if err := l.Fetch(stagingDir, rep); err != nil {
+			return fmt.Errorf("copying profile %q: %v", p.Name, err)
+		}
+		n, err := backupSQLite(l.Dir, filepath.Join(stagingDir, l.Dest), rep)
+		if err != nil {
+			return fmt.Errorf("copying databases of profile %q: %v", p.Name, err)
+		}
+		rep.Count("sqlite databases", n)
+	}
+	rep.Count("profiles", int64(len(profiles)))
+	return nil
+}
+
+func isSQLite(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		// The file is shorter than the header.
+		return false, nil
+	}
+	return bytes.Equal(header, sqliteHeader), nil
+}
+
+// backupSQLite replaces each SQLite database copied from srcDir to destDir
+// with a consistent copy made by the SQLite backup API. A raw copy of the
+// database may be corrupt if the browser wrote to it during the copy.
+func backupSQLite(srcDir, destDir string, rep *report.Source) (int64, error) {
+	n := int64(0)
+	err := filepath.WalkDir(destDir, func(dest string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if ok, err := isSQLite(dest); err != nil || !ok {
+			return err
+		}
+		rel, err := filepath.Rel(destDir, dest)
+		if err != nil {
+			return err
+		}
+		if err := sqliteBackup(filepath.Join(srcDir, rel), dest); err != nil {
+			rep.Warnf("%s: keeping a raw copy: %v", dest, err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// sqliteBackup replaces dest with a copy of the database src, keeping the
+// permissions and modification time of dest.
+func sqliteBackup(src, dest string) error {
+	fi, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+	tmp, err := sqlite.Backup(src, filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, time.Time{}, fi.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,194 @@
+package browser
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runSQLite(t *testing.T, db, sql string) string {
+	t.Helper()
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	out, err := exec.Command("sqlite3", db, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3: %v: %s", err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newFirefox creates a data directory with two profiles.
+func newFirefox(t *testing.T) string {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "profiles.ini"), `[General]
+StartWithLastProfile=1
+
+[Profile1]
+Name=work
+IsRelative=1
+Path=Profiles/def.work
+
+[Profile0]
+Name=default
+IsRelative=1
+Path=Profiles/abc.default
+Default=1
+
+[Profile2]
+Name=elsewhere
+IsRelative=0
+Path=/somewhere/else
+`)
+	for _, dir := range []string{"Profiles/abc.default", "Profiles/def.work"} {
+		writeFile(t, filepath.Join(dataDir, dir, "prefs.js"), "user_pref();")
+		writeFile(t, filepath.Join(dataDir, dir, "cache2/entries/1"), "cached")
+	}
+	return dataDir
+}
+
+func TestFirefoxProfiles(t *testing.T) {
+	profiles, warnings, err := firefoxProfiles(newFirefox(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []profile{
+		{"default", filepath.FromSlash("Profiles/abc.default")},
+		{"work", filepath.FromSlash("Profiles/def.work")},
+	}
+	if !slices.Equal(profiles, want) {
+		t.Errorf("profiles = %v; want %v", profiles, want)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("warnings = %q; want 1", warnings)
+	}
+}
+
+func TestChromiumProfiles(t *testing.T) {
+	dataDir := t.TempDir()
+	writeFile(t, filepath.Join(dataDir, "Local State"), `{"profile": {"info_cache": {
+		"Profile 1": {"name": "Work"},
+		"Default": {"name": "Person 1"}
+	}}}`)
+	profiles, err := chromiumProfiles(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []profile{{"Person 1", "Default"}, {"Work", "Profile 1"}}
+	if !slices.Equal(profiles, want) {
+		t.Errorf("profiles = %v; want %v", profiles, want)
+	}
+
+	writeFile(t, filepath.Join(dataDir, "Local State"), `{"profile": {"info_cache": {"../etc": {}}}}`)
+	if _, err := chromiumProfiles(dataDir); err == nil {
+		t.Error("chromiumProfiles() with a path outside the data directory succeeded")
+	}
+}
+
+func TestFetchFirefox(t *testing.T) {
+	dataDir := newFirefox(t)
+	db := filepath.Join(dataDir, "Profiles/abc.default/places.sqlite")
+	runSQLite(t, db, "PRAGMA journal_mode=WAL; CREATE TABLE moz_places (url TEXT); INSERT INTO moz_places VALUES ('https://example.com');")
+
+	b := &Browser{Browser: "firefox", DataDir: dataDir, Dest: "firefox", Profiles: []string{"default"}}
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := b.Fetch(stagingDir, rep.Source(b.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(stagingDir, "firefox")
+	for _, file := range []string{"profiles.ini", "Profiles/abc.default/prefs.js"} {
+		if _, err := os.Stat(filepath.Join(dest, file)); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, file := range []string{"Profiles/abc.default/cache2", "Profiles/def.work"} {
+		if _, err := os.Stat(filepath.Join(dest, file)); err == nil {
+			t.Errorf("%s was copied", file)
+		}
+	}
+	if got := runSQLite(t, filepath.Join(dest, "Profiles/abc.default/places.sqlite"), "SELECT url FROM moz_places"); got != "https://example.com" {
+		t.Errorf("copied database contains %q", got)
+	}
+	if got := rep.Counts[b.String()]["sqlite databases"]; got != 1 {
+		t.Errorf("counted %d sqlite databases; want 1", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	pollInterval = time.Millisecond
+	dataDir := t.TempDir()
+	lock := filepath.Join(dataDir, "SingletonLock")
+	b := &Browser{Browser: "chromium"}
+
+	// A lock of a process which exited is stale.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("host-"+strconv.Itoa(cmd.Process.Pid), lock); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.wait(dataDir, nil, 0); err != nil {
+		t.Errorf("wait() with a stale lock = %v", err)
+	}
+
+	// This process holds the lock.
+	os.Remove(lock)
+	if err := os.Symlink("host-"+strconv.Itoa(os.Getpid()), lock); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.wait(dataDir, nil, 10*time.Millisecond); err == nil {
+		t.Error("wait() with a held lock succeeded")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		os.Remove(lock)
+	}()
+	if err := b.wait(dataDir, nil, time.Minute); err != nil {
+		t.Errorf("wait() = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    Browser
+		ok   bool
+	}{
+		{"ok", Browser{Browser: "firefox", DataDir: "/home/me/.mozilla/firefox", Dest: "laptop/firefox"}, true},
+		{"defaults", Browser{Browser: "chromium"}, true},
+		{"unknown browser", Browser{Browser: "lynx"}, false},
+		{"relative data_dir", Browser{Browser: "firefox", DataDir: ".mozilla/firefox"}, false},
+		{"dest outside", Browser{Browser: "firefox", Dest: "../firefox"}, false},
+		{"negative wait", Browser{Browser: "firefox", WaitMinutes: -1}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.b.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v; want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
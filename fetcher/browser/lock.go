@@ -0,0 +1,56 @@
+package browser
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// symlinkLockHeld returns true if the lock at path is held by a running
+// process. Browsers create the lock as a symlink to a target ending in the
+// pid, for example "192.168.0.1:+1234" for Firefox and "hostname-1234" for
+// Chromium. A lock left behind by a crash is not held.
+func symlinkLockHeld(path string) (bool, error) {
+	target, err := os.Readlink(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	pid, err := strconv.Atoi(target[strings.LastIndexAny(target, "+-")+1:])
+	if err != nil {
+		// An unknown format is assumed to be held.
+		return true, nil
+	}
+	return processExists(pid), nil
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// fcntlLockHeld returns true if another process holds a POSIX lock on the
+// file at path. Firefox locks .parentlock in this way.
+func fcntlLockHeld(path string) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lk); err != nil {
+		return false, &fs.PathError{Op: "fcntl", Path: path, Err: err}
+	}
+	return lk.Type != unix.F_UNLCK, nil
+}
@@ -0,0 +1,103 @@
+package browser
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// profile is a directory containing the data of one browser profile.
+type profile struct {
+	Name string
+	// Dir is relative to the data directory.
+	Dir string
+}
+
+// firefoxProfiles reads the profiles from Firefox's profiles.ini. Profiles
+// with an absolute path outside of the data directory are skipped with a
+// warning in the returned list.
+func firefoxProfiles(dataDir string) ([]profile, []string, error) {
+	f, err := os.Open(filepath.Join(dataDir, "profiles.ini"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	// sections maps the name of each section to its keys.
+	sections := map[string]map[string]string{}
+	var section map[string]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, ";"), strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = map[string]string{}
+			sections[line[1:len(line)-1]] = section
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if ok && section != nil {
+				section[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	profiles := []profile{}
+	warnings := []string{}
+	for name, keys := range sections {
+		if !strings.HasPrefix(name, "Profile") || keys["Path"] == "" {
+			continue
+		}
+		dir := filepath.FromSlash(keys["Path"])
+		if keys["IsRelative"] == "0" {
+			rel, err := filepath.Rel(dataDir, dir)
+			if err != nil || !filepath.IsLocal(rel) {
+				warnings = append(warnings, fmt.Sprintf("skipping profile %q outside of %s: %s", keys["Name"], dataDir, dir))
+				continue
+			}
+			dir = rel
+		}
+		profiles = append(profiles, profile{Name: keys["Name"], Dir: dir})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Dir < profiles[j].Dir
+	})
+	return profiles, warnings, nil
+}
+
+// chromiumProfiles reads the profiles from Chromium's Local State file.
+func chromiumProfiles(dataDir string) ([]profile, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, "Local State"))
+	if err != nil {
+		return nil, err
+	}
+	state := struct {
+		Profile struct {
+			InfoCache map[string]struct {
+				Name string `json:"name"`
+			} `json:"info_cache"`
+		} `json:"profile"`
+	}{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing Local State: %v", err)
+	}
+
+	profiles := []profile{}
+	for dir, info := range state.Profile.InfoCache {
+		if !filepath.IsLocal(dir) {
+			return nil, fmt.Errorf("invalid profile directory %q in Local State", dir)
+		}
+		profiles = append(profiles, profile{Name: info.Name, Dir: dir})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Dir < profiles[j].Dir
+	})
+	return profiles, nil
+}
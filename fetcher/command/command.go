@@ -0,0 +1,117 @@
+// Package command fetches the output of a command, for example `crontab -l`
+// or `brew bundle dump --file=-`.
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/internal/fsutil"
+	"github.com/rjoleary/backup/report"
+)
+
+// defaultTimeout is how long the command may run.
+const defaultTimeout = 10 * time.Minute
+
+// maxStderr is the number of bytes of stderr kept in the report.
+const maxStderr = 4096
+
+// Command writes the stdout of a command to a file in the staging area.
+type Command struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// Dir is the working directory. It defaults to the current directory.
+	Dir string `json:"dir,omitempty"`
+	// TimeoutSeconds defaults to 10 minutes.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// Output is the file in the staging area, for example
+	// "laptop/crontab.txt".
+	Output string `json:"output"`
+}
+
+func (c *Command) String() string {
+	return strings.Join(append([]string{c.Command}, c.Args...), " ")
+}
+
+func (c *Command) Name() string {
+	return "Command"
+}
+
+func (c *Command) Validate() error {
+	if c.Command == "" {
+		return errors.New("command is required")
+	}
+	if c.Output == "" {
+		return errors.New("output is required")
+	}
+	if err := fetcher.ValidateDest("output", c.Output); err != nil {
+		return err
+	}
+	if c.TimeoutSeconds < 0 {
+		return errors.New("timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+func (c *Command) Deps() map[string][]string {
+	// Only check the command is installed. Running it may have side
+	// effects.
+	return map[string][]string{c.Command: {"sh", "-c", `command -v "$0"`, c.Command}}
+}
+
+func (c *Command) Destinations() []string {
+	return []string{c.Output}
+}
+
+func (c *Command) Fetch(stagingDir string, rep *report.Source) error {
+	timeout := defaultTimeout
+	if c.TimeoutSeconds != 0 {
+		timeout = time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output := filepath.Join(stagingDir, c.Output)
+	if err := os.MkdirAll(filepath.Dir(output), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stdout := &fsutil.CountingWriter{W: f}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	runErr := cmd.Run()
+	rep.Count("bytes", stdout.N)
+
+	if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+		if len(msg) > maxStderr {
+			msg = append([]byte("..."), msg[len(msg)-maxStderr:]...)
+		}
+		rep.Infof("stderr:\n%s", msg)
+	}
+	if cmd.ProcessState != nil {
+		rep.Infof("exit code %d", cmd.ProcessState.ExitCode())
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s timed out after %v", c.Command, timeout)
+	}
+	if runErr != nil {
+		return fmt.Errorf("%s: %v", c.Command, runErr)
+	}
+	return f.Close()
+}
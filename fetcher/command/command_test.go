@@ -0,0 +1,71 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func TestFetch(t *testing.T) {
+	dir := t.TempDir()
+	c := &Command{
+		Command: "sh",
+		Args:    []string{"-c", "pwd; echo warning >&2"},
+		Dir:     dir,
+		Output:  "laptop/pwd.txt",
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := c.Fetch(stagingDir, rep.Source(c.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(stagingDir, c.Output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != dir {
+		t.Errorf("output = %q; want %q", got, dir)
+	}
+	messages := []string{}
+	for _, e := range rep.Events {
+		messages = append(messages, e.Message)
+	}
+	if want := []string{"stderr:\nwarning", "exit code 0"}; strings.Join(messages, "|") != strings.Join(want, "|") {
+		t.Errorf("report = %q; want %q", messages, want)
+	}
+	if got := rep.Counts[c.String()]["bytes"]; got != int64(len(data)) {
+		t.Errorf("counted %d bytes; want %d", got, len(data))
+	}
+}
+
+func TestFetchFailure(t *testing.T) {
+	for _, c := range []*Command{
+		{Command: "sh", Args: []string{"-c", "exit 3"}, Output: "out"},
+		{Command: "sleep", Args: []string{"10"}, TimeoutSeconds: 1, Output: "out"},
+		{Command: "no-such-command", Output: "out"},
+	} {
+		if err := c.Fetch(t.TempDir(), nil); err == nil {
+			t.Errorf("Fetch() of %s succeeded", c)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []*Command{
+		{Output: "out"},
+		{Command: "true"},
+		{Command: "true", Output: "/etc/out"},
+		{Command: "true", Output: "out", TimeoutSeconds: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", c)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package database fetches consistent dumps of PostgreSQL, MySQL and SQLite
+// databases. Copying the files of a running database does not give a
+// consistent backup.
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/internal/fsutil"
+	"github.com/rjoleary/backup/report"
+)
+
+func validateDest(dest string) error {
+	if dest == "" {
+		return errors.New("dest is required")
+	}
+	return fetcher.ValidateDest("dest", dest)
+}
+
+// writeCredentials writes a file which is only readable by the owner to a new
+// temporary directory. The caller removes the directory.
+func writeCredentials(name, content string) (string, error) {
+	dir, err := os.MkdirTemp("", "backup_database")
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return file, nil
+}
+
+// compressTo creates the gzip file dest, with its contents written by fn. A
+// partial file is removed on failure.
+func compressTo(dest string, rep *report.Source, fn func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	counter := &fsutil.CountingWriter{W: gz}
+	err = fn(counter)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	rep.Count("dump bytes", counter.N)
+	return nil
+}
+
+// dump runs a dump command and compresses its output into dest. The output
+// on stderr is an error if the command fails, otherwise it is a warning.
+func dump(cmd *exec.Cmd, dest string, rep *report.Source) error {
+	return compressTo(dest, rep, func(w io.Writer) error {
+		stderr := &bytes.Buffer{}
+		cmd.Stdout = w
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		msg := strings.TrimSpace(stderr.String())
+		if err != nil {
+			if msg != "" {
+				return fmt.Errorf("%s: %v: %s", filepath.Base(cmd.Path), err, msg)
+			}
+			return fmt.Errorf("%s: %v", filepath.Base(cmd.Path), err)
+		}
+		if msg != "" {
+			rep.Warnf("%s", msg)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// fakeCommand puts a shell script with the given name first in PATH.
+func fakeCommand(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func readGzip(t *testing.T, file string) string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPostgres(t *testing.T) {
+	// The fake pg_dump prints its arguments and password file.
+	fakeCommand(t, "pg_dump", `echo "$@"; cat "$PGPASSFILE"`)
+	p := &Postgres{
+		Host:     "db.example.com",
+		Port:     5433,
+		User:     "backup",
+		Password: `p:a\ss`,
+		Database: "app",
+		Dest:     "db/app.sql.gz",
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	if err := p.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "--no-password --host=db.example.com --port=5433 --username=backup --dbname=app\n*:*:*:*:p\\:a\\\\ss\n"
+	if got := readGzip(t, filepath.Join(stagingDir, p.Dest)); got != want {
+		t.Errorf("dump = %q; want %q", got, want)
+	}
+}
+
+func TestPostgresFailure(t *testing.T) {
+	fakeCommand(t, "pg_dumpall", `echo partial; echo "connection refused" >&2; exit 1`)
+	p := &Postgres{Dest: "all.sql.gz"}
+	stagingDir := t.TempDir()
+	err := p.Fetch(stagingDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("Fetch() = %v; want the error from stderr", err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, p.Dest)); err == nil {
+		t.Error("partial dump was not removed")
+	}
+}
+
+func TestMySQL(t *testing.T) {
+	// The fake mysqldump prints its arguments and option file.
+	fakeCommand(t, "mysqldump", `echo "$@"; cat "${1#--defaults-extra-file=}"; echo "Warning: deprecated" >&2`)
+	m := &MySQL{
+		Host:      "localhost",
+		User:      "root",
+		Password:  `se"cret`,
+		Databases: []string{"a", "b"},
+		Dest:      "mysql.sql.gz",
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := m.Fetch(stagingDir, rep.Source(m.String())); err != nil {
+		t.Fatal(err)
+	}
+	got := readGzip(t, filepath.Join(stagingDir, m.Dest))
+	for _, want := range []string{
+		"--single-transaction --routines --events --triggers --databases a b\n",
+		"[client]\nhost=\"localhost\"\nuser=\"root\"\npassword=\"se\\\"cret\"\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dump %q does not contain %q", got, want)
+		}
+	}
+	if got := rep.Num(report.Warning); got != 1 {
+		t.Errorf("got %d warnings; want 1 from stderr", got)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	db := filepath.Join(t.TempDir(), "app.db")
+	if out, err := exec.Command("sqlite3", db, "CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('hello');").CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %v: %s", err, out)
+	}
+
+	s := &SQLite{Path: db, Dest: "app.sqlite.gz"}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	if err := s.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if err := os.WriteFile(restored, []byte(readGzip(t, filepath.Join(stagingDir, s.Dest))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sqlite3", restored, "SELECT v FROM t").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hello" {
+		t.Errorf("restored database contains %q", got)
+	}
+
+	// Only the dump is left in the staging area.
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("staging area contains %d files; want 1", len(entries))
+	}
+
+	if err := (&SQLite{Path: filepath.Join(t.TempDir(), "missing.db"), Dest: "x.gz"}).Fetch(stagingDir, nil); err == nil {
+		t.Error("Fetch() of a missing database succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range []interface{ Validate() error }{
+		&Postgres{},
+		&Postgres{Dest: "../x"},
+		&MySQL{Dest: "x", Port: 70000},
+		&SQLite{Dest: "x"},
+		&SQLite{Path: "app.db", Dest: "x"},
+	} {
+		if err := v.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", v)
+		}
+	}
+}
+
+// The server tests use the default connection settings of the client, for
+// example from PGHOST or ~/.my.cnf.
+
+func TestPostgresServer(t *testing.T) {
+	db := os.Getenv("TEST_POSTGRES_DATABASE")
+	if db == "" {
+		t.Skip("TEST_POSTGRES_DATABASE is not set")
+	}
+	p := &Postgres{Database: db, Dest: "pg.sql.gz"}
+	stagingDir := t.TempDir()
+	if err := p.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readGzip(t, filepath.Join(stagingDir, p.Dest)); !strings.Contains(got, "PostgreSQL database dump") {
+		t.Errorf("unexpected dump %.100q", got)
+	}
+}
+
+func TestMySQLServer(t *testing.T) {
+	db := os.Getenv("TEST_MYSQL_DATABASE")
+	if db == "" {
+		t.Skip("TEST_MYSQL_DATABASE is not set")
+	}
+	m := &MySQL{Databases: []string{db}, Dest: "mysql.sql.gz"}
+	stagingDir := t.TempDir()
+	if err := m.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readGzip(t, filepath.Join(stagingDir, m.Dest)); !strings.Contains(got, "CREATE DATABASE") {
+		t.Errorf("unexpected dump %.100q", got)
+	}
+}
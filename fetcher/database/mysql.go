@@ -0,0 +1,113 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// MySQL dumps MySQL or MariaDB databases with mysqldump into a gzipped SQL
+// file.
+type MySQL struct {
+	// Host, Port, User and Socket default to the same as mysql.
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Socket string `json:"socket,omitempty"`
+	User   string `json:"user,omitempty"`
+	// Password is passed to mysqldump in a temporary option file.
+	Password string `json:"password,omitempty"`
+	// Databases are the databases to dump. All databases are dumped by
+	// default.
+	Databases []string `json:"databases,omitempty"`
+	// Dest is the dump file in the staging area, for example
+	// "laptop/mysql/all.sql.gz".
+	Dest string `json:"dest"`
+}
+
+func (m *MySQL) String() string {
+	dbs := strings.Join(m.Databases, ", ")
+	if dbs == "" {
+		dbs = "all databases"
+	}
+	if m.Host != "" {
+		return fmt.Sprintf("mysql %s on %s", dbs, m.Host)
+	}
+	return "mysql " + dbs
+}
+
+func (m *MySQL) Name() string {
+	return "MySQL"
+}
+
+func (m *MySQL) Validate() error {
+	if m.Port < 0 || m.Port > 65535 {
+		return fmt.Errorf("invalid port %d", m.Port)
+	}
+	return validateDest(m.Dest)
+}
+
+func (m *MySQL) Deps() map[string][]string {
+	return map[string][]string{"mysqldump": {"mysqldump", "--version"}}
+}
+
+func (m *MySQL) Destinations() []string {
+	return []string{m.Dest}
+}
+
+// optionValue quotes a value in an option file.
+func optionValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// optionFile returns the [client] section of an option file with the
+// connection settings, which keeps the password out of the arguments.
+func (m *MySQL) optionFile() string {
+	b := &strings.Builder{}
+	b.WriteString("[client]\n")
+	for _, opt := range []struct{ key, value string }{
+		{"host", m.Host},
+		{"socket", m.Socket},
+		{"user", m.User},
+		{"password", m.Password},
+	} {
+		if opt.value != "" {
+			fmt.Fprintf(b, "%s=%s\n", opt.key, optionValue(opt.value))
+		}
+	}
+	if m.Port != 0 {
+		fmt.Fprintf(b, "port=%d\n", m.Port)
+	}
+	return b.String()
+}
+
+func (m *MySQL) args(optionFile string) []string {
+	return append([]string{
+		// This must be the first argument.
+		"--defaults-extra-file=" + optionFile,
+		// Dump InnoDB tables in a consistent state without locking.
+		"--single-transaction",
+		"--routines",
+		"--events",
+		"--triggers",
+	}, m.databaseArgs()...)
+}
+
+func (m *MySQL) databaseArgs() []string {
+	if len(m.Databases) == 0 {
+		return []string{"--all-databases"}
+	}
+	return append([]string{"--databases"}, m.Databases...)
+}
+
+func (m *MySQL) Fetch(stagingDir string, rep *report.Source) error {
+	optionFile, err := writeCredentials("my.cnf", m.optionFile())
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(filepath.Dir(optionFile))
+	return dump(exec.Command("mysqldump", m.args(optionFile)...), filepath.Join(stagingDir, m.Dest), rep)
+}
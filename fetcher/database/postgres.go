@@ -0,0 +1,104 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// Postgres dumps a PostgreSQL database with pg_dump, or every database with
+// pg_dumpall, into a gzipped SQL file.
+type Postgres struct {
+	// Host, Port and User default to the same as psql.
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port,omitempty"`
+	User string `json:"user,omitempty"`
+	// Password is passed to pg_dump in a temporary password file.
+	Password string `json:"password,omitempty"`
+	// Database is the database to dump. If it is empty, all databases
+	// are dumped with pg_dumpall.
+	Database string `json:"database,omitempty"`
+	// Dest is the dump file in the staging area, for example
+	// "laptop/postgres/mydb.sql.gz".
+	Dest string `json:"dest"`
+}
+
+func (p *Postgres) String() string {
+	db := p.Database
+	if db == "" {
+		db = "all databases"
+	}
+	if p.Host != "" {
+		return fmt.Sprintf("postgres %s on %s", db, p.Host)
+	}
+	return "postgres " + db
+}
+
+func (p *Postgres) Name() string {
+	return "Postgres"
+}
+
+func (p *Postgres) Validate() error {
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid port %d", p.Port)
+	}
+	return validateDest(p.Dest)
+}
+
+func (p *Postgres) Deps() map[string][]string {
+	if p.Database == "" {
+		return map[string][]string{"pg_dumpall": {"pg_dumpall", "--version"}}
+	}
+	return map[string][]string{"pg_dump": {"pg_dump", "--version"}}
+}
+
+func (p *Postgres) Destinations() []string {
+	return []string{p.Dest}
+}
+
+// pgpassEscape escapes a field of a password file.
+func pgpassEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(s)
+}
+
+func (p *Postgres) args() []string {
+	// The password is never prompted for.
+	args := []string{"--no-password"}
+	if p.Host != "" {
+		args = append(args, "--host="+p.Host)
+	}
+	if p.Port != 0 {
+		args = append(args, "--port="+strconv.Itoa(p.Port))
+	}
+	if p.User != "" {
+		args = append(args, "--username="+p.User)
+	}
+	if p.Database != "" {
+		args = append(args, "--dbname="+p.Database)
+	}
+	return args
+}
+
+func (p *Postgres) Fetch(stagingDir string, rep *report.Source) error {
+	name := "pg_dump"
+	if p.Database == "" {
+		name = "pg_dumpall"
+	}
+	cmd := exec.Command(name, p.args()...)
+	cmd.Env = os.Environ()
+	if p.Password != "" {
+		// The password applies to any host, port, database and user.
+		passFile, err := writeCredentials("pgpass", "*:*:*:*:"+pgpassEscape(p.Password)+"\n")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(filepath.Dir(passFile))
+		cmd.Env = append(cmd.Env, "PGPASSFILE="+passFile)
+	}
+	return dump(cmd, filepath.Join(stagingDir, p.Dest), rep)
+}
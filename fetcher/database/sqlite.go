@@ -0,0 +1,80 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rjoleary/backup/internal/sqlite"
+	"github.com/rjoleary/backup/report"
+)
+
+// SQLite copies a SQLite database with the online backup API into a gzipped
+// database file. The copy is consistent even if the database is being
+// written.
+type SQLite struct {
+	// Path is the absolute path of the database file.
+	Path string `json:"path"`
+	// Dest is the file in the staging area, for example
+	// "laptop/app.sqlite.gz".
+	Dest string `json:"dest"`
+}
+
+func (s *SQLite) String() string {
+	return "sqlite " + s.Path
+}
+
+func (s *SQLite) Name() string {
+	return "SQLite"
+}
+
+func (s *SQLite) Validate() error {
+	if s.Path == "" {
+		return errors.New("path is required")
+	}
+	// sqlite3 runs in the staging area, so a relative path would not
+	// refer to the database.
+	if !filepath.IsAbs(s.Path) {
+		return fmt.Errorf("path must be absolute, got %q", s.Path)
+	}
+	return validateDest(s.Dest)
+}
+
+func (s *SQLite) Deps() map[string][]string {
+	return map[string][]string{"sqlite3": {"sqlite3", "-version"}}
+}
+
+func (s *SQLite) Destinations() []string {
+	return []string{s.Dest}
+}
+
+func (s *SQLite) Fetch(stagingDir string, rep *report.Source) error {
+	// sqlite3 does not create a missing database when opened read-only.
+	if _, err := os.Stat(s.Path); err != nil {
+		return err
+	}
+
+	// The uncompressed copy is kept in the staging area, which is
+	// encrypted.
+	dest := filepath.Join(stagingDir, s.Dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	tmp, err := sqlite.Backup(s.Path, filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return compressTo(dest, rep, func(w io.Writer) error {
+		f, err := os.Open(tmp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+}
@@ -0,0 +1,544 @@
+// Package dav fetches calendars with CalDAV (RFC 4791) and address books with
+// CardDAV (RFC 6352).
+package dav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// stateFile records the sync token and objects of each collection, so only
+// the changes are downloaded when the staging area is reused.
+const stateFile = ".backup-state.json"
+
+// multigetBatch is the number of objects downloaded per request.
+const multigetBatch = 100
+
+// DAV exports the calendars and address books of a user. Each event, task or
+// contact is saved as a file in a directory per collection, for example
+// dest/calendars/<calendar>/<name>.ics and dest/contacts/<address book>/<name>.vcf.
+// Directories and files are named after the last element of the collection's
+// or object's path on the server, or a hash of the path if that is not a safe
+// file name. A hash of the path is also appended to the directory of a
+// collection whose name is already taken by another collection.
+// Objects deleted on the server are deleted from the export.
+type DAV struct {
+	// URL is the DAV endpoint of the server, for example
+	// "https://cloud.example.com/remote.php/dav". The user's collections
+	// are discovered from it.
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Calendars and Contacts choose what is exported. Both are exported
+	// if neither is set.
+	Calendars bool   `json:"calendars,omitempty"`
+	Contacts  bool   `json:"contacts,omitempty"`
+	Dest      string `json:"dest"`
+}
+
+// kind is a type of collection.
+type kind struct {
+	// resourceType is the element in the collection's resourcetype.
+	resourceType string
+	homeSet      string
+	namespace    string
+	multiget     string
+	data         string
+	dir          string
+	ext          string
+}
+
+var (
+	calendars = &kind{"calendar", "calendar-home-set", "urn:ietf:params:xml:ns:caldav", "calendar-multiget", "calendar-data", "calendars", ".ics"}
+	contacts  = &kind{"addressbook", "addressbook-home-set", "urn:ietf:params:xml:ns:carddav", "addressbook-multiget", "address-data", "contacts", ".vcf"}
+)
+
+// collection is a discovered calendar or address book.
+type collection struct {
+	kind      *kind
+	url       *url.URL
+	name      string
+	syncToken string
+}
+
+type state struct {
+	// Collections is keyed by the path of the collection.
+	Collections map[string]*collectionState `json:"collections"`
+}
+
+type collectionState struct {
+	// Dir is relative to Dest. It is kept, so the directory does not change
+	// when a collection with the same name is added or removed.
+	Dir       string `json:"dir,omitempty"`
+	SyncToken string `json:"sync_token,omitempty"`
+	// Objects is keyed by the path of the object.
+	Objects map[string]object `json:"objects"`
+}
+
+type object struct {
+	ETag string `json:"etag"`
+	// File is relative to Dest.
+	File string `json:"file"`
+}
+
+type multistatus struct {
+	Responses []davResponse `xml:"response"`
+	SyncToken string        `xml:"sync-token"`
+}
+
+type davResponse struct {
+	Href     string `xml:"href"`
+	Status   string `xml:"status"`
+	Propstat []struct {
+		Status string `xml:"status"`
+		Prop   prop   `xml:"prop"`
+	} `xml:"propstat"`
+}
+
+type hrefs struct {
+	Href []string `xml:"href"`
+}
+
+type prop struct {
+	CurrentUserPrincipal hrefs `xml:"current-user-principal"`
+	CalendarHomeSet      hrefs `xml:"calendar-home-set"`
+	AddressbookHomeSet   hrefs `xml:"addressbook-home-set"`
+	ResourceType         struct {
+		Calendar    *struct{} `xml:"calendar"`
+		Addressbook *struct{} `xml:"addressbook"`
+	} `xml:"resourcetype"`
+	DisplayName  string `xml:"displayname"`
+	SyncToken    string `xml:"sync-token"`
+	ETag         string `xml:"getetag"`
+	CalendarData string `xml:"calendar-data"`
+	AddressData  string `xml:"address-data"`
+}
+
+// prop returns the properties which were found.
+func (r *davResponse) prop() *prop {
+	for _, ps := range r.Propstat {
+		if strings.Contains(ps.Status, " 200 ") {
+			return &ps.Prop
+		}
+	}
+	return &prop{}
+}
+
+func (d *DAV) String() string {
+	if u, err := url.Parse(d.URL); err == nil {
+		return d.Username + "@" + u.Host
+	}
+	return d.Username
+}
+
+func (d *DAV) Name() string {
+	return "DAV"
+}
+
+func (d *DAV) Validate() error {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https url, got %q", d.URL)
+	}
+	if d.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", d.Dest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *DAV) Destinations() []string {
+	return []string{d.Dest}
+}
+
+func (d *DAV) kinds() []*kind {
+	kinds := []*kind{}
+	if d.Calendars || !d.Contacts {
+		kinds = append(kinds, calendars)
+	}
+	if d.Contacts || !d.Calendars {
+		kinds = append(kinds, contacts)
+	}
+	return kinds
+}
+
+// request sends a PROPFIND or REPORT and parses the multistatus response.
+func (d *DAV) request(method string, u *url.URL, depth, body string) (*multistatus, error) {
+	req, err := http.NewRequest(method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if d.Username != "" || d.Password != "" {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	ms := &multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return nil, fmt.Errorf("%s %s: %v", method, u.Redacted(), err)
+	}
+	return ms, nil
+}
+
+func propfindBody(props string) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:card="urn:ietf:params:xml:ns:carddav">
+<d:prop>` + props + `</d:prop></d:propfind>`
+}
+
+// discover finds the user's collections through the principal's home sets.
+func (d *DAV) discover() ([]collection, error) {
+	root, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	principal := root
+	ms, err := d.request("PROPFIND", root, "0", propfindBody(`<d:current-user-principal/>`))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ms.Responses {
+		if p := r.prop().CurrentUserPrincipal.Href; len(p) != 0 {
+			if principal, err = root.Parse(p[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ms, err = d.request("PROPFIND", principal, "0", propfindBody(`<c:calendar-home-set/><card:addressbook-home-set/>`))
+	if err != nil {
+		return nil, err
+	}
+	homeSets := map[*kind][]string{}
+	for _, r := range ms.Responses {
+		homeSets[calendars] = append(homeSets[calendars], r.prop().CalendarHomeSet.Href...)
+		homeSets[contacts] = append(homeSets[contacts], r.prop().AddressbookHomeSet.Href...)
+	}
+
+	collections := []collection{}
+	for _, k := range d.kinds() {
+		if len(homeSets[k]) == 0 {
+			return nil, fmt.Errorf("the principal %s has no %s", principal.Redacted(), k.homeSet)
+		}
+		for _, h := range homeSets[k] {
+			home, err := principal.Parse(h)
+			if err != nil {
+				return nil, err
+			}
+			ms, err := d.request("PROPFIND", home, "1", propfindBody(`<d:resourcetype/><d:displayname/><d:sync-token/>`))
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range ms.Responses {
+				p := r.prop()
+				if (k == calendars && p.ResourceType.Calendar == nil) || (k == contacts && p.ResourceType.Addressbook == nil) {
+					continue
+				}
+				u, err := home.Parse(r.Href)
+				if err != nil {
+					return nil, err
+				}
+				collections = append(collections, collection{
+					kind:      k,
+					url:       u,
+					name:      p.DisplayName,
+					syncToken: p.SyncToken,
+				})
+			}
+		}
+	}
+	return collections, nil
+}
+
+// fileName returns a file name for the last element of the path p.
+func fileName(p, ext string) string {
+	name := path.Base(p)
+	if !filepath.IsLocal(name) || strings.ContainsAny(name, `/\:`) || strings.HasPrefix(name, ".") {
+		sum := sha256.Sum256([]byte(p))
+		name = hex.EncodeToString(sum[:8])
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+	return name
+}
+
+func (d *DAV) Fetch(stagingDir string, rep *report.Source) error {
+	s := &state{Collections: map[string]*collectionState{}}
+	file := filepath.Join(stagingDir, d.Dest, stateFile)
+	if data, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			rep.Warnf("ignoring invalid %s: %v", file, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s.Collections == nil {
+		s.Collections = map[string]*collectionState{}
+	}
+
+	collections, err := d.discover()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, c := range collections {
+		seen[c.url.Path] = true
+		if s.Collections[c.url.Path] == nil {
+			s.Collections[c.url.Path] = &collectionState{}
+		}
+	}
+	// Collections deleted on the server are removed from the export.
+	for p, cs := range s.Collections {
+		if !seen[p] {
+			for _, o := range cs.Objects {
+				os.Remove(filepath.Join(stagingDir, d.Dest, filepath.FromSlash(o.File)))
+			}
+			delete(s.Collections, p)
+		}
+	}
+	assignDirs(collections, s)
+
+	failed := 0
+	for _, c := range collections {
+		cs := s.Collections[c.url.Path]
+		if cs.Objects == nil {
+			cs.Objects = map[string]object{}
+		}
+		if err := d.sync(stagingDir, cs.Dir, c, cs, rep); err != nil {
+			rep.Warnf("%s %q: %v", c.kind.resourceType, c.name, err)
+			failed++
+		}
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to export %d collections", failed)
+	}
+	return nil
+}
+
+// assignDirs chooses the directory of each collection which does not have
+// one yet. Collections in different home sets may have the same name, in
+// which case the directories of the later ones get a hash of their path.
+func assignDirs(collections []collection, s *state) {
+	taken := map[string]bool{}
+	for _, cs := range s.Collections {
+		if cs.Dir != "" {
+			taken[cs.Dir] = true
+		}
+	}
+	for _, c := range collections {
+		cs := s.Collections[c.url.Path]
+		if cs.Dir != "" {
+			continue
+		}
+		dir := path.Join(c.kind.dir, fileName(c.url.Path, ""))
+		if taken[dir] {
+			sum := sha256.Sum256([]byte(c.url.Path))
+			dir += "-" + hex.EncodeToString(sum[:8])
+		}
+		cs.Dir = dir
+		taken[dir] = true
+	}
+}
+
+// sync updates the export of a collection in dir, which is relative to Dest.
+func (d *DAV) sync(stagingDir, dir string, c collection, cs *collectionState, rep *report.Source) error {
+	if cs.SyncToken != "" && cs.SyncToken == c.syncToken {
+		rep.Count("unchanged collections", 1)
+		return nil
+	}
+
+	var changed, deleted []string
+	token := ""
+	if cs.SyncToken != "" {
+		var err error
+		changed, deleted, token, err = d.syncCollection(c, cs.SyncToken)
+		if err != nil {
+			// For example, the token expired.
+			rep.Infof("%s %q: full sync after incremental sync failed: %v", c.kind.resourceType, c.name, err)
+			token = ""
+		}
+	}
+	if token == "" {
+		var err error
+		changed, deleted, err = d.list(c, cs)
+		if err != nil {
+			return err
+		}
+		token = c.syncToken
+	}
+
+	if err := os.MkdirAll(filepath.Join(stagingDir, d.Dest, filepath.FromSlash(dir)), 0700); err != nil {
+		return err
+	}
+	for i := 0; i < len(changed); i += multigetBatch {
+		batch := changed[i:min(i+multigetBatch, len(changed))]
+		if err := d.multiget(stagingDir, dir, c, cs, batch, rep); err != nil {
+			return err
+		}
+	}
+	for _, p := range deleted {
+		if o, ok := cs.Objects[p]; ok {
+			if err := os.Remove(filepath.Join(stagingDir, d.Dest, filepath.FromSlash(o.File))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			delete(cs.Objects, p)
+			rep.Count("deleted objects", 1)
+		}
+	}
+	cs.SyncToken = token
+	return nil
+}
+
+// syncCollection returns the paths of the objects which changed and were
+// deleted since token (RFC 6578), and the new token.
+func (d *DAV) syncCollection(c collection, token string) (changed, deleted []string, newToken string, err error) {
+	for {
+		escaped := &strings.Builder{}
+		xml.EscapeText(escaped, []byte(token))
+		ms, err := d.request("REPORT", c.url, "0", `<?xml version="1.0" encoding="utf-8"?>
+<d:sync-collection xmlns:d="DAV:"><d:sync-token>`+escaped.String()+`</d:sync-token>
+<d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if ms.SyncToken == "" {
+			return nil, nil, "", errors.New("no sync-token in response")
+		}
+		truncated := false
+		for _, r := range ms.Responses {
+			u, err := c.url.Parse(r.Href)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			switch {
+			case strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(c.url.Path, "/"):
+				// The server has more changes for the new token.
+				truncated = strings.Contains(r.Status, " 507 ")
+			case strings.Contains(r.Status, " 404 "):
+				deleted = append(deleted, u.Path)
+			default:
+				changed = append(changed, u.Path)
+			}
+		}
+		token = ms.SyncToken
+		if !truncated {
+			return changed, deleted, token, nil
+		}
+	}
+}
+
+// list returns the paths of the objects which changed and were deleted since
+// the last export by comparing their ETags.
+func (d *DAV) list(c collection, cs *collectionState) (changed, deleted []string, err error) {
+	ms, err := d.request("PROPFIND", c.url, "1", propfindBody(`<d:getetag/>`))
+	if err != nil {
+		return nil, nil, err
+	}
+	members := map[string]bool{}
+	for _, r := range ms.Responses {
+		u, err := c.url.Parse(r.Href)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasSuffix(u.Path, "/") {
+			continue
+		}
+		members[u.Path] = true
+		if o, ok := cs.Objects[u.Path]; !ok || o.ETag != r.prop().ETag {
+			changed = append(changed, u.Path)
+		}
+	}
+	for p := range cs.Objects {
+		if !members[p] {
+			deleted = append(deleted, p)
+		}
+	}
+	return changed, deleted, nil
+}
+
+// multiget downloads the objects with the paths in batch.
+func (d *DAV) multiget(stagingDir, dir string, c collection, cs *collectionState, batch []string, rep *report.Source) error {
+	body := &strings.Builder{}
+	fmt.Fprintf(body, `<?xml version="1.0" encoding="utf-8"?>
+<x:%s xmlns:d="DAV:" xmlns:x="%s"><d:prop><d:getetag/><x:%s/></d:prop>`, c.kind.multiget, c.kind.namespace, c.kind.data)
+	for _, p := range batch {
+		body.WriteString("<d:href>")
+		xml.EscapeText(body, []byte((&url.URL{Path: p}).EscapedPath()))
+		body.WriteString("</d:href>")
+	}
+	fmt.Fprintf(body, "</x:%s>", c.kind.multiget)
+
+	ms, err := d.request("REPORT", c.url, "1", body.String())
+	if err != nil {
+		return err
+	}
+	for _, r := range ms.Responses {
+		u, err := c.url.Parse(r.Href)
+		if err != nil {
+			return err
+		}
+		p := r.prop()
+		data := p.CalendarData
+		if c.kind == contacts {
+			data = p.AddressData
+		}
+		if data == "" {
+			// The object was deleted after it was listed.
+			rep.Warnf("%s: %s", u.Path, strings.TrimSpace(r.Status))
+			continue
+		}
+		// XML parsers normalize line endings, but iCalendar and vCard use
+		// CRLF.
+		if !strings.Contains(data, "\r\n") {
+			data = strings.ReplaceAll(data, "\n", "\r\n")
+		}
+		file := path.Join(dir, fileName(u.Path, c.kind.ext))
+		if err := os.WriteFile(filepath.Join(stagingDir, d.Dest, filepath.FromSlash(file)), []byte(data), 0600); err != nil {
+			return err
+		}
+		cs.Objects[u.Path] = object{ETag: p.ETag, File: file}
+		rep.Count("downloaded objects", 1)
+	}
+	return nil
+}
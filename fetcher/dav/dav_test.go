@@ -0,0 +1,436 @@
+package dav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+type fakeCollection struct {
+	resourceType string
+	name         string
+	version      int
+	// objects maps the file name to the data.
+	objects map[string]string
+	etags   map[string]string
+	// changed maps the file name to the version it last changed.
+	changed map[string]int
+}
+
+// fakeDAV is a CalDAV and CardDAV server for the user "me".
+type fakeDAV struct {
+	mu sync.Mutex
+	// collections is keyed by path.
+	collections map[string]*fakeCollection
+	// expireTokens rejects every sync token.
+	expireTokens bool
+	// sharedCalendars adds a second calendar home set.
+	sharedCalendars bool
+	// requests are the method, path and root element of the requests.
+	requests []string
+}
+
+func newFakeDAV() *fakeDAV {
+	return &fakeDAV{collections: map[string]*fakeCollection{}}
+}
+
+func (f *fakeDAV) put(collection, name, data string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.collections[collection]
+	c.version++
+	c.objects[name] = data
+	c.etags[name] = fmt.Sprintf(`"%d"`, c.version)
+	c.changed[name] = c.version
+}
+
+func (f *fakeDAV) delete(collection, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.collections[collection]
+	c.version++
+	delete(c.objects, name)
+	c.changed[name] = c.version
+}
+
+func (f *fakeDAV) addCollection(p, resourceType, name string) {
+	f.collections[p] = &fakeCollection{
+		resourceType: resourceType,
+		name:         name,
+		objects:      map[string]string{},
+		etags:        map[string]string{},
+		changed:      map[string]int{},
+	}
+}
+
+func (f *fakeDAV) reports() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reports := []string{}
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "REPORT ") {
+			reports = append(reports, strings.TrimPrefix(r, "REPORT "))
+		}
+	}
+	f.requests = nil
+	return reports
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []string, syncToken string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav" xmlns:card="urn:ietf:params:xml:ns:carddav">`)
+	for _, r := range responses {
+		fmt.Fprint(w, r)
+	}
+	if syncToken != "" {
+		fmt.Fprintf(w, "<d:sync-token>%s</d:sync-token>", syncToken)
+	}
+	fmt.Fprint(w, "</d:multistatus>")
+}
+
+func propResponse(href, props string) string {
+	return fmt.Sprintf("<d:response><d:href>%s</d:href><d:propstat><d:prop>%s</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>", href, props)
+}
+
+func escape(s string) string {
+	b := &strings.Builder{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, _ := r.BasicAuth(); user != "me" || pass != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	req := struct {
+		XMLName   xml.Name
+		SyncToken string   `xml:"sync-token"`
+		Hrefs     []string `xml:"href"`
+	}{}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+req.XMLName.Local)
+
+	switch p := r.URL.Path; {
+	case r.Method == "PROPFIND" && p == "/dav/":
+		writeMultistatus(w, []string{propResponse(p, "<d:current-user-principal><d:href>/dav/principals/me/</d:href></d:current-user-principal>")}, "")
+	case r.Method == "PROPFIND" && p == "/dav/principals/me/":
+		calendarHomes := "<d:href>/dav/calendars/me/</d:href>"
+		if f.sharedCalendars {
+			calendarHomes += "<d:href>/dav/calendars/shared/</d:href>"
+		}
+		writeMultistatus(w, []string{propResponse(p,
+			"<cal:calendar-home-set>"+calendarHomes+"</cal:calendar-home-set>"+
+				"<card:addressbook-home-set><d:href>/dav/addressbooks/me/</d:href></card:addressbook-home-set>")}, "")
+	case r.Method == "PROPFIND" && (p == "/dav/calendars/me/" || p == "/dav/addressbooks/me/" || f.sharedCalendars && p == "/dav/calendars/shared/"):
+		responses := []string{propResponse(p, "<d:resourcetype><d:collection/></d:resourcetype>")}
+		paths := []string{}
+		for cp := range f.collections {
+			if strings.HasPrefix(cp, p) {
+				paths = append(paths, cp)
+			}
+		}
+		sort.Strings(paths)
+		for _, cp := range paths {
+			c := f.collections[cp]
+			ns := "cal"
+			if c.resourceType == "addressbook" {
+				ns = "card"
+			}
+			responses = append(responses, propResponse(cp, fmt.Sprintf(
+				"<d:resourcetype><d:collection/><%s:%s/></d:resourcetype><d:displayname>%s</d:displayname><d:sync-token>token-%d</d:sync-token>",
+				ns, c.resourceType, escape(c.name), c.version)))
+		}
+		writeMultistatus(w, responses, "")
+	case r.Method == "PROPFIND" && f.collections[p] != nil:
+		c := f.collections[p]
+		responses := []string{propResponse(p, "<d:resourcetype><d:collection/></d:resourcetype>")}
+		for name, etag := range c.etags {
+			if _, ok := c.objects[name]; ok {
+				responses = append(responses, propResponse(p+name, "<d:getetag>"+escape(etag)+"</d:getetag>"))
+			}
+		}
+		writeMultistatus(w, responses, "")
+	case r.Method == "REPORT" && req.XMLName.Local == "sync-collection" && f.collections[p] != nil:
+		c := f.collections[p]
+		since, err := strconv.Atoi(strings.TrimPrefix(req.SyncToken, "token-"))
+		if err != nil || f.expireTokens {
+			http.Error(w, "<d:error xmlns:d=\"DAV:\"><d:valid-sync-token/></d:error>", http.StatusForbidden)
+			return
+		}
+		responses := []string{}
+		for name, version := range c.changed {
+			if version <= since {
+				continue
+			}
+			if _, ok := c.objects[name]; ok {
+				responses = append(responses, propResponse(p+name, "<d:getetag>"+escape(c.etags[name])+"</d:getetag>"))
+			} else {
+				responses = append(responses, fmt.Sprintf("<d:response><d:href>%s</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>", p+name))
+			}
+		}
+		writeMultistatus(w, responses, fmt.Sprintf("token-%d", c.version))
+	case r.Method == "REPORT" && (req.XMLName.Local == "calendar-multiget" || req.XMLName.Local == "addressbook-multiget") && f.collections[p] != nil:
+		c := f.collections[p]
+		element := "cal:calendar-data"
+		if c.resourceType == "addressbook" {
+			element = "card:address-data"
+		}
+		responses := []string{}
+		for _, href := range req.Hrefs {
+			name := strings.TrimPrefix(href, p)
+			if data, ok := c.objects[name]; ok {
+				// Like most servers, the line endings are not escaped.
+				data = strings.ReplaceAll(escape(data), "&#xD;&#xA;", "\r\n")
+				responses = append(responses, propResponse(href, fmt.Sprintf("<d:getetag>%s</d:getetag><%s>%s</%s>", escape(c.etags[name]), element, data, element)))
+			} else {
+				responses = append(responses, fmt.Sprintf("<d:response><d:href>%s</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>", href))
+			}
+		}
+		writeMultistatus(w, responses, "")
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// readExport returns the files in the export, except the state file.
+func readExport(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == stateFile {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+const (
+	event1  = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:One & two\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	event2  = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:2\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	contact = "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Jane <Doe>\r\nEND:VCARD\r\n"
+)
+
+func TestFetch(t *testing.T) {
+	srv := newFakeDAV()
+	srv.addCollection("/dav/calendars/me/personal/", "calendar", "Personal")
+	srv.addCollection("/dav/calendars/me/work/", "calendar", "Work")
+	srv.addCollection("/dav/addressbooks/me/contacts/", "addressbook", "Contacts")
+	srv.put("/dav/calendars/me/personal/", "1.ics", event1)
+	srv.put("/dav/calendars/me/personal/", "2.ics", event2)
+	srv.put("/dav/calendars/me/work/", "w", event1)
+	srv.put("/dav/addressbooks/me/contacts/", "jane.vcf", contact)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	d := &DAV{URL: ts.URL + "/dav/", Username: "me", Password: "secret", Dest: "dav"}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	exportDir := filepath.Join(stagingDir, "dav")
+	rep := report.New()
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"calendars/personal/1.ics":   event1,
+		"calendars/personal/2.ics":   event2,
+		"calendars/work/w.ics":       event1,
+		"contacts/contacts/jane.vcf": contact,
+	}
+	if got := readExport(t, exportDir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+	if got, want := strings.Join(srv.reports(), ", "), "/dav/calendars/me/personal/ calendar-multiget, /dav/calendars/me/work/ calendar-multiget, /dav/addressbooks/me/contacts/ addressbook-multiget"; got != want {
+		t.Errorf("reports = %q; want %q", got, want)
+	}
+
+	// Nothing is downloaded if the sync tokens did not change.
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.reports(); len(got) != 0 {
+		t.Errorf("reports = %q; want none", got)
+	}
+
+	// Only the changes are downloaded.
+	srv.put("/dav/calendars/me/personal/", "1.ics", event2)
+	srv.delete("/dav/calendars/me/personal/", "2.ics")
+	srv.put("/dav/calendars/me/personal/", "3.ics", event1)
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"calendars/personal/1.ics":   event2,
+		"calendars/personal/3.ics":   event1,
+		"calendars/work/w.ics":       event1,
+		"contacts/contacts/jane.vcf": contact,
+	}
+	if got := readExport(t, exportDir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+	if got, want := strings.Join(srv.reports(), ", "), "/dav/calendars/me/personal/ sync-collection, /dav/calendars/me/personal/ calendar-multiget"; got != want {
+		t.Errorf("reports = %q; want %q", got, want)
+	}
+
+	// Expired tokens fall back to comparing the ETags.
+	srv.expireTokens = true
+	srv.delete("/dav/addressbooks/me/contacts/", "jane.vcf")
+	srv.put("/dav/addressbooks/me/contacts/", "john.vcf", contact)
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"calendars/personal/1.ics":   event2,
+		"calendars/personal/3.ics":   event1,
+		"calendars/work/w.ics":       event1,
+		"contacts/contacts/john.vcf": contact,
+	}
+	if got := readExport(t, exportDir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+
+	counts := rep.Counts[d.String()]
+	if counts["downloaded objects"] != 7 || counts["deleted objects"] != 2 || counts["unchanged collections"] != 7 {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func TestFetchContacts(t *testing.T) {
+	srv := newFakeDAV()
+	srv.addCollection("/dav/calendars/me/personal/", "calendar", "Personal")
+	srv.addCollection("/dav/addressbooks/me/contacts/", "addressbook", "Contacts")
+	srv.put("/dav/calendars/me/personal/", "1.ics", event1)
+	srv.put("/dav/addressbooks/me/contacts/", "jane.vcf", contact)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	d := &DAV{URL: ts.URL + "/dav/", Username: "me", Password: "secret", Contacts: true, Dest: "dav"}
+	stagingDir := t.TempDir()
+	if err := d.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"contacts/contacts/jane.vcf": contact}
+	if got := readExport(t, filepath.Join(stagingDir, "dav")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+
+	d.Password = "wrong"
+	if err := d.Fetch(t.TempDir(), nil); err == nil {
+		t.Error("Fetch() with the wrong password succeeded")
+	}
+}
+
+func TestFetchSameName(t *testing.T) {
+	srv := newFakeDAV()
+	srv.sharedCalendars = true
+	srv.addCollection("/dav/calendars/me/work/", "calendar", "Work")
+	srv.addCollection("/dav/calendars/shared/work/", "calendar", "Team")
+	srv.put("/dav/calendars/me/work/", "1.ics", event1)
+	srv.put("/dav/calendars/shared/work/", "1.ics", event2)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	d := &DAV{URL: ts.URL + "/dav/", Username: "me", Password: "secret", Calendars: true, Dest: "dav"}
+	stagingDir := t.TempDir()
+	if err := d.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("/dav/calendars/shared/work/"))
+	shared := "calendars/work-" + hex.EncodeToString(sum[:8])
+	want := map[string]string{
+		"calendars/work/1.ics": event1,
+		shared + "/1.ics":      event2,
+	}
+	if got := readExport(t, filepath.Join(stagingDir, "dav")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+
+	// The directory of the shared calendar is kept after the other one is
+	// deleted.
+	srv.mu.Lock()
+	delete(srv.collections, "/dav/calendars/me/work/")
+	srv.mu.Unlock()
+	srv.put("/dav/calendars/shared/work/", "2.ics", event1)
+	if err := d.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		shared + "/1.ics": event2,
+		shared + "/2.ics": event1,
+	}
+	if got := readExport(t, filepath.Join(stagingDir, "dav")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("export = %q; want %q", got, want)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	for _, tt := range []struct {
+		p, ext string
+		// want is empty if the name is a hash.
+		want string
+	}{
+		{"/cal/personal/abc.ics", ".ics", "abc.ics"},
+		{"/cal/personal/abc", ".ics", "abc.ics"},
+		{"/card/contacts/ABC.VCF", ".vcf", "ABC.VCF"},
+		{"/cal/personal/", "", "personal"},
+		{"/cal/personal/..", ".ics", ""},
+		{"/cal/personal/.hidden", ".ics", ""},
+		{"/cal/personal/a:b", ".ics", ""},
+	} {
+		got := fileName(tt.p, tt.ext)
+		if tt.want == "" {
+			if len(got) != 16+len(tt.ext) || !strings.HasSuffix(got, tt.ext) {
+				t.Errorf("fileName(%q) = %q; want a hash", tt.p, got)
+			}
+		} else if got != tt.want {
+			t.Errorf("fileName(%q) = %q; want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		d  DAV
+		ok bool
+	}{
+		{DAV{URL: "https://cloud.example.com/remote.php/dav", Dest: "dav"}, true},
+		{DAV{URL: "cloud.example.com", Dest: "dav"}, false},
+		{DAV{URL: "https://cloud.example.com/remote.php/dav"}, false},
+		{DAV{URL: "https://cloud.example.com/remote.php/dav", Dest: "../dav"}, false},
+	} {
+		if err := tt.d.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v; want ok=%v", tt.d, err, tt.ok)
+		}
+	}
+}
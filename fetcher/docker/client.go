@@ -0,0 +1,119 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// client is a client for the subset of the Docker Engine API used by the
+// fetcher. Podman's Docker-compatible API also implements it.
+type client struct {
+	http *http.Client
+}
+
+// apiError is an error response from the API.
+type apiError struct {
+	method, path string
+	status       int
+	message      string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.method, e.path, e.status, http.StatusText(e.status), e.message)
+}
+
+func newClient(socket string) *client {
+	return &client{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// do sends a request with an optional JSON body. The caller closes the body
+// of the response.
+func (c *client) do(method, path string, query url.Values, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	// The host is ignored, since the connection is to the socket.
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &apiError{method: method, path: path, status: resp.StatusCode, message: msg.Message}
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the JSON response into out, which may be
+// nil.
+func (c *client) call(method, path string, query url.Values, body, out any) error {
+	resp, err := c.do(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// pull pulls an image. The response is a stream of progress messages, which
+// reports errors after the status.
+func (c *client) pull(image, tag string) error {
+	resp, err := c.do(http.MethodPost, "/images/create", url.Values{"fromImage": {image}, "tag": {tag}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("pulling %s:%s: %v", image, tag, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pulling %s:%s: %s", image, tag, msg.Error)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package docker fetches the volumes and images of Docker or Podman through
+// the Docker-compatible API socket.
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// Consistency policies for the containers which use a volume.
+const (
+	// ConsistencyNone exports the volume while the containers run.
+	ConsistencyNone = ""
+	// ConsistencyPause pauses the containers during the export.
+	ConsistencyPause = "pause"
+	// ConsistencyStop stops the containers during the export and starts
+	// them again afterwards.
+	ConsistencyStop = "stop"
+)
+
+// volumeTarget is where the volume is mounted in the helper container.
+const volumeTarget = "/volume"
+
+// volumeName is the format of volume names accepted by Docker.
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Docker exports volumes as tar files in dest/volumes/<volume>.tar and saves
+// images in dest/images/<image>.tar.
+//
+// A volume is read by creating a stopped helper container which mounts it,
+// and downloading the mount point from the container.
+type Docker struct {
+	// Socket defaults to the unix socket in $DOCKER_HOST, or
+	// /var/run/docker.sock. For Podman it is usually
+	// $XDG_RUNTIME_DIR/podman/podman.sock.
+	Socket string `json:"socket,omitempty"`
+	// Volumes are the volumes to export. Every volume is exported if it
+	// is empty and AllVolumes is set.
+	Volumes    []string `json:"volumes,omitempty"`
+	AllVolumes bool     `json:"all_volumes,omitempty"`
+	// Images are saved like `docker save`.
+	Images []string `json:"images,omitempty"`
+	// Consistency is "", "pause" or "stop".
+	Consistency string `json:"consistency,omitempty"`
+	// HelperImage is the image of the helper container. It is pulled if
+	// it is missing. The default is "busybox:latest".
+	HelperImage string `json:"helper_image,omitempty"`
+	Dest        string `json:"dest"`
+}
+
+type volume struct {
+	Name string `json:"Name"`
+}
+
+type container struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	State string   `json:"State"`
+}
+
+func (d *Docker) String() string {
+	return "docker " + d.socket()
+}
+
+func (d *Docker) Name() string {
+	return "Docker"
+}
+
+func (d *Docker) socket() string {
+	if d.Socket != "" {
+		return d.Socket
+	}
+	if s, ok := strings.CutPrefix(os.Getenv("DOCKER_HOST"), "unix://"); ok {
+		return s
+	}
+	return "/var/run/docker.sock"
+}
+
+func (d *Docker) helperImage() string {
+	if d.HelperImage == "" {
+		return "busybox:latest"
+	}
+	return d.HelperImage
+}
+
+func (d *Docker) Validate() error {
+	if len(d.Volumes) == 0 && !d.AllVolumes && len(d.Images) == 0 {
+		return errors.New("volumes, all_volumes or images is required")
+	}
+	if len(d.Volumes) != 0 && d.AllVolumes {
+		return errors.New("volumes and all_volumes cannot be used together")
+	}
+	for _, v := range d.Volumes {
+		if !volumeName.MatchString(v) {
+			return fmt.Errorf("invalid volume name %q", v)
+		}
+	}
+	for _, i := range d.Images {
+		if i == "" {
+			return errors.New("empty image name")
+		}
+	}
+	switch d.Consistency {
+	case ConsistencyNone, ConsistencyPause, ConsistencyStop:
+	default:
+		return fmt.Errorf("invalid consistency %q, must be %q or %q", d.Consistency, ConsistencyPause, ConsistencyStop)
+	}
+	if d.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", d.Dest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Docker) Destinations() []string {
+	return []string{d.Dest}
+}
+
+// imageFileName returns the file name of a saved image, for example
+// "ghcr.io_me_app_v1.tar" for "ghcr.io/me/app:v1".
+func imageFileName(image string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image) + ".tar"
+}
+
+// splitTag splits an image reference into the repository and the tag, which
+// defaults to "latest". A colon may also separate the port of a registry.
+func splitTag(image string) (string, string) {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+func (d *Docker) Fetch(stagingDir string, rep *report.Source) error {
+	c := newClient(d.socket())
+
+	volumes := d.Volumes
+	if d.AllVolumes {
+		list := struct {
+			Volumes []volume `json:"Volumes"`
+		}{}
+		if err := c.call(http.MethodGet, "/volumes", nil, nil, &list); err != nil {
+			return err
+		}
+		for _, v := range list.Volumes {
+			volumes = append(volumes, v.Name)
+		}
+	}
+
+	failed := 0
+	for _, v := range volumes {
+		if !volumeName.MatchString(v) {
+			rep.Warnf("skipping volume with invalid name %q", v)
+			continue
+		}
+		dest := filepath.Join(stagingDir, d.Dest, "volumes", v+".tar")
+		if err := d.exportVolume(c, v, dest, rep); err != nil {
+			rep.Warnf("volume %s: %v", v, err)
+			failed++
+		}
+	}
+	for _, image := range d.Images {
+		dest := filepath.Join(stagingDir, d.Dest, "images", imageFileName(image))
+		resp, err := c.do(http.MethodGet, "/images/"+image+"/get", nil, nil)
+		if err == nil {
+			err = writeFile(dest, resp.Body, rep, "image bytes")
+			resp.Body.Close()
+		}
+		if err != nil {
+			rep.Warnf("image %s: %v", image, err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to export %d volumes and images", failed)
+	}
+	return nil
+}
+
+// exportVolume writes the volume as a tar file to dest. The paths in the tar
+// file start with "volume/".
+func (d *Docker) exportVolume(c *client, name, dest string, rep *report.Source) (err error) {
+	// Mounting a missing volume would create it.
+	if err := c.call(http.MethodGet, "/volumes/"+name, nil, nil, nil); err != nil {
+		return err
+	}
+	if d.Consistency != ConsistencyNone {
+		resume, quiesceErr := d.quiesce(c, name, rep)
+		// The containers are resumed even if the export fails.
+		defer func() {
+			if resumeErr := resume(); err == nil {
+				err = resumeErr
+			}
+		}()
+		if quiesceErr != nil {
+			return quiesceErr
+		}
+	}
+
+	id, err := d.createHelper(c, name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		removeErr := c.call(http.MethodDelete, "/containers/"+id, url.Values{"force": {"true"}, "v": {"false"}}, nil, nil)
+		if err == nil {
+			err = removeErr
+		}
+	}()
+
+	resp, err := c.do(http.MethodGet, "/containers/"+id+"/archive", url.Values{"path": {volumeTarget}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return writeFile(dest, resp.Body, rep, "volume bytes")
+}
+
+// createHelper creates a stopped container which mounts the volume read-only,
+// and pulls the helper image if it is missing.
+func (d *Docker) createHelper(c *client, name string) (string, error) {
+	config := map[string]any{
+		"Image":      d.helperImage(),
+		"Cmd":        []string{"true"},
+		"Labels":     map[string]string{"backup.helper": "true"},
+		"HostConfig": map[string]any{"Mounts": []map[string]any{{"Type": "volume", "Source": name, "Target": volumeTarget, "ReadOnly": true}}},
+	}
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+	err := c.call(http.MethodPost, "/containers/create", nil, config, &created)
+	if apiErr := (*apiError)(nil); errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		if err := c.pull(splitTag(d.helperImage())); err != nil {
+			return "", err
+		}
+		err = c.call(http.MethodPost, "/containers/create", nil, config, &created)
+	}
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// quiesce pauses or stops the running containers which use the volume. It
+// returns a function which resumes them.
+func (d *Docker) quiesce(c *client, name string, rep *report.Source) (func() error, error) {
+	noop := func() error { return nil }
+	filters, err := json.Marshal(map[string][]string{"volume": {name}, "status": {"running"}})
+	if err != nil {
+		return noop, err
+	}
+	containers := []container{}
+	if err := c.call(http.MethodGet, "/containers/json", url.Values{"filters": {string(filters)}}, nil, &containers); err != nil {
+		return noop, err
+	}
+
+	action, undo := "pause", "unpause"
+	if d.Consistency == ConsistencyStop {
+		action, undo = "stop", "start"
+	}
+	done := []container{}
+	resume := func() error {
+		var err error
+		for _, ct := range done {
+			if e := c.call(http.MethodPost, "/containers/"+ct.ID+"/"+undo, nil, nil, nil); e != nil {
+				rep.Warnf("%s %s: %v", undo, ct.Names, e)
+				err = e
+			}
+		}
+		return err
+	}
+	for _, ct := range containers {
+		if err := c.call(http.MethodPost, "/containers/"+ct.ID+"/"+action, nil, nil, nil); err != nil {
+			return resume, err
+		}
+		rep.Infof("%s %s for volume %s", action, ct.Names, name)
+		done = append(done, ct)
+	}
+	return resume, nil
+}
+
+// writeFile writes r to dest and counts the bytes. A partial file is removed
+// on failure.
+func writeFile(dest string, r io.Reader, rep *report.Source, counter string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	rep.Count(counter, n)
+	return nil
+}
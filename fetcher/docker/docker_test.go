@@ -0,0 +1,365 @@
+package docker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+type fakeContainer struct {
+	name   string
+	state  string
+	volume string
+	helper bool
+}
+
+// fakeDocker implements the subset of the Docker Engine API used by the
+// fetcher.
+type fakeDocker struct {
+	mu sync.Mutex
+	// volumes maps the volume name to its files.
+	volumes    map[string]map[string]string
+	containers map[string]*fakeContainer
+	images     map[string]string
+	hasHelper  bool
+	// brokenVolume fails to export.
+	brokenVolume string
+	nextID       int
+	// exportStates are the states of the other containers using the volume
+	// during each export.
+	exportStates []string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": msg})
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodGet && p == "/volumes":
+		volumes := []map[string]string{}
+		for name := range f.volumes {
+			volumes = append(volumes, map[string]string{"Name": name, "Driver": "local"})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"Volumes": volumes})
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/volumes/"):
+		name := strings.TrimPrefix(p, "/volumes/")
+		if f.volumes[name] == nil {
+			notFound(w, "get "+name+": no such volume")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"Name": name})
+	case r.Method == http.MethodGet && p == "/containers/json":
+		filters := map[string][]string{}
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		list := []map[string]any{}
+		for id, c := range f.containers {
+			if slices.Contains(filters["volume"], c.volume) && slices.Contains(filters["status"], c.state) {
+				list = append(list, map[string]any{"Id": id, "Names": []string{"/" + c.name}, "State": c.state})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == http.MethodPost && p == "/containers/create":
+		config := struct {
+			Image      string
+			HostConfig struct {
+				Mounts []struct{ Type, Source, Target string }
+			}
+		}{}
+		json.NewDecoder(r.Body).Decode(&config)
+		if config.Image != "busybox:latest" || !f.hasHelper {
+			notFound(w, "No such image: "+config.Image)
+			return
+		}
+		if len(config.HostConfig.Mounts) != 1 || config.HostConfig.Mounts[0].Target != "/volume" {
+			http.Error(w, "unexpected mounts", http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		id := fmt.Sprintf("helper%d", f.nextID)
+		f.containers[id] = &fakeContainer{name: id, state: "created", volume: config.HostConfig.Mounts[0].Source, helper: true}
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": id})
+	case r.Method == http.MethodPost && p == "/images/create":
+		if r.URL.Query().Get("fromImage") != "busybox" || r.URL.Query().Get("tag") != "latest" {
+			notFound(w, "pull access denied")
+			return
+		}
+		f.hasHelper = true
+		fmt.Fprint(w, `{"status":"Pulling from library/busybox"}`+"\n"+`{"status":"Downloaded newer image for busybox:latest"}`+"\n")
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/images/") && strings.HasSuffix(p, "/get"):
+		name := strings.TrimSuffix(strings.TrimPrefix(p, "/images/"), "/get")
+		content, ok := f.images[name]
+		if !ok {
+			notFound(w, "reference does not exist")
+			return
+		}
+		fmt.Fprint(w, content)
+	case strings.HasPrefix(p, "/containers/"):
+		id, action, _ := strings.Cut(strings.TrimPrefix(p, "/containers/"), "/")
+		c := f.containers[id]
+		if c == nil {
+			notFound(w, "No such container: "+id)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete && action == "":
+			delete(f.containers, id)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && (action == "pause" || action == "stop"):
+			c.state = map[string]string{"pause": "paused", "stop": "exited"}[action]
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && (action == "unpause" || action == "start"):
+			c.state = "running"
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && action == "archive":
+			for _, other := range f.containers {
+				if !other.helper && other.volume == c.volume {
+					f.exportStates = append(f.exportStates, other.name+" "+other.state)
+				}
+			}
+			if r.URL.Query().Get("path") != "/volume" || c.volume == f.brokenVolume {
+				notFound(w, "Could not find the file /volume in container "+id)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-tar")
+			tw := tar.NewWriter(w)
+			tw.WriteHeader(&tar.Header{Name: "volume/", Typeflag: tar.TypeDir, Mode: 0755})
+			names := []string{}
+			for name := range f.volumes[c.volume] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				content := f.volumes[c.volume][name]
+				tw.WriteHeader(&tar.Header{Name: "volume/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+				tw.Write([]byte(content))
+			}
+			tw.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startFakeDocker serves f on a unix socket and returns its path.
+func startFakeDocker(t *testing.T, f *fakeDocker) string {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: f}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		volumes: map[string]map[string]string{
+			"db":    {"data.txt": "rows", "conf/settings": "x=1"},
+			"cache": {"c": "cached"},
+		},
+		containers: map[string]*fakeContainer{
+			"app1": {name: "app", state: "running", volume: "db"},
+			"old1": {name: "old", state: "exited", volume: "db"},
+			"web1": {name: "web", state: "running", volume: "cache"},
+		},
+		images: map[string]string{"ghcr.io/me/app:v1": "image tar"},
+	}
+}
+
+// readTar returns the files in a tar file.
+func readTar(t *testing.T, file string) map[string]string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	f := newFakeDocker()
+	d := &Docker{
+		Socket:      startFakeDocker(t, f),
+		Volumes:     []string{"db"},
+		Images:      []string{"ghcr.io/me/app:v1"},
+		Consistency: ConsistencyPause,
+		Dest:        "docker",
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"volume/": "", "volume/conf/settings": "x=1", "volume/data.txt": "rows"}
+	if got := readTar(t, filepath.Join(stagingDir, "docker", "volumes", "db.tar")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("db.tar = %q; want %q", got, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(stagingDir, "docker", "images", "ghcr.io_me_app_v1.tar")); err != nil || string(data) != "image tar" {
+		t.Errorf("image = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "docker", "volumes", "cache.tar")); err == nil {
+		t.Error("unconfigured volume was exported")
+	}
+
+	// The running container was paused during the export, and the helper
+	// image was pulled.
+	if got, want := strings.Join(f.exportStates, ", "), "app paused, old exited"; got != want {
+		t.Errorf("states during export = %q; want %q", got, want)
+	}
+	if got := f.containers["app1"].state; got != "running" {
+		t.Errorf("app is %s after the export", got)
+	}
+	if !f.hasHelper {
+		t.Error("helper image was not pulled")
+	}
+	if len(f.containers) != 3 {
+		t.Errorf("helper container was not removed: %v", f.containers)
+	}
+}
+
+func TestFetchAllVolumes(t *testing.T) {
+	f := newFakeDocker()
+	f.hasHelper = true
+	d := &Docker{Socket: startFakeDocker(t, f), AllVolumes: true, Consistency: ConsistencyStop, Dest: "docker"}
+	stagingDir := t.TempDir()
+	if err := d.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"db", "cache"} {
+		if _, err := os.Stat(filepath.Join(stagingDir, "docker", "volumes", v+".tar")); err != nil {
+			t.Error(err)
+		}
+	}
+	sort.Strings(f.exportStates)
+	if got, want := strings.Join(f.exportStates, ", "), "app exited, old exited, web exited"; got != want {
+		t.Errorf("states during export = %q; want %q", got, want)
+	}
+	for _, c := range []string{"app1", "web1"} {
+		if got := f.containers[c].state; got != "running" {
+			t.Errorf("%s is %s after the export", c, got)
+		}
+	}
+	if got := f.containers["old1"].state; got != "exited" {
+		t.Errorf("stopped container is %s after the export", got)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	f := newFakeDocker()
+	f.hasHelper = true
+	f.brokenVolume = "db"
+	d := &Docker{
+		Socket:      startFakeDocker(t, f),
+		Volumes:     []string{"db", "missing", "cache"},
+		Images:      []string{"missing:latest"},
+		Consistency: ConsistencyPause,
+		Dest:        "docker",
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := d.Fetch(stagingDir, rep.Source(d.String())); err == nil {
+		t.Fatal("Fetch() succeeded")
+	}
+	if got := rep.Num(report.Warning); got != 3 {
+		t.Errorf("%d warnings; want 3", got)
+	}
+	// The other volumes are exported, and the containers are resumed
+	// after a failure.
+	if _, err := os.Stat(filepath.Join(stagingDir, "docker", "volumes", "cache.tar")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "docker", "volumes", "db.tar")); err == nil {
+		t.Error("partial export of db was kept")
+	}
+	if got := f.containers["app1"].state; got != "running" {
+		t.Errorf("app is %s after the export", got)
+	}
+	if len(f.containers) != 3 {
+		t.Errorf("helper container was not removed: %v", f.containers)
+	}
+	if _, ok := f.volumes["missing"]; ok {
+		t.Error("missing volume was created")
+	}
+}
+
+func TestSplitTag(t *testing.T) {
+	for _, tt := range []struct {
+		image, repo, tag string
+	}{
+		{"busybox", "busybox", "latest"},
+		{"busybox:1.36", "busybox", "1.36"},
+		{"registry.local:5000/tools/busybox", "registry.local:5000/tools/busybox", "latest"},
+		{"registry.local:5000/tools/busybox:1", "registry.local:5000/tools/busybox", "1"},
+	} {
+		if repo, tag := splitTag(tt.image); repo != tt.repo || tag != tt.tag {
+			t.Errorf("splitTag(%q) = %q, %q; want %q, %q", tt.image, repo, tag, tt.repo, tt.tag)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		d  Docker
+		ok bool
+	}{
+		{Docker{Volumes: []string{"db"}, Dest: "docker"}, true},
+		{Docker{AllVolumes: true, Consistency: ConsistencyStop, Dest: "docker"}, true},
+		{Docker{Images: []string{"postgres:16"}, Dest: "docker"}, true},
+		{Docker{Dest: "docker"}, false},
+		{Docker{Volumes: []string{"db"}, AllVolumes: true, Dest: "docker"}, false},
+		{Docker{Volumes: []string{"../db"}, Dest: "docker"}, false},
+		{Docker{Volumes: []string{"db"}, Consistency: "freeze", Dest: "docker"}, false},
+		{Docker{Volumes: []string{"db"}, Dest: "/docker"}, false},
+	} {
+		if err := tt.d.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v; want ok=%v", tt.d, err, tt.ok)
+		}
+	}
+}
@@ -1,10 +1,130 @@
 package fetcher
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
 
 type Fetcher interface {
 	fmt.Stringer
 	Name() string
 	Validate() error
-	Fetch(stagingDir string) error
+	// Fetch downloads the content into the staging directory. Warnings
+	// and statistics are added to the report.
+	Fetch(stagingDir string, rep *report.Source) error
+}
+
+// Dependent is optionally implemented by fetchers and listers which run
+// external programs.
+type Dependent interface {
+	// Deps maps the name of each program to a command which succeeds if
+	// the program is installed.
+	Deps() map[string][]string
+}
+
+// Destination is optionally implemented by fetchers to declare where they
+// write in the staging directory.
+type Destination interface {
+	// Destinations returns the files and directories written by Fetch,
+	// relative to the staging directory.
+	Destinations() []string
+}
+
+// ValidateDest returns an error if dest, the value of the named option, is
+// not a relative path inside the staging directory.
+func ValidateDest(name, dest string) error {
+	if !filepath.IsLocal(dest) {
+		return fmt.Errorf("%s must be a relative path inside the staging area, got %q", name, dest)
+	}
+	return nil
+}
+
+// HostDir joins the hostname of this machine, or "localhost" if it is
+// unknown, with elem. Fetchers of local files use it as the default
+// destination, so several machines can be backed up to the same image.
+func HostDir(elem ...string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return filepath.Join(append([]string{host}, elem...)...)
+}
+
+// overlap is an error for two fetchers which write to the same path, or where
+// one writes inside the other's directory.
+type overlap struct {
+	// i and j are the indices of the fetchers, with i < j.
+	i, j         int
+	a, b         Fetcher
+	pathA, pathB string
+}
+
+func (o *overlap) Error() string {
+	return fmt.Sprintf("%s fetcher %v and %s fetcher %v overlap at %q and %q", o.a.Name(), o.a, o.b.Name(), o.b, o.pathA, o.pathB)
+}
+
+// overlaps returns every pair of fetchers which overlap.
+func overlaps(fetchers []Fetcher) []*overlap {
+	type dest struct {
+		path  string
+		index int
+	}
+	dests := []dest{}
+	for i, f := range fetchers {
+		d, ok := f.(Destination)
+		if !ok {
+			continue
+		}
+		for _, p := range d.Destinations() {
+			dests = append(dests, dest{filepath.Clean(p), i})
+		}
+	}
+	found := []*overlap{}
+	for i, a := range dests {
+		for _, b := range dests[i+1:] {
+			if a.path == b.path || strings.HasPrefix(b.path, a.path+string(filepath.Separator)) || strings.HasPrefix(a.path, b.path+string(filepath.Separator)) {
+				found = append(found, &overlap{a.index, b.index, fetchers[a.index], fetchers[b.index], a.path, b.path})
+			}
+		}
+	}
+	return found
+}
+
+// CheckDestinations returns an error if two fetchers write to the same path,
+// or one writes inside the other's directory.
+func CheckDestinations(fetchers []Fetcher) error {
+	if o := overlaps(fetchers); len(o) != 0 {
+		return o[0]
+	}
+	return nil
+}
+
+// SkipOverlapping returns the listed fetchers which do not overlap with a
+// configured fetcher or another listed fetcher. Each one which does is
+// reported as an error and skipped, so it does not stop the other fetchers.
+// The configured fetchers are not checked, since Validate rejects them.
+func SkipOverlapping(configured, listed []Fetcher, rep *report.Report) []Fetcher {
+	all := append(slices.Clip(configured), listed...)
+	skip := map[int]error{}
+	for _, o := range overlaps(all) {
+		for _, i := range []int{o.i, o.j} {
+			if i >= len(configured) && skip[i] == nil {
+				skip[i] = o
+			}
+		}
+	}
+	kept := []Fetcher{}
+	for i, f := range listed {
+		if err := skip[len(configured)+i]; err != nil {
+			rep.Source(f.String()).Errorf("skipped: %v", err)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
 }
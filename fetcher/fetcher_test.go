@@ -0,0 +1,94 @@
+package fetcher_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/fetcher/git"
+	"github.com/rjoleary/backup/fetcher/local"
+	"github.com/rjoleary/backup/report"
+)
+
+func TestCheckDestinations(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fetchers []fetcher.Fetcher
+		overlap  bool
+	}{
+		{
+			name: "distinct",
+			fetchers: []fetcher.Fetcher{
+				&local.Local{Dir: "/work/notes", Dest: "laptop/work/notes"},
+				&local.Local{Dir: "/personal/notes", Dest: "laptop/personal/notes"},
+				&git.Git{Dir: "user/notes"},
+				&git.Git{Dir: "user/notes-old", Options: git.Options{Bundle: true}},
+			},
+		},
+		{
+			name: "same",
+			fetchers: []fetcher.Fetcher{
+				&local.Local{Dir: "/work/notes", Dest: "notes"},
+				&local.Local{Dir: "/personal/notes", Dest: "notes/"},
+			},
+			overlap: true,
+		},
+		{
+			name: "nested",
+			fetchers: []fetcher.Fetcher{
+				&local.Local{Dir: "/home", Dest: "laptop"},
+				&git.Git{Dir: "laptop/repo"},
+			},
+			overlap: true,
+		},
+		{
+			name: "bundle",
+			fetchers: []fetcher.Fetcher{
+				&git.Git{Dir: "repo", Options: git.Options{Bundle: true}},
+				&local.Local{Dir: "/a", Dest: "repo.bundle"},
+			},
+			overlap: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fetcher.CheckDestinations(tt.fetchers)
+			if (err != nil) != tt.overlap {
+				t.Errorf("CheckDestinations() = %v; want overlap %v", err, tt.overlap)
+			}
+		})
+	}
+}
+
+func TestSkipOverlapping(t *testing.T) {
+	configured := []fetcher.Fetcher{
+		&local.Local{Dir: "/home", Dest: "laptop"},
+	}
+	listed := []fetcher.Fetcher{
+		&git.Git{Url: "github.com/me/a", Dir: "me/a"},
+		// The same repo name on two services.
+		&git.Git{Url: "github.com/me/b", Dir: "me/b"},
+		&git.Git{Url: "bitbucket.org/me/b", Dir: "me/b"},
+		&git.Git{Url: "github.com/me/c", Dir: "laptop/c"},
+	}
+	rep := report.New()
+	kept := fetcher.SkipOverlapping(configured, listed, rep)
+	if got, want := fmt.Sprint(kept), "[github.com/me/a]"; got != want {
+		t.Errorf("SkipOverlapping() = %v; want %v", got, want)
+	}
+	if got := rep.Num(report.Error); got != 3 {
+		t.Errorf("got %d errors; want 3", got)
+	}
+}
+
+func TestValidateDest(t *testing.T) {
+	for dest, ok := range map[string]bool{
+		"laptop/home": true,
+		"":            false,
+		"/laptop":     false,
+		"../laptop":   false,
+	} {
+		if err := fetcher.ValidateDest("dest", dest); (err == nil) != ok {
+			t.Errorf("ValidateDest(%q) = %v; want ok %v", dest, err, ok)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// createBundle writes all the refs of the repo in dir to a bundle file and
+// verifies it. A single file is easier to restore than a mirror.
+func createBundle(ctx context.Context, dir, file string, rep *report.Source) error {
+	// git refuses to create an empty bundle.
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--count=1")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		rep.Infof("skipping bundle of empty repo")
+		return nil
+	}
+
+	for _, args := range [][]string{
+		{"bundle", "create", "--quiet", file, "--all"},
+		{"bundle", "verify", "--quiet", file},
+	} {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git bundle %s: %v", args[1], err)
+		}
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	rep.Count("bundle bytes", fi.Size())
+	return nil
+}
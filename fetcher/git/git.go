@@ -9,6 +9,9 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/rjoleary/backup/report"
+	"golang.org/x/crypto/ssh"
 )
 
 const known_hosts = `
@@ -23,11 +26,74 @@ bitbucket.org ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNT
 bitbucket.org ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIazEu89wgQZ4bqs3d63QSMzYVa0MuJ2e2gKTKqu+UUO
 `
 
+// Options are the settings which listers pass through to the git fetchers
+// they create.
+type Options struct {
+	// SSHKey is an unencrypted private key in the OpenSSH or PEM format. If
+	// set, it is used instead of the keys in ssh-agent.
+	SSHKey string `json:"ssh_key,omitempty"`
+	// LFS enables downloading Git LFS objects. It requires git-lfs.
+	LFS bool `json:"lfs,omitempty"`
+	// Bundle additionally writes the repo to a single bundle file named
+	// "<dir>.bundle".
+	Bundle bool `json:"bundle,omitempty"`
+	// Submodules records the submodule URLs referenced by the repo, so
+	// they can be checked against the other fetchers.
+	Submodules bool `json:"submodules,omitempty"`
+	// Backend is either "git" (default) which runs the git command, or
+	// "go" which uses a Go implementation of git.
+	Backend string `json:"backend,omitempty"`
+}
+
+func (o *Options) Validate() error {
+	if o.SSHKey != "" {
+		if _, err := ssh.ParseRawPrivateKey([]byte(o.SSHKey)); err != nil {
+			return fmt.Errorf("invalid ssh_key: %v", err)
+		}
+	}
+	switch o.Backend {
+	case "", "git":
+		return checkGitVersion()
+	case "go":
+		if o.LFS {
+			return errors.New("lfs is not supported by the go backend")
+		}
+		if o.Bundle {
+			return errors.New("bundle is not supported by the go backend")
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", o.Backend)
+	}
+	return nil
+}
+
+// Deps returns the programs required by the options.
+func (o *Options) Deps() map[string][]string {
+	if o.Backend == "go" {
+		return nil
+	}
+	deps := map[string][]string{"git": {"git", "--version"}}
+	if o.LFS {
+		deps["git-lfs"] = []string{"git", "lfs", "version"}
+	}
+	return deps
+}
+
 type Git struct {
 	Dir      string `json:"dir"`
 	Url      string `json:"url"`
 	Protocol string `json:"protocol"`
 	Private  bool   `json:"private"`
+	// Username and Token are the credentials for the https protocol.
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// KnownHosts are merged with the built-in known_hosts. This is set
+	// from the config and is not saved.
+	KnownHosts []string `json:"-"`
+	Options
+
+	// submodules is set by Fetch when the Submodules option is enabled.
+	submodules []string
 }
 
 func (g *Git) String() string {
@@ -38,6 +104,13 @@ func (g *Git) Name() string {
 	return "Git"
 }
 
+func (g *Git) Destinations() []string {
+	if g.Bundle {
+		return []string{g.Dir, g.Dir + ".bundle"}
+	}
+	return []string{g.Dir}
+}
+
 func (g *Git) Validate() error {
 	if g.Dir == "" {
 		return errors.New("dir is required")
@@ -45,57 +118,156 @@ func (g *Git) Validate() error {
 	if g.Url == "" {
 		return errors.New("url is required")
 	}
-	if g.Protocol == "" {
+	switch g.Protocol {
+	case "":
 		return errors.New("protocol is required")
+	case "ssh":
+		if g.Token != "" {
+			return errors.New("token is only supported by the https protocol")
+		}
+	case "https":
+		if g.Token != "" && g.Username == "" {
+			return errors.New("username is required with a token")
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q", g.Protocol)
 	}
-	return nil
+	return g.Options.Validate()
 }
 
-func (g *Git) Fetch(stagingDir string) error {
-	dir := filepath.Join(stagingDir, g.Dir)
-	os.MkdirAll(dir, 0777)
+// transport holds the options for git to authenticate with the remote.
+type transport struct {
+	// tmpDir contains files referenced by the options. It is deleted by
+	// Close.
+	tmpDir string
+	env    []string
+	// config is passed to git with "-c".
+	config []string
+}
 
-	f, err := os.CreateTemp("", "backup_known_hosts")
+func (g *Git) newTransport() (*transport, error) {
+	tmpDir, err := os.MkdirTemp("", "backup_git")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer os.Remove(f.Name())
-	if _, err := f.Write([]byte(known_hosts)); err != nil {
-		return err
+	t := &transport{
+		tmpDir: tmpDir,
+		// Fail rather than hang waiting for input.
+		env: []string{"GIT_TERMINAL_PROMPT=0"},
 	}
-	if err := f.Close(); err != nil {
-		return err
+
+	knownHostsData, err := mergeKnownHosts(g.KnownHosts)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	knownHosts := filepath.Join(tmpDir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownHostsData), 0600); err != nil {
+		t.Close()
+		return nil, err
+	}
+	sshCommand := fmt.Sprintf("ssh -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", knownHosts)
+
+	if g.SSHKey != "" {
+		// ssh refuses keys which are readable by other users.
+		identity := filepath.Join(tmpDir, "id")
+		key := strings.TrimSpace(g.SSHKey) + "\n"
+		if err := os.WriteFile(identity, []byte(key), 0600); err != nil {
+			t.Close()
+			return nil, err
+		}
+		sshCommand += fmt.Sprintf(" -i %s -o IdentitiesOnly=yes", identity)
 	}
-	sshEnv := fmt.Sprintf("GIT_SSH_COMMAND=ssh -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes", f.Name())
+	t.env = append(t.env, "GIT_SSH_COMMAND="+sshCommand)
+
+	if g.Protocol == "https" && g.Token != "" {
+		// The token is read from a file by the credential helper so it
+		// does not appear in argv or the environment of any process.
+		credentials := filepath.Join(tmpDir, "credentials")
+		data := fmt.Sprintf("username=%s\npassword=%s\n", g.Username, g.Token)
+		if err := os.WriteFile(credentials, []byte(data), 0600); err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.config = append(t.config,
+			// The empty value resets the list of helpers so that
+			// the token does not get saved to the user's keychain.
+			"credential.helper=",
+			fmt.Sprintf(`credential.helper=!f() { test "$1" = get && cat '%s'; }; f`, credentials))
+	}
+	return t, nil
+}
+
+func (t *transport) Close() error {
+	return os.RemoveAll(t.tmpDir)
+}
+
+// command returns a git command which runs in dir.
+func (t *transport) command(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	gitArgs := []string{}
+	for _, c := range t.config {
+		gitArgs = append(gitArgs, "-c", c)
+	}
+	cmd := exec.CommandContext(ctx, "git", append(gitArgs, args...)...)
+	cmd.Env = append(cmd.Environ(), t.env...)
+	cmd.Dir = dir
+	return cmd
+}
+
+func (g *Git) Fetch(stagingDir string, rep *report.Source) error {
+	dir := filepath.Join(stagingDir, g.Dir)
+	os.MkdirAll(dir, 0777)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
+	if g.Backend == "go" {
+		return g.fetchGo(ctx, dir, rep)
+	}
+
+	t, err := g.newTransport()
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
 	// This command determines if "dir" already contains a git repo. We
 	// cannot simply check for the ".git" directory because it is a
 	// headless clone.
-	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--git-dir")
-	cmd.Env = append(cmd.Environ(), sshEnv)
-	cmd.Dir = dir
+	cmd := t.command(ctx, dir, "rev-parse", "--git-dir")
 	out, _ := cmd.Output()
 
 	if strings.TrimSpace(string(out)) == "." {
 		// Repo already exists. Update.
-		cmd := exec.CommandContext(ctx, "git", "remote", "update")
-		cmd.Env = append(cmd.Environ(), sshEnv)
-		cmd.Dir = dir
+		before, err := listRefs(ctx, dir)
+		if err != nil {
+			return err
+		}
+		cmd := t.command(ctx, dir,
+			// Refs deleted from the remote are deleted from the
+			// mirror, but preserveRefs keeps a copy.
+			"-c", "remote.origin.prune=true",
+			// The mirror's refspec "+refs/*:refs/*" would otherwise
+			// prune the preserved refs.
+			"-c", "remote.origin.fetch=^"+preservedRefPrefix+"*",
+			"remote", "update")
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
 			return err
 		}
+		after, err := listRefs(ctx, dir)
+		if err != nil {
+			return err
+		}
+		if err := preserveRefs(cliRefs{ctx, dir}, before, after, time.Now().UTC(), rep); err != nil {
+			return err
+		}
 
 	} else {
 		// Repo is new. Clone for the first time.
-		cmd = exec.CommandContext(ctx, "git", "clone", "--mirror", g.Url, ".")
-		cmd.Env = append(cmd.Environ(), sshEnv)
-		cmd.Dir = dir
+		cmd = t.command(ctx, dir, "clone", "--mirror", g.Url, ".")
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -115,5 +287,71 @@ func (g *Git) Fetch(stagingDir string) error {
 			return err
 		}
 	}
+
+	if g.LFS {
+		// Mirroring does not download LFS objects, only the pointers.
+		cmd := t.command(ctx, dir, "lfs", "fetch", "--all")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to fetch lfs objects: %v", err)
+		}
+		n, size, err := countFiles(filepath.Join(dir, "lfs", "objects"))
+		if err != nil {
+			return err
+		}
+		rep.Count("lfs objects", n)
+		rep.Count("lfs bytes", size)
+	} else if usesLFS(ctx, dir) {
+		rep.Warnf("repo has LFS pointers but lfs is not enabled")
+	}
+
+	if g.Bundle {
+		if err := createBundle(ctx, dir, filepath.Join(stagingDir, g.Dir+".bundle"), rep); err != nil {
+			return err
+		}
+	}
+
+	if g.Submodules {
+		g.submodules, err = submoduleURLs(ctx, dir, g.Url)
+		if err != nil {
+			return err
+		}
+		for _, u := range g.submodules {
+			rep.Infof("references submodule %s", u)
+		}
+	}
 	return nil
 }
+
+// usesLFS returns true if the .gitattributes file on HEAD configures the LFS
+// filter.
+func usesLFS(ctx context.Context, dir string) bool {
+	cmd := exec.CommandContext(ctx, "git", "show", "HEAD:.gitattributes")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return err == nil && strings.Contains(string(out), "filter=lfs")
+}
+
+// countFiles returns the number and total size of the files under dir.
+func countFiles(dir string) (n int64, size int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			n++
+			size += fi.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	return n, size, err
+}
@@ -0,0 +1,429 @@
+package git
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+	"golang.org/x/crypto/ssh"
+)
+
+// runGit runs git in dir and returns the trimmed stdout.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newRemote creates a bare repo named "repo.git" containing a single commit.
+// It returns the directory holding the bare repo and a work tree for making
+// further commits.
+func newRemote(t *testing.T) (root, work string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root = t.TempDir()
+	work = t.TempDir()
+	runGit(t, root, "init", "--quiet", "--bare", "--initial-branch=main", "repo.git")
+	runGit(t, work, "init", "--quiet", "--initial-branch=main")
+	commit(t, work, "first")
+	runGit(t, work, "remote", "add", "origin", filepath.Join(root, "repo.git"))
+	runGit(t, work, "push", "--quiet", "origin", "main")
+	return root, work
+}
+
+func commit(t *testing.T, work, msg string) string {
+	t.Helper()
+	runGit(t, work, "commit", "--quiet", "--allow-empty", "-m", msg)
+	return runGit(t, work, "rev-parse", "HEAD")
+}
+
+// serveHTTP serves the repos in root with git's smart HTTP protocol. Requests
+// must use the given basic auth credentials.
+func serveHTTP(t *testing.T, root, username, password string) *httptest.Server {
+	t.Helper()
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchHTTPS(t *testing.T) {
+	root, work := newRemote(t)
+	srv := serveHTTP(t, root, "user", "secret-token")
+	stagingDir := t.TempDir()
+
+	g := &Git{
+		Dir:      "user/repo",
+		Url:      srv.URL + "/repo.git",
+		Protocol: "https",
+		Username: "user",
+		Token:    "secret-token",
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clone then update.
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatalf("initial Fetch() = %v", err)
+	}
+	want := commit(t, work, "second")
+	runGit(t, work, "push", "--quiet", "origin", "main")
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatalf("second Fetch() = %v", err)
+	}
+
+	mirror := filepath.Join(stagingDir, g.Dir)
+	if got := runGit(t, mirror, "rev-parse", "refs/heads/main"); got != want {
+		t.Errorf("refs/heads/main = %s; want %s", got, want)
+	}
+
+	// The token must not be saved in the mirror's config.
+	config, err := os.ReadFile(filepath.Join(mirror, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), g.Token) {
+		t.Error("token was saved to the git config")
+	}
+}
+
+func TestFetchHTTPSWrongToken(t *testing.T) {
+	root, _ := newRemote(t)
+	srv := serveHTTP(t, root, "user", "secret-token")
+
+	g := &Git{
+		Dir:      "user/repo",
+		Url:      srv.URL + "/repo.git",
+		Protocol: "https",
+		Username: "user",
+		Token:    "wrong-token",
+	}
+	if err := g.Fetch(t.TempDir(), nil); err == nil {
+		t.Fatal("Fetch() with the wrong token succeeded")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		git     Git
+		wantErr bool
+	}{
+		{
+			name: "ssh",
+			git:  Git{Dir: "a", Url: "git@github.com:a/b.git", Protocol: "ssh"},
+		},
+		{
+			name: "https with token",
+			git:  Git{Dir: "a", Url: "https://github.com/a/b.git", Protocol: "https", Username: "a", Token: "t"},
+		},
+		{
+			name:    "ssh with token",
+			git:     Git{Dir: "a", Url: "git@github.com:a/b.git", Protocol: "ssh", Token: "t"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ssh key",
+			git:     Git{Dir: "a", Url: "git@github.com:a/b.git", Protocol: "ssh", Options: Options{SSHKey: "not a key"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown protocol",
+			git:     Git{Dir: "a", Url: "ftp://example.com/b.git", Protocol: "ftp"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.git.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckGitVersion(t *testing.T) {
+	old := gitVersion
+	t.Cleanup(func() { gitVersion = old })
+	for _, tt := range []struct {
+		out string
+		err error
+		ok  bool
+	}{
+		{out: "git version 2.29.0\n", ok: true},
+		{out: "git version 2.39.3 (Apple Git-146)\n", ok: true},
+		{out: "git version 2.45.1.windows.1\n", ok: true},
+		{out: "git version 3.0.0\n", ok: true},
+		{out: "git version 2.28.0\n"},
+		{out: "git version 1.9.1\n"},
+		{out: "unexpected\n"},
+		// Missing programs are reported by the dependency check.
+		{err: errors.New("executable file not found"), ok: true},
+	} {
+		gitVersion = func() ([]byte, error) { return []byte(tt.out), tt.err }
+		if err := checkGitVersion(); (err == nil) != tt.ok {
+			t.Errorf("checkGitVersion() with %q = %v; want ok %v", tt.out, err, tt.ok)
+		}
+	}
+}
+
+func TestTransportSSHKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Git{
+		Dir:      "a",
+		Url:      "git@github.com:a/b.git",
+		Protocol: "ssh",
+		Options:  Options{SSHKey: string(pem.EncodeToMemory(block))},
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := g.newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	identity := filepath.Join(tr.tmpDir, "id")
+	fi, err := os.Stat(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("identity file mode = %v; want 0600", fi.Mode().Perm())
+	}
+	cmd := tr.command(t.Context(), "", "version")
+	if !slices.ContainsFunc(cmd.Env, func(e string) bool {
+		return strings.HasPrefix(e, "GIT_SSH_COMMAND=") && strings.Contains(e, "-i "+identity+" -o IdentitiesOnly=yes")
+	}) {
+		t.Errorf("GIT_SSH_COMMAND does not use the identity file")
+	}
+
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(identity); !os.IsNotExist(err) {
+		t.Errorf("identity file was not deleted")
+	}
+}
+
+func TestFetchWarnsAboutLFS(t *testing.T) {
+	root, work := newRemote(t)
+	if err := os.WriteFile(filepath.Join(work, ".gitattributes"), []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "add", ".gitattributes")
+	commit(t, work, "track binaries with lfs")
+	runGit(t, work, "push", "--quiet", "origin", "main")
+
+	g := &Git{
+		Dir:      "repo",
+		Url:      filepath.Join(root, "repo.git"),
+		Protocol: "ssh",
+	}
+	rep := report.New()
+	if err := g.Fetch(t.TempDir(), rep.Source(g.String())); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num(report.Warning) != 1 {
+		t.Errorf("got %d warnings; want 1", rep.Num(report.Warning))
+	}
+}
+
+func TestCountFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"a/b": 3, "a/c": 4, "d": 5} {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, make([]byte, size), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, size, err := countFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || size != 12 {
+		t.Errorf("countFiles() = %d, %d; want 3, 12", n, size)
+	}
+
+	if n, _, err := countFiles(filepath.Join(dir, "missing")); n != 0 || err != nil {
+		t.Errorf("countFiles(missing) = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestFetchBundleAndSubmodules(t *testing.T) {
+	root, work := newRemote(t)
+	gitmodules := `[submodule "lib"]
+	path = lib
+	url = ../lib.git
+[submodule "other"]
+	path = other
+	url = https://example.com/other/repo.git
+`
+	if err := os.WriteFile(filepath.Join(work, ".gitmodules"), []byte(gitmodules), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "add", ".gitmodules")
+	want := commit(t, work, "add submodules")
+	runGit(t, work, "push", "--quiet", "origin", "main")
+
+	stagingDir := t.TempDir()
+	g := &Git{
+		Dir:      "user/repo",
+		Url:      filepath.Join(root, "repo.git"),
+		Protocol: "ssh",
+		Options:  Options{Bundle: true, Submodules: true},
+	}
+	rep := report.New()
+	if err := g.Fetch(stagingDir, rep.Source(g.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bundle can be cloned.
+	bundle := filepath.Join(stagingDir, "user/repo.bundle")
+	clone := t.TempDir()
+	runGit(t, clone, "clone", "--quiet", "--bare", bundle, ".")
+	if got := runGit(t, clone, "rev-parse", "refs/heads/main"); got != want {
+		t.Errorf("bundle refs/heads/main = %s; want %s", got, want)
+	}
+
+	// Relative urls are resolved against the repo's url.
+	urls, err := submoduleURLs(t.Context(), filepath.Join(stagingDir, g.Dir), "git@example.com:user/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantURLs := []string{"example.com/user/lib.git", "https://example.com/other/repo.git"}
+	if !slices.Equal(urls, wantURLs) {
+		t.Errorf("submoduleURLs() = %q; want %q", urls, wantURLs)
+	}
+	if got := g.SubmoduleURLs(); len(got) != 2 {
+		t.Errorf("SubmoduleURLs() = %q; want 2 urls", got)
+	}
+
+	// Only the submodule without a fetcher is reported.
+	g.submodules = urls
+	lib := &Git{Dir: "user/lib", Url: "https://example.com/user/lib", Protocol: "https"}
+	CheckSubmodules([]fetcher.Fetcher{g, lib}, rep)
+	if rep.Num(report.Warning) != 1 {
+		t.Errorf("got %d warnings; want 1", rep.Num(report.Warning))
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for _, u := range []string{
+		"git@github.com:User/Repo.git",
+		"ssh://git@github.com/user/repo",
+		"ssh://git@github.com:22/user/repo.git",
+		"https://github.com/user/repo.git",
+		"https://github.com/user/repo/",
+	} {
+		if got := normalizeURL(u); got != "github.com/user/repo" {
+			t.Errorf("normalizeURL(%q) = %q; want %q", u, got, "github.com/user/repo")
+		}
+	}
+}
+
+func TestFetchPreservesRefs(t *testing.T) {
+	root, work := newRemote(t)
+	runGit(t, work, "branch", "feature")
+	runGit(t, work, "push", "--quiet", "origin", "feature")
+	oldMain := runGit(t, work, "rev-parse", "main")
+
+	stagingDir := t.TempDir()
+	g := &Git{
+		Dir:      "repo",
+		Url:      filepath.Join(root, "repo.git"),
+		Protocol: "ssh",
+	}
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite main and delete feature.
+	runGit(t, work, "commit", "--quiet", "--amend", "--allow-empty", "-m", "rewritten")
+	runGit(t, work, "push", "--quiet", "--force", "origin", "main", ":feature")
+
+	rep := report.New()
+	if err := g.Fetch(stagingDir, rep.Source(g.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.Counts[g.String()]["preserved refs"]; got != 2 {
+		t.Errorf("preserved %d refs; want 2", got)
+	}
+
+	mirror := filepath.Join(stagingDir, g.Dir)
+	refs := runGit(t, mirror, "for-each-ref", "--format=%(objectname) %(refname)")
+	for _, pattern := range []string{
+		oldMain + " refs/backup/*/heads/main",
+		oldMain + " refs/backup/*/heads/feature",
+	} {
+		found := false
+		for _, line := range strings.Split(refs, "\n") {
+			if ok, _ := filepath.Match(pattern, line); ok {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no ref matching %q in:\n%s", pattern, refs)
+		}
+	}
+	if strings.Contains(refs, " refs/heads/feature") {
+		t.Error("deleted branch was not pruned")
+	}
+
+	// The preserved refs survive the next update.
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := runGit(t, mirror, "for-each-ref", "--format=%(objectname) %(refname)"); got != refs {
+		t.Errorf("refs changed on the next update:\n%s\nwant:\n%s", got, refs)
+	}
+}
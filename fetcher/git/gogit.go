@@ -0,0 +1,249 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	gittransport "github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/rjoleary/backup/report"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	// By default, go-git runs git-upload-pack for file:// urls. Serve them
+	// in-process instead so the go backend does not depend on git.
+	client.InstallProtocol("file", server.DefaultServer)
+}
+
+// goAuth returns the go-git equivalent of the transport's options.
+func (g *Git) goAuth(t *transport) (gittransport.AuthMethod, error) {
+	ep, err := gittransport.NewEndpoint(g.Url)
+	if err != nil {
+		return nil, err
+	}
+	switch ep.Protocol {
+	case "ssh":
+		user := ep.User
+		if user == "" {
+			user = "git"
+		}
+		hostKeyCallback, err := knownhosts.New(filepath.Join(t.tmpDir, "known_hosts"))
+		if err != nil {
+			return nil, err
+		}
+		if g.SSHKey != "" {
+			auth, err := gitssh.NewPublicKeys(user, []byte(g.SSHKey), "")
+			if err != nil {
+				return nil, err
+			}
+			auth.HostKeyCallback = hostKeyCallback
+			return auth, nil
+		}
+		auth, err := gitssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	case "http", "https":
+		if g.Token != "" {
+			return &githttp.BasicAuth{Username: g.Username, Password: g.Token}, nil
+		}
+	}
+	return nil, nil
+}
+
+// fetchGo is the same as Fetch, but uses go-git instead of running git.
+func (g *Git) fetchGo(ctx context.Context, dir string, rep *report.Source) error {
+	t, err := g.newTransport()
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	auth, err := g.goAuth(t)
+	if err != nil {
+		return err
+	}
+
+	repo, err := gogit.PlainOpen(dir)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		// Repo is new. Clone for the first time.
+		repo, err = gogit.PlainCloneContext(ctx, dir, true, &gogit.CloneOptions{
+			URL:      g.Url,
+			Auth:     auth,
+			Mirror:   true,
+			Progress: os.Stdout,
+		})
+		if errors.Is(err, gittransport.ErrEmptyRemoteRepository) {
+			rep.Infof("remote is empty")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// go-git never garbage collects, but the mirror may later be
+		// updated by the git backend.
+		cfg, err := repo.Config()
+		if err != nil {
+			return err
+		}
+		cfg.Raw.Section("gc").SetOption("auto", "0")
+		if err := repo.SetConfig(cfg); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		// Repo already exists. Update.
+		if err := goUpdate(ctx, repo, auth, rep); err != nil {
+			return err
+		}
+	}
+
+	if g.Submodules {
+		g.submodules, err = goSubmoduleURLs(repo, g.Url)
+		if err != nil {
+			return err
+		}
+		for _, u := range g.submodules {
+			rep.Infof("references submodule %s", u)
+		}
+	}
+	return nil
+}
+
+// goUpdate fetches all the refs from the remote, prunes the deleted refs and
+// preserves refs which were deleted or force-pushed.
+func goUpdate(ctx context.Context, repo *gogit.Repository, auth gittransport.AuthMethod, rep *report.Source) error {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return err
+	}
+	remoteRefs, err := remote.ListContext(ctx, &gogit.ListOptions{Auth: auth})
+	if err != nil && !errors.Is(err, gittransport.ErrEmptyRemoteRepository) {
+		return err
+	}
+	before, err := goListRefs(repo)
+	if err != nil {
+		return err
+	}
+
+	// go-git's pruning would also delete the preserved refs because they
+	// match the refspec, so deleted refs are pruned below instead.
+	err = remote.FetchContext(ctx, &gogit.FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/*:refs/*"},
+		Auth:     auth,
+		Progress: os.Stdout,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) && !errors.Is(err, gittransport.ErrEmptyRemoteRepository) {
+		return err
+	}
+	onRemote := map[string]bool{}
+	for _, r := range remoteRefs {
+		onRemote[r.Name().String()] = true
+	}
+	for ref := range before {
+		if !onRemote[ref] {
+			if err := repo.Storer.RemoveReference(plumbing.ReferenceName(ref)); err != nil {
+				return err
+			}
+		}
+	}
+
+	after, err := goListRefs(repo)
+	if err != nil {
+		return err
+	}
+	return preserveRefs(goRefs{repo}, before, after, time.Now().UTC(), rep)
+}
+
+// goListRefs is the same as listRefs.
+func goListRefs(repo *gogit.Repository) (map[string]string, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	err = iter.ForEach(func(r *plumbing.Reference) error {
+		name := r.Name().String()
+		if r.Type() == plumbing.HashReference && name != "HEAD" && !strings.HasPrefix(name, preservedRefPrefix) {
+			refs[name] = r.Hash().String()
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// goRefs is the refStore for the go backend.
+type goRefs struct {
+	repo *gogit.Repository
+}
+
+func (g goRefs) isAncestor(oldID, newID string) bool {
+	oldCommit, err := g.repo.CommitObject(plumbing.NewHash(oldID))
+	if err != nil {
+		return false
+	}
+	newCommit, err := g.repo.CommitObject(plumbing.NewHash(newID))
+	if err != nil {
+		return false
+	}
+	ok, err := oldCommit.IsAncestor(newCommit)
+	return err == nil && ok
+}
+
+func (g goRefs) setRef(ref, id string) error {
+	return g.repo.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(ref), plumbing.NewHash(id)))
+}
+
+// goSubmoduleURLs is the same as submoduleURLs.
+func goSubmoduleURLs(repo *gogit.Repository, repoURL string) ([]string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		// No HEAD.
+		return nil, nil
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	file, err := commit.File(".gitmodules")
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	modules := config.NewModules()
+	if err := modules.Unmarshal([]byte(contents)); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(modules.Submodules))
+	for name := range modules.Submodules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	urls := make([]string, 0, len(names))
+	for _, name := range names {
+		urls = append(urls, resolveSubmoduleURL(modules.Submodules[name].URL, repoURL))
+	}
+	return urls, nil
+}
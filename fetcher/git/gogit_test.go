@@ -0,0 +1,198 @@
+package git
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/rjoleary/backup/report"
+)
+
+// newGoRemote is the same as newRemote, but does not run git. It returns the
+// file:// url of the bare repo and a work tree which pushes to it.
+func newGoRemote(t *testing.T) (string, *gogit.Repository) {
+	t.Helper()
+	bare := filepath.Join(t.TempDir(), "repo.git")
+	if _, err := gogit.PlainInit(bare, true); err != nil {
+		t.Fatal(err)
+	}
+	remoteURL := "file://" + bare
+
+	work, err := gogit.PlainInit(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := work.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteURL}}); err != nil {
+		t.Fatal(err)
+	}
+	goCommit(t, work, "first", false)
+	goPush(t, work, "refs/heads/master:refs/heads/master")
+	return remoteURL, work
+}
+
+func goCommit(t *testing.T, work *gogit.Repository, msg string, amend bool) plumbing.Hash {
+	t.Helper()
+	wt, err := work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	hash, err := wt.Commit(msg, &gogit.CommitOptions{
+		AllowEmptyCommits: true,
+		Amend:             amend,
+		Author:            sig,
+		Committer:         sig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func goPush(t *testing.T, work *gogit.Repository, refSpecs ...config.RefSpec) {
+	t.Helper()
+	if err := work.Push(&gogit.PushOptions{RemoteName: "origin", RefSpecs: refSpecs}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchGo(t *testing.T) {
+	remoteURL, work := newGoRemote(t)
+	first, err := work.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goPush(t, work, "refs/heads/master:refs/heads/feature")
+
+	stagingDir := t.TempDir()
+	g := &Git{
+		Dir:      "repo",
+		Url:      remoteURL,
+		Protocol: "ssh",
+		Options:  Options{Backend: "go"},
+	}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatalf("initial Fetch() = %v", err)
+	}
+
+	// Rewrite master and delete feature.
+	want := goCommit(t, work, "rewritten", true)
+	goPush(t, work, "+refs/heads/master:refs/heads/master", ":refs/heads/feature")
+	rep := report.New()
+	if err := g.Fetch(stagingDir, rep.Source(g.String())); err != nil {
+		t.Fatalf("second Fetch() = %v", err)
+	}
+
+	mirror, err := gogit.PlainOpen(filepath.Join(stagingDir, g.Dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := goListRefs(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRefs := map[string]string{"refs/heads/master": want.String()}
+	if !maps.Equal(refs, wantRefs) {
+		t.Errorf("refs = %v; want %v", refs, wantRefs)
+	}
+	if got := rep.Counts[g.String()]["preserved refs"]; got != 2 {
+		t.Errorf("preserved %d refs; want 2", got)
+	}
+
+	// The old value of master is still reachable.
+	iter, err := mirror.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preserved := []string{}
+	iter.ForEach(func(r *plumbing.Reference) error {
+		if r.Hash() == first.Hash() {
+			preserved = append(preserved, r.Name().String())
+		}
+		return nil
+	})
+	if len(preserved) != 2 {
+		t.Errorf("got preserved refs %q; want 2", preserved)
+	}
+
+	cfg, err := mirror.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Raw.Section("gc").Option("auto"); got != "0" {
+		t.Errorf("gc.auto = %q; want 0", got)
+	}
+}
+
+func TestFetchGoSubmodules(t *testing.T) {
+	remoteURL, work := newGoRemote(t)
+	wt, err := work.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitmodules := "[submodule \"b\"]\n\tpath = b\n\turl = ../b.git\n[submodule \"a\"]\n\tpath = a\n\turl = https://example.com/a.git\n"
+	if err := os.WriteFile(filepath.Join(wt.Filesystem.Root(), ".gitmodules"), []byte(gitmodules), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add(".gitmodules"); err != nil {
+		t.Fatal(err)
+	}
+	goCommit(t, work, "add submodules", false)
+	goPush(t, work, "refs/heads/master:refs/heads/master")
+
+	g := &Git{
+		Dir:      "repo",
+		Url:      remoteURL,
+		Protocol: "ssh",
+		Options:  Options{Backend: "go", Submodules: true},
+	}
+	if err := g.Fetch(t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"https://example.com/a.git", path.Join(normalizeURL(remoteURL), "../b.git")}
+	if got := g.SubmoduleURLs(); !slices.Equal(got, want) {
+		t.Errorf("SubmoduleURLs() = %q; want %q", got, want)
+	}
+}
+
+func TestFetchGoCanceled(t *testing.T) {
+	remoteURL, _ := newGoRemote(t)
+	g := &Git{
+		Dir:      "repo",
+		Url:      remoteURL,
+		Protocol: "ssh",
+		Options:  Options{Backend: "go"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := g.fetchGo(ctx, t.TempDir(), nil); err == nil {
+		t.Fatal("fetchGo() with canceled context succeeded")
+	}
+}
+
+func TestValidateGoBackend(t *testing.T) {
+	g := &Git{
+		Dir:      "repo",
+		Url:      "git@github.com:a/b.git",
+		Protocol: "ssh",
+		Options:  Options{Backend: "go", LFS: true},
+	}
+	if err := g.Validate(); err == nil {
+		t.Error("Validate() with lfs on the go backend succeeded")
+	}
+	if deps := g.Deps(); len(deps) != 0 {
+		t.Errorf("Deps() = %v; want none", deps)
+	}
+}
@@ -0,0 +1,83 @@
+package git
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHostsEntry is a parsed line from a known_hosts file.
+type knownHostsEntry struct {
+	line  string
+	hosts []string
+}
+
+func parseKnownHosts(data string) ([]knownHostsEntry, error) {
+	entries := []knownHostsEntry{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, hosts, _, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid known_hosts line %q: %v", line, err)
+		}
+		entries = append(entries, knownHostsEntry{line, hosts})
+	}
+	return entries, nil
+}
+
+// ValidateKnownHosts checks each line is in the known_hosts format.
+func ValidateKnownHosts(lines []string) error {
+	_, err := parseKnownHosts(strings.Join(lines, "\n"))
+	return err
+}
+
+// mergeKnownHosts returns the built-in known_hosts with the extra lines
+// appended. When the extra lines contain a host, the built-in entries for that
+// host are dropped so rotated keys are no longer trusted.
+func mergeKnownHosts(extra []string) (string, error) {
+	builtin, err := parseKnownHosts(known_hosts)
+	if err != nil {
+		return "", err
+	}
+	extraEntries, err := parseKnownHosts(strings.Join(extra, "\n"))
+	if err != nil {
+		return "", err
+	}
+
+	overridden := map[string]bool{}
+	for _, e := range extraEntries {
+		for _, h := range e.hosts {
+			overridden[h] = true
+		}
+	}
+
+	var sb strings.Builder
+	for _, e := range builtin {
+		if !slices.ContainsFunc(e.hosts, func(h string) bool { return overridden[h] }) {
+			sb.WriteString(e.line + "\n")
+		}
+	}
+	for _, e := range extraEntries {
+		sb.WriteString(e.line + "\n")
+	}
+	return sb.String(), nil
+}
+
+// ReplaceKnownHosts returns lines with the entries for host replaced by
+// entries.
+func ReplaceKnownHosts(lines []string, host string, entries []string) []string {
+	out := []string{}
+	for _, line := range lines {
+		parsed, err := parseKnownHosts(line)
+		if err == nil && len(parsed) == 1 && slices.Contains(parsed[0].hosts, host) {
+			continue
+		}
+		out = append(out, line)
+	}
+	return append(out, entries...)
+}
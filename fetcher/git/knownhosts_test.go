@@ -0,0 +1,46 @@
+package git
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testGitLabKey = "gitlab.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAfuCHKVTjquxvt6CM6tdG4SLp1Btn/nOeHHE5UOzRdf"
+	testGitHubKey = "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIazEu89wgQZ4bqs3d63QSMzYVa0MuJ2e2gKTKqu+UUO"
+)
+
+func TestMergeKnownHosts(t *testing.T) {
+	got, err := mergeKnownHosts([]string{testGitLabKey, testGitHubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, testGitLabKey) {
+		t.Error("extra host is missing")
+	}
+	if !strings.Contains(got, "bitbucket.org ssh-ed25519") {
+		t.Error("built-in host is missing")
+	}
+
+	// The built-in github.com keys are replaced.
+	if n := strings.Count(got, "github.com "); n != 1 {
+		t.Errorf("got %d github.com keys; want 1", n)
+	}
+}
+
+func TestValidateKnownHosts(t *testing.T) {
+	if err := ValidateKnownHosts([]string{testGitLabKey}); err != nil {
+		t.Errorf("ValidateKnownHosts(valid) = %v", err)
+	}
+	if err := ValidateKnownHosts([]string{"gitlab.com ssh-ed25519 notbase64"}); err == nil {
+		t.Error("ValidateKnownHosts(invalid) succeeded")
+	}
+}
+
+func TestReplaceKnownHosts(t *testing.T) {
+	got := ReplaceKnownHosts([]string{testGitLabKey, testGitHubKey}, "github.com", []string{"github.com new"})
+	want := []string{testGitLabKey, "github.com new"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ReplaceKnownHosts() = %q; want %q", got, want)
+	}
+}
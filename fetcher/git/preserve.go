@@ -0,0 +1,127 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// preservedRefPrefix is the namespace for refs which were force-pushed or
+// deleted on the remote. For example, if the branch "main" was force-pushed,
+// its old value is saved to "refs/backup/<timestamp>/heads/main".
+const preservedRefPrefix = "refs/backup/"
+
+// gitVersion returns the output of "git --version". git is only run once. It
+// is overridden by tests.
+var gitVersion = sync.OnceValues(func() ([]byte, error) {
+	return exec.Command("git", "--version").Output()
+})
+
+// checkGitVersion returns an error if git is older than 2.29, which added the
+// negative refspecs used to keep the preserved refs out of the mirror's
+// refspec. A missing git is not an error here, since it is reported as a
+// missing dependency.
+func checkGitVersion() error {
+	out, err := gitVersion()
+	if err != nil {
+		return nil
+	}
+	// For example "git version 2.39.3 (Apple Git-146)".
+	fields := strings.Fields(string(out))
+	var major, minor int
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected output of git --version: %q", out)
+	}
+	if _, err := fmt.Sscanf(fields[2], "%d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("unexpected output of git --version: %q", out)
+	}
+	if major < 2 || major == 2 && minor < 29 {
+		return fmt.Errorf("git >= 2.29 required, found %s", fields[2])
+	}
+	return nil
+}
+
+// refStore is implemented by each backend for preserveRefs.
+type refStore interface {
+	// isAncestor returns true if oldID is an ancestor of newID.
+	isAncestor(oldID, newID string) bool
+	setRef(ref, id string) error
+}
+
+// cliRefs is the refStore for the git backend.
+type cliRefs struct {
+	ctx context.Context
+	dir string
+}
+
+func (c cliRefs) isAncestor(oldID, newID string) bool {
+	cmd := exec.CommandContext(c.ctx, "git", "merge-base", "--is-ancestor", oldID, newID)
+	cmd.Dir = c.dir
+	return cmd.Run() == nil
+}
+
+func (c cliRefs) setRef(ref, id string) error {
+	cmd := exec.CommandContext(c.ctx, "git", "update-ref", ref, id)
+	cmd.Dir = c.dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// listRefs returns a map from ref name to object id. Preserved refs are
+// excluded.
+func listRefs(ctx context.Context, dir string) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %v", err)
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		id, ref, ok := strings.Cut(line, " ")
+		if ok && !strings.HasPrefix(ref, preservedRefPrefix) {
+			refs[ref] = id
+		}
+	}
+	return refs, nil
+}
+
+// preserveRefs compares the refs from before and after an update. The old
+// value of each ref which was deleted or force-pushed is saved under
+// preservedRefPrefix so the lost commits remain reachable by name.
+func preserveRefs(store refStore, before, after map[string]string, now time.Time, rep *report.Source) error {
+	names := make([]string, 0, len(before))
+	for ref := range before {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	timestamp := now.Format("2006-01-02T15-04-05")
+	for _, ref := range names {
+		oldID := before[ref]
+		newID, ok := after[ref]
+		event := "deleted"
+		if ok {
+			if newID == oldID || store.isAncestor(oldID, newID) {
+				continue
+			}
+			event = "force-pushed"
+		}
+
+		preserved := preservedRefPrefix + timestamp + "/" + strings.TrimPrefix(ref, "refs/")
+		if err := store.setRef(preserved, oldID); err != nil {
+			return fmt.Errorf("failed to preserve %s: %v", ref, err)
+		}
+		rep.Warnf("%s was %s, old value %s preserved as %s", ref, event, oldID, preserved)
+		rep.Count("preserved refs", 1)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package git
+
+import (
+	"context"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// submoduleURLs returns the urls in the .gitmodules file on HEAD. Relative
+// urls are resolved against the repo's url.
+func submoduleURLs(ctx context.Context, dir, repoURL string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "config", "--blob", "HEAD:.gitmodules",
+		"--get-regexp", `^submodule\..*\.url$`)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		// There is no .gitmodules file, or no HEAD.
+		return nil, nil
+	}
+
+	urls := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		_, u, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		urls = append(urls, resolveSubmoduleURL(u, repoURL))
+	}
+	return urls, nil
+}
+
+// resolveSubmoduleURL resolves relative submodule urls against the repo's
+// url.
+func resolveSubmoduleURL(u, repoURL string) string {
+	if strings.HasPrefix(u, "./") || strings.HasPrefix(u, "../") {
+		return path.Join(normalizeURL(repoURL), u)
+	}
+	return u
+}
+
+// normalizeURL converts the various forms of a git url into "host/path" so
+// they can be compared. For example, these all normalize to
+// "github.com/user/repo":
+//
+//	git@github.com:user/repo.git
+//	ssh://git@github.com/user/repo
+//	https://github.com/user/repo.git
+func normalizeURL(u string) string {
+	if parsed, err := url.Parse(u); err == nil && (parsed.Host != "" || parsed.Scheme == "file") {
+		u = parsed.Hostname() + "/" + parsed.Path
+	} else if before, after, ok := strings.Cut(u, ":"); ok && !strings.Contains(before, "/") {
+		// scp-like syntax: [user@]host:path
+		if i := strings.LastIndex(before, "@"); i >= 0 {
+			before = before[i+1:]
+		}
+		u = before + "/" + after
+	}
+	u = path.Clean(strings.ToLower(u))
+	return strings.TrimSuffix(u, ".git")
+}
+
+// SubmoduleURLs returns the submodule urls recorded by the last Fetch.
+func (g *Git) SubmoduleURLs() []string {
+	return g.submodules
+}
+
+// CheckSubmodules warns about submodules which are not backed up by any of the
+// git fetchers.
+func CheckSubmodules(fetchers []fetcher.Fetcher, rep *report.Report) {
+	covered := map[string]bool{}
+	for _, f := range fetchers {
+		if g, ok := f.(*Git); ok {
+			covered[normalizeURL(g.Url)] = true
+		}
+	}
+	for _, f := range fetchers {
+		g, ok := f.(*Git)
+		if !ok {
+			continue
+		}
+		for _, u := range g.submodules {
+			if !covered[normalizeURL(u)] {
+				rep.Source(g.String()).Warnf("submodule %s is not backed up", u)
+			}
+		}
+	}
+}
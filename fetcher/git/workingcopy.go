@@ -0,0 +1,260 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// stashRefPrefix is the namespace in the mirror for the entries of the stash.
+// Only the latest entry has a ref in the working copy, the others are in the
+// reflog of refs/stash. They are named by commit id, because their indices
+// change when a stash is pushed or popped.
+const stashRefPrefix = "refs/stashes/"
+
+// emptyTree is the id of the empty tree object.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// WorkingCopy mirrors a local git repo, including the branches which have
+// not been pushed and the stash. Deleted and rewritten refs are preserved
+// like in Git.
+type WorkingCopy struct {
+	// Path is the working tree, or a bare repo.
+	Path string `json:"path"`
+	// Dir is the mirror in the staging area.
+	Dir string `json:"dir"`
+	// Patch additionally writes the uncommitted changes, including the
+	// untracked files which are not ignored, to "<dir>.patch". It can be
+	// applied to a checkout of HEAD with `git apply`.
+	Patch bool `json:"patch,omitempty"`
+}
+
+func (w *WorkingCopy) String() string {
+	return w.Path
+}
+
+func (w *WorkingCopy) Name() string {
+	return "Git working copy"
+}
+
+func (w *WorkingCopy) Destinations() []string {
+	if w.Patch {
+		return []string{w.Dir, w.Dir + ".patch"}
+	}
+	return []string{w.Dir}
+}
+
+func (w *WorkingCopy) Deps() map[string][]string {
+	return map[string][]string{"git": {"git", "--version"}}
+}
+
+func (w *WorkingCopy) Validate() error {
+	if w.Path == "" {
+		return errors.New("path is required")
+	}
+	if !filepath.IsAbs(w.Path) {
+		return fmt.Errorf("path must be absolute, got %q", w.Path)
+	}
+	if w.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if err := fetcher.ValidateDest("dir", w.Dir); err != nil {
+		return err
+	}
+	return checkGitVersion()
+}
+
+// gitOutput runs git in dir and returns stdout.
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return string(out), nil
+}
+
+func (w *WorkingCopy) Fetch(stagingDir string, rep *report.Source) error {
+	dir := filepath.Join(stagingDir, w.Dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// As in Git.Fetch, the mirror is a bare repo.
+	out, _ := gitOutput(ctx, dir, "rev-parse", "--git-dir")
+	if strings.TrimSpace(out) != "." {
+		if _, err := gitOutput(ctx, dir, "init", "--quiet", "--bare"); err != nil {
+			return err
+		}
+		if _, err := gitOutput(ctx, dir, "config", "gc.auto", "0"); err != nil {
+			return err
+		}
+	}
+
+	stashes, err := gitOutput(ctx, w.Path, "log", "--walk-reflogs", "--format=%H", "refs/stash", "--")
+	if err != nil {
+		// There is no stash.
+		stashes = ""
+	}
+	refspecs := []string{
+		"+refs/*:refs/*",
+		// The stash is mirrored with stashRefPrefix instead.
+		"^refs/stash",
+		// The mirror's refspec would otherwise prune the preserved refs.
+		"^" + preservedRefPrefix + "*",
+	}
+	for _, id := range strings.Fields(stashes) {
+		refspecs = append(refspecs, "+"+id+":"+stashRefPrefix+id)
+	}
+
+	before, err := listRefs(ctx, dir)
+	if err != nil {
+		return err
+	}
+	// The stash entries are not advertised by the working copy, so they
+	// are requested by id.
+	args := append([]string{"fetch", "--quiet", "--prune", "--no-write-fetch-head",
+		"--upload-pack=git -c uploadpack.allowAnySHA1InWant=true upload-pack", w.Path}, refspecs...)
+	if _, err := gitOutput(ctx, dir, args...); err != nil {
+		return err
+	}
+	after, err := listRefs(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if err := preserveRefs(cliRefs{ctx, dir}, before, after, time.Now().UTC(), rep); err != nil {
+		return err
+	}
+	// The mirror's HEAD points at the same branch as the working copy.
+	if head, err := gitOutput(ctx, w.Path, "symbolic-ref", "--quiet", "HEAD"); err == nil {
+		if _, err := gitOutput(ctx, dir, "symbolic-ref", "HEAD", strings.TrimSpace(head)); err != nil {
+			return err
+		}
+	}
+	rep.Count("refs", int64(len(after)))
+	rep.Count("stashes", int64(len(strings.Fields(stashes))))
+
+	if err := reportAhead(ctx, w.Path, rep); err != nil {
+		return err
+	}
+
+	if w.Patch {
+		if err := w.writePatch(ctx, filepath.Join(stagingDir, w.Dir+".patch"), rep); err != nil {
+			return fmt.Errorf("failed to save uncommitted changes: %v", err)
+		}
+	}
+	return nil
+}
+
+// reportAhead warns about the branches with commits which have not been
+// pushed to their upstream.
+func reportAhead(ctx context.Context, path string, rep *report.Source) error {
+	out, err := gitOutput(ctx, path, "for-each-ref",
+		"--format=%(refname:short)%00%(upstream:short)%00%(upstream:track,nobracket)", "refs/heads")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], "ahead ") {
+			continue
+		}
+		rep.Warnf("branch %s is %s of %s", fields[0], fields[2], fields[1])
+		rep.Count("unpushed branches", 1)
+	}
+	return nil
+}
+
+// writePatch writes the difference between HEAD and the working tree to
+// file, or removes the file if there are no changes. The untracked files are
+// added to a copy of the index with a temporary object directory, so the
+// working copy is not modified.
+func (w *WorkingCopy) writePatch(ctx context.Context, file string, rep *report.Source) error {
+	out, err := gitOutput(ctx, w.Path, "rev-parse", "--is-bare-repository", "--git-path", "index", "--git-path", "objects")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return fmt.Errorf("unexpected output of git rev-parse: %q", out)
+	}
+	if fields[0] == "true" {
+		return nil
+	}
+	index, objects := fields[1], fields[2]
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(w.Path, index)
+	}
+	if !filepath.IsAbs(objects) {
+		objects = filepath.Join(w.Path, objects)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "backup_git")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpIndex := filepath.Join(tmpDir, "index")
+	tmpObjects := filepath.Join(tmpDir, "objects")
+	if err := os.Mkdir(tmpObjects, 0700); err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(index); err == nil {
+		if err := os.WriteFile(tmpIndex, data, 0600); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	base := "HEAD"
+	if _, err := gitOutput(ctx, w.Path, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		// There are no commits yet.
+		base = emptyTree
+	}
+	diff := ""
+	for _, args := range [][]string{
+		{"add", "--all"},
+		{"diff", "--cached", "--binary", base},
+	} {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = w.Path
+		// New blobs are written to a temporary object directory.
+		cmd.Env = append(cmd.Environ(),
+			"GIT_INDEX_FILE="+tmpIndex,
+			"GIT_OBJECT_DIRECTORY="+tmpObjects,
+			"GIT_ALTERNATE_OBJECT_DIRECTORIES="+objects)
+		out, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("git %s: %v", args[0], err)
+		}
+		diff = string(out)
+	}
+
+	if diff == "" {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.WriteFile(file, []byte(diff), 0600); err != nil {
+		return err
+	}
+	rep.Infof("saved uncommitted changes to %s", filepath.Base(file))
+	rep.Count("patch bytes", int64(len(diff)))
+	return nil
+}
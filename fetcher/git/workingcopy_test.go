@@ -0,0 +1,97 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func TestWorkingCopy(t *testing.T) {
+	_, work := newRemote(t)
+	runGit(t, work, "fetch", "--quiet", "origin")
+	runGit(t, work, "branch", "--quiet", "--set-upstream-to=origin/main")
+	if err := os.WriteFile(filepath.Join(work, "a.txt"), []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "add", "a.txt")
+	head := commit(t, work, "unpushed")
+
+	// Two stash entries, only the latest of which has a ref.
+	stashes := []string{}
+	for _, content := range []string{"two\n", "three\n"} {
+		if err := os.WriteFile(filepath.Join(work, "a.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, work, "stash", "--quiet")
+		stashes = append(stashes, runGit(t, work, "rev-parse", "refs/stash"))
+	}
+
+	// Uncommitted changes.
+	if err := os.WriteFile(filepath.Join(work, "a.txt"), []byte("four\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "new.txt"), []byte("untracked\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status := runGit(t, work, "status", "--porcelain")
+
+	w := &WorkingCopy{Path: work, Dir: "src/repo", Patch: true}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := report.New()
+	stagingDir := t.TempDir()
+	if err := w.Fetch(stagingDir, r.Source(w.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror := filepath.Join(stagingDir, "src/repo")
+	if got := runGit(t, mirror, "rev-parse", "refs/heads/main"); got != head {
+		t.Errorf("refs/heads/main = %s; want %s", got, head)
+	}
+	for _, id := range stashes {
+		if got := runGit(t, mirror, "rev-parse", stashRefPrefix+id); got != id {
+			t.Errorf("%s%s = %s", stashRefPrefix, id, got)
+		}
+	}
+	if got := r.Counts[w.String()]["unpushed branches"]; got != 1 {
+		t.Errorf("unpushed branches = %d; want 1", got)
+	}
+	if got := runGit(t, work, "status", "--porcelain"); got != status {
+		t.Errorf("status changed to %q; want %q", got, status)
+	}
+
+	// The patch applies to a checkout of HEAD.
+	patch := filepath.Join(stagingDir, "src/repo.patch")
+	checkout := t.TempDir()
+	runGit(t, checkout, "clone", "--quiet", mirror, ".")
+	runGit(t, checkout, "apply", patch)
+	for file, want := range map[string]string{"a.txt": "four\n", "new.txt": "untracked\n"} {
+		got, err := os.ReadFile(filepath.Join(checkout, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q; want %q", file, got, want)
+		}
+	}
+
+	// Dropping a stash entry preserves it, and the patch is removed once
+	// everything is committed.
+	runGit(t, work, "stash", "drop", "--quiet", "stash@{1}")
+	runGit(t, work, "add", "--all")
+	commit(t, work, "everything")
+	if err := w.Fetch(stagingDir, r.Source(w.String())); err != nil {
+		t.Fatal(err)
+	}
+	refs := runGit(t, mirror, "for-each-ref", "--format=%(refname)", preservedRefPrefix)
+	if !strings.HasSuffix(refs, "/stashes/"+stashes[0]) {
+		t.Errorf("preserved refs = %q; want the dropped stash", refs)
+	}
+	if _, err := os.Stat(patch); !os.IsNotExist(err) {
+		t.Errorf("patch still exists: %v", err)
+	}
+}
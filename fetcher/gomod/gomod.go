@@ -0,0 +1,371 @@
+// Package gomod downloads the Go modules which the mirrored git repos depend
+// on, so the repos can still be built if the modules vanish upstream.
+package gomod
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// DefaultProxy is the module proxy used if none is configured.
+const DefaultProxy = "https://proxy.golang.org"
+
+// client is used for the requests to the proxy.
+var client = &http.Client{Timeout: 5 * time.Minute}
+
+// GoModules reads go.mod and go.sum on HEAD of the git mirrors in the staging
+// area, and downloads the module versions into dest in the layout of a module
+// proxy. Set GOPROXY=file://<dest> to build from it.
+//
+// The fetchers run in order of their name, so the git mirrors are updated
+// before the modules are downloaded.
+type GoModules struct {
+	// Repos are patterns for filepath.Glob which match the git mirrors,
+	// relative to the staging area. For example "github/*".
+	Repos []string `json:"repos"`
+	// Proxy defaults to DefaultProxy.
+	Proxy string `json:"proxy,omitempty"`
+	Dest  string `json:"dest"`
+}
+
+// sums are the hashes from go.sum. An empty hash is not verified.
+type sums struct {
+	// zip is empty if only the go.mod file is needed.
+	zip, mod string
+	// needZip is set if the module's code is needed, not just its go.mod
+	// file.
+	needZip bool
+}
+
+func (g *GoModules) String() string {
+	return "go modules " + g.Dest
+}
+
+func (g *GoModules) Name() string {
+	return "Go modules"
+}
+
+func (g *GoModules) proxy() string {
+	if g.Proxy == "" {
+		return DefaultProxy
+	}
+	return strings.TrimSuffix(g.Proxy, "/")
+}
+
+func (g *GoModules) Validate() error {
+	if len(g.Repos) == 0 {
+		return errors.New("repos is required")
+	}
+	for _, r := range g.Repos {
+		if _, err := filepath.Match(r, ""); err != nil {
+			return fmt.Errorf("invalid repos pattern %q: %v", r, err)
+		}
+		if err := fetcher.ValidateDest("repos", r); err != nil {
+			return err
+		}
+	}
+	if u, err := url.Parse(g.proxy()); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("proxy must be an http or https url, got %q", g.Proxy)
+	}
+	if g.Dest == "" {
+		return errors.New("dest is required")
+	}
+	return fetcher.ValidateDest("dest", g.Dest)
+}
+
+func (g *GoModules) Destinations() []string {
+	return []string{g.Dest}
+}
+
+func (g *GoModules) Deps() map[string][]string {
+	return map[string][]string{"git": {"git", "--version"}}
+}
+
+// gitOutput runs git in the mirror and returns stdout.
+func gitOutput(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+// readRepo adds the modules required by every go.mod file on HEAD of the
+// mirror to mods.
+func readRepo(ctx context.Context, dir string, mods map[module.Version]*sums, rep *report.Source) error {
+	if _, err := gitOutput(ctx, dir, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		rep.Infof("skipping %s: no commits", dir)
+		return nil
+	}
+	out, err := gitOutput(ctx, dir, "ls-tree", "-r", "-z", "--name-only", "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, file := range strings.Split(string(out), "\x00") {
+		if path.Base(file) != "go.mod" || strings.Contains("/"+file, "/vendor/") || strings.Contains("/"+file, "/testdata/") {
+			continue
+		}
+		data, err := gitOutput(ctx, dir, "show", "HEAD:"+file)
+		if err != nil {
+			return err
+		}
+		f, err := modfile.ParseLax(file, data, nil)
+		if err != nil {
+			rep.Warnf("%s: %v", filepath.Join(dir, file), err)
+			continue
+		}
+		rep.Count("go.mod files", 1)
+		for _, r := range f.Require {
+			add(mods, r.Mod).needZip = true
+		}
+		for _, r := range f.Replace {
+			// Replacements with a local directory have no version.
+			if r.New.Version != "" {
+				add(mods, r.New).needZip = true
+			}
+		}
+
+		sumFile := path.Join(path.Dir(file), "go.sum")
+		data, err = gitOutput(ctx, dir, "show", "HEAD:"+sumFile)
+		if err != nil {
+			// go.sum is missing if there are no dependencies.
+			continue
+		}
+		if err := parseSums(data, mods); err != nil {
+			rep.Warnf("%s: %v", filepath.Join(dir, sumFile), err)
+		}
+	}
+	return nil
+}
+
+func add(mods map[module.Version]*sums, m module.Version) *sums {
+	s, ok := mods[m]
+	if !ok {
+		s = &sums{}
+		mods[m] = s
+	}
+	return s
+}
+
+// parseSums adds the lines of a go.sum file, which look like
+// "golang.org/x/mod v0.30.0 h1:..." or "golang.org/x/mod v0.30.0/go.mod h1:...".
+func parseSums(data []byte, mods map[module.Version]*sums) error {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: malformed", n)
+		}
+		if version, ok := strings.CutSuffix(fields[1], "/go.mod"); ok {
+			add(mods, module.Version{Path: fields[0], Version: version}).mod = fields[2]
+		} else {
+			sum := add(mods, module.Version{Path: fields[0], Version: fields[1]})
+			sum.zip = fields[2]
+			sum.needZip = true
+		}
+	}
+	return s.Err()
+}
+
+func (g *GoModules) Fetch(stagingDir string, rep *report.Source) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	mods := map[module.Version]*sums{}
+	for _, pattern := range g.Repos {
+		dirs, err := filepath.Glob(filepath.Join(stagingDir, pattern))
+		if err != nil {
+			return err
+		}
+		if len(dirs) == 0 {
+			rep.Warnf("no repos match %q", pattern)
+		}
+		for _, dir := range dirs {
+			if err := readRepo(ctx, dir, mods, rep); err != nil {
+				return fmt.Errorf("%s: %v", dir, err)
+			}
+		}
+	}
+
+	versions := make([]module.Version, 0, len(mods))
+	for m := range mods {
+		if err := module.Check(m.Path, m.Version); err != nil {
+			rep.Warnf("skipping %v", err)
+			continue
+		}
+		versions = append(versions, m)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].Path != versions[j].Path {
+			return versions[i].Path < versions[j].Path
+		}
+		return semver.Compare(versions[i].Version, versions[j].Version) < 0
+	})
+
+	dest := filepath.Join(stagingDir, g.Dest)
+	failed := 0
+	lists := map[string][]string{}
+	for _, m := range versions {
+		if err := g.download(ctx, dest, m, mods[m], rep); err != nil {
+			rep.Warnf("%s@%s: %v", m.Path, m.Version, err)
+			failed++
+			continue
+		}
+		lists[m.Path] = append(lists[m.Path], m.Version)
+		rep.Count("modules", 1)
+	}
+	for p, vs := range lists {
+		if err := writeList(dest, p, vs); err != nil {
+			return err
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to download %d modules", failed)
+	}
+	return nil
+}
+
+// download saves the .info, .mod and optionally .zip files of a module
+// version. Files which already exist are kept.
+func (g *GoModules) download(ctx context.Context, dest string, m module.Version, sum *sums, rep *report.Source) error {
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return err
+	}
+	escVersion, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(dest, filepath.FromSlash(escPath), "@v")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	exts := []string{".info", ".mod"}
+	if sum.needZip {
+		exts = append(exts, ".zip")
+	}
+	for _, ext := range exts {
+		file := filepath.Join(dir, escVersion+ext)
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		tmp := file + ".tmp"
+		n, err := g.get(ctx, escPath+"/@v/"+escVersion+ext, tmp)
+		if err == nil {
+			err = verify(tmp, ext, sum)
+		}
+		if err == nil {
+			err = os.Rename(tmp, file)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		rep.Count("module bytes", n)
+	}
+	if sum.needZip && sum.zip == "" || sum.mod == "" {
+		rep.Warnf("%s@%s is not in go.sum, so it was not verified", m.Path, m.Version)
+	}
+	return nil
+}
+
+// get downloads a file from the proxy.
+func (g *GoModules) get(ctx context.Context, p, file string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.proxy()+"/"+p, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", p, resp.Status)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// verify checks a downloaded file against the hash in go.sum.
+func verify(file, ext string, sum *sums) error {
+	var got, want string
+	var err error
+	switch {
+	case ext == ".mod" && sum.mod != "":
+		want = sum.mod
+		got, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return os.Open(file)
+		})
+	case ext == ".zip" && sum.zip != "":
+		want = sum.zip
+		got, err = dirhash.HashZip(file, dirhash.Hash1)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s checksum mismatch: got %s, go.sum has %s", ext, got, want)
+	}
+	return nil
+}
+
+// writeList adds versions to the list file of a module, which the go command
+// reads to resolve queries such as @latest.
+func writeList(dest, modPath string, versions []string) error {
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dest, filepath.FromSlash(escPath), "@v", "list")
+	seen := map[string]bool{}
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, v := range append(strings.Fields(string(data)), versions...) {
+		seen[v] = true
+	}
+	all := make([]string, 0, len(seen))
+	for v := range seen {
+		all = append(all, v)
+	}
+	semver.Sort(all)
+	return os.WriteFile(file, []byte(strings.Join(all, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,267 @@
+package gomod
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// proxyModule is a module version served by the fake proxy.
+type proxyModule struct {
+	path, escPath, version string
+	mod                    string
+	// files are the files in the zip other than go.mod.
+	files map[string]string
+}
+
+// zip returns the zip file and its hash.
+func (m *proxyModule) zip(t *testing.T) ([]byte, string) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	files := map[string]string{"go.mod": m.mod}
+	for name, content := range m.files {
+		files[name] = content
+	}
+	for name, content := range files {
+		f, err := w.Create(m.path + "@" + m.version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(f, content)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "mod.zip")
+	if err := os.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := dirhash.HashZip(file, dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), sum
+}
+
+func (m *proxyModule) modSum(t *testing.T) string {
+	t.Helper()
+	sum, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(m.mod)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+// runCmd runs a command in dir and returns the trimmed stdout.
+func runCmd(t *testing.T, dir string, env []string, name string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %v: %v: %s", name, args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitAll creates a repo in dir with a commit of all the files.
+func commitAll(t *testing.T, dir string) {
+	t.Helper()
+	env := []string{
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	}
+	runCmd(t, dir, env, "git", "init", "--quiet")
+	runCmd(t, dir, env, "git", "add", ".")
+	runCmd(t, dir, env, "git", "commit", "--quiet", "-m", "first")
+}
+
+func TestFetch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	modules := []*proxyModule{
+		{
+			path: "example.com/a", escPath: "example.com/a", version: "v1.0.0",
+			mod:   "module example.com/a\n\ngo 1.21\n\nrequire example.com/c v0.1.0\n",
+			files: map[string]string{"a.go": "package a\n\nconst A = \"a\"\n"},
+		},
+		{
+			// Upper case letters are escaped in the proxy's paths.
+			path: "example.com/B", escPath: "example.com/!b", version: "v1.1.0",
+			mod:   "module example.com/B\n\ngo 1.21\n",
+			files: map[string]string{"b.go": "package b\n\nconst B = \"b\"\n"},
+		},
+		{
+			// Only the go.mod file of c is needed.
+			path: "example.com/c", escPath: "example.com/c", version: "v0.1.0",
+			mod:   "module example.com/c\n\ngo 1.21\n",
+			files: map[string]string{"c.go": "package c\n"},
+		},
+	}
+
+	files := map[string][]byte{}
+	goSum := ""
+	for _, m := range modules {
+		prefix := "/" + m.escPath + "/@v/" + m.version
+		zipData, zipSum := m.zip(t)
+		files[prefix+".info"] = []byte(fmt.Sprintf(`{"Version":%q,"Time":"2024-01-02T03:04:05Z"}`, m.version))
+		files[prefix+".mod"] = []byte(m.mod)
+		files[prefix+".zip"] = zipData
+		if m.path != "example.com/c" {
+			goSum += fmt.Sprintf("%s %s %s\n", m.path, m.version, zipSum)
+		}
+		goSum += fmt.Sprintf("%s %s/go.mod %s\n", m.path, m.version, m.modSum(t))
+	}
+	var mu sync.Mutex
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	// A repo which depends on a and B, mirrored into the staging area.
+	work := t.TempDir()
+	for name, content := range map[string]string{
+		"go.mod":  "module example.com/app\n\ngo 1.21\n\nrequire (\n\texample.com/B v1.1.0\n\texample.com/a v1.0.0\n)\n",
+		"go.sum":  goSum,
+		"main.go": "package main\n\nimport (\n\t\"example.com/B\"\n\t\"example.com/a\"\n)\n\nfunc main() { println(a.A + b.B) }\n",
+	} {
+		if err := os.WriteFile(filepath.Join(work, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commitAll(t, work)
+	stagingDir := t.TempDir()
+	runCmd(t, stagingDir, nil, "git", "clone", "--quiet", "--mirror", work, "repos/app")
+
+	g := &GoModules{Repos: []string{"repos/*"}, Proxy: srv.URL, Dest: "goproxy"}
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := report.New()
+	if err := g.Fetch(stagingDir, r.Source(g.String())); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.Num(report.Warning); n != 0 {
+		t.Errorf("warnings = %d; want 0", n)
+	}
+	if got := r.Counts[g.String()]["modules"]; got != 3 {
+		t.Errorf("modules = %d; want 3", got)
+	}
+	dest := filepath.Join(stagingDir, "goproxy")
+	if _, err := os.Stat(filepath.Join(dest, "example.com/c/@v/v0.1.0.zip")); !os.IsNotExist(err) {
+		t.Errorf("zip of example.com/c was downloaded: %v", err)
+	}
+	list, err := os.ReadFile(filepath.Join(dest, "example.com/!b/@v/list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(list) != "v1.1.0\n" {
+		t.Errorf("list = %q; want %q", list, "v1.1.0\n")
+	}
+
+	// A second fetch keeps the files.
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	if err := g.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(requests) != 0 {
+		t.Errorf("second fetch requested %v", requests)
+	}
+	mu.Unlock()
+
+	// The repo builds with the directory as its proxy.
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	out := runCmd(t, work, []string{
+		"GOPROXY=file://" + filepath.ToSlash(dest),
+		"GOMODCACHE=" + t.TempDir(),
+		"GOFLAGS=-modcacherw",
+		"GOSUMDB=off",
+		"GOTOOLCHAIN=local",
+	}, "go", "run", ".")
+	// The output starts with the progress of the downloads.
+	if lines := strings.Split(out, "\n"); lines[len(lines)-1] != "ab" {
+		t.Errorf("go run = %q; want %q", out, "ab")
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "module example.com/a\n")
+	}))
+	defer srv.Close()
+
+	work := t.TempDir()
+	if err := os.WriteFile(filepath.Join(work, "go.sum"), []byte("example.com/a v1.0.0/go.mod h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "go.mod"), []byte("module example.com/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commitAll(t, work)
+
+	g := &GoModules{Repos: []string{"."}, Proxy: srv.URL, Dest: "goproxy"}
+	if err := g.Fetch(work, nil); err == nil {
+		t.Error("Fetch() succeeded; want error")
+	}
+	if _, err := os.Stat(filepath.Join(work, "goproxy/example.com/a/@v/v1.0.0.mod")); !os.IsNotExist(err) {
+		t.Errorf("mismatched go.mod was kept: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		g    GoModules
+		ok   bool
+	}{
+		{"ok", GoModules{Repos: []string{"github/*"}, Dest: "goproxy"}, true},
+		{"proxy", GoModules{Repos: []string{"github/*"}, Proxy: "https://goproxy.example.com/", Dest: "goproxy"}, true},
+		{"no repos", GoModules{Dest: "goproxy"}, false},
+		{"bad pattern", GoModules{Repos: []string{"["}, Dest: "goproxy"}, false},
+		{"repos outside", GoModules{Repos: []string{"../*"}, Dest: "goproxy"}, false},
+		{"file proxy", GoModules{Repos: []string{"github/*"}, Proxy: "file:///tmp", Dest: "goproxy"}, false},
+		{"no dest", GoModules{Repos: []string{"github/*"}}, false},
+		{"dest outside", GoModules{Repos: []string{"github/*"}, Dest: "/goproxy"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.g.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v; want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootCAs verifies the server's certificate. It is nil to use the system's
+// roots, and is replaced by tests.
+var rootCAs *x509.CertPool
+
+// idleTimeout is the time allowed without any data from or to the server. A
+// command may take longer, for example to download a large mailbox. It is
+// replaced by tests.
+var idleTimeout = 5 * time.Minute
+
+// maxLiteral limits the size of a message.
+const maxLiteral = 1 << 30
+
+// conn is a client for the subset of IMAP4rev1 (RFC 3501) needed to download
+// messages.
+type conn struct {
+	c   net.Conn
+	r   *bufio.Reader
+	tag int
+}
+
+// idleConn extends the deadline of the connection before each read and write.
+type idleConn struct {
+	net.Conn
+}
+
+func (c idleConn) Read(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(idleTimeout))
+	return c.Conn.Read(b)
+}
+
+func (c idleConn) Write(b []byte) (int, error) {
+	c.SetDeadline(time.Now().Add(idleTimeout))
+	return c.Conn.Write(b)
+}
+
+// response is a line sent by the server. Status responses have a status
+// and the rest of the line in text, the others have fields.
+type response struct {
+	// tag is "*" for untagged responses.
+	tag    string
+	status string
+	text   string
+	// fields are strings for atoms and quoted strings, []byte for literals
+	// and []any for lists.
+	fields []any
+}
+
+// dial connects to server, which is host:port, with TLS, or with STARTTLS if
+// startTLS is set.
+func dial(server string, startTLS bool) (*conn, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, RootCAs: rootCAs}
+	dialer := &net.Dialer{Timeout: time.Minute}
+	var c net.Conn
+	if startTLS {
+		c, err = dialer.Dial("tcp", server)
+	} else {
+		c, err = tls.DialWithDialer(dialer, "tcp", server, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c = idleConn{c}
+	ic := &conn{c: c, r: bufio.NewReader(c)}
+
+	greeting, err := ic.readResponse()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if greeting.status != "OK" {
+		c.Close()
+		return nil, fmt.Errorf("server greeting: %s %s", greeting.status, greeting.text)
+	}
+	if startTLS {
+		if err := ic.execute("STARTTLS", nil); err != nil {
+			c.Close()
+			return nil, err
+		}
+		// The TLS connection reads and writes through idleConn.
+		tc := tls.Client(c, config)
+		ic.c = tc
+		ic.r = bufio.NewReader(tc)
+	}
+	return ic, nil
+}
+
+func (c *conn) Close() error {
+	return c.c.Close()
+}
+
+// quote returns s as a quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// quotable returns whether s can be sent as a quoted string.
+func quotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// execute sends a command and calls untagged for each untagged response
+// until the command completes. untagged may be nil.
+func (c *conn) execute(command string, untagged func(*response) error) error {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	if _, err := fmt.Fprintf(c.c, "%s %s\r\n", tag, command); err != nil {
+		return err
+	}
+	name, _, _ := strings.Cut(command, " ")
+	var handlerErr error
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		switch resp.tag {
+		case tag:
+			if handlerErr != nil {
+				return handlerErr
+			}
+			if resp.status != "OK" {
+				return fmt.Errorf("%s: %s %s", name, resp.status, resp.text)
+			}
+			return nil
+		case "*":
+			// The server sends BYE before completing LOGOUT.
+			if resp.status == "BYE" && name != "LOGOUT" {
+				return fmt.Errorf("%s: server closed the connection: %s", name, resp.text)
+			}
+			if untagged != nil && handlerErr == nil {
+				handlerErr = untagged(resp)
+			}
+		default:
+			return fmt.Errorf("%s: unexpected response tag %q", name, resp.tag)
+		}
+	}
+}
+
+// readResponse reads one response, including any literals.
+func (c *conn) readResponse() (*response, error) {
+	tag, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	resp := &response{tag: tag}
+	if err := c.expect(' '); err != nil {
+		return nil, err
+	}
+	// The text of a status response is not parsed, since it is free-form.
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != '(' && first[0] != '"' && first[0] != '{' {
+		word, err := c.readAtom()
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(word) {
+		case "OK", "NO", "BAD", "BYE", "PREAUTH":
+			resp.status = strings.ToUpper(word)
+			line, err := c.r.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			resp.text = strings.TrimSpace(line)
+			return resp, nil
+		}
+		resp.fields = append(resp.fields, word)
+		if b, err := c.r.ReadByte(); err != nil {
+			return nil, err
+		} else if b == '\r' {
+			return resp, c.expect('\n')
+		} else if b != ' ' {
+			return nil, fmt.Errorf("unexpected %q in response", b)
+		}
+	}
+	resp.fields, err = c.readFields(resp.fields, '\r')
+	if err != nil {
+		return nil, err
+	}
+	return resp, c.expect('\n')
+}
+
+// readFields reads space separated fields until end, which is consumed.
+func (c *conn) readFields(fields []any, end byte) ([]any, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case end:
+			return fields, nil
+		case ' ':
+			continue
+		case '(':
+			list, err := c.readFields(nil, ')')
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, list)
+		case '"':
+			s, err := c.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, s)
+		case '{':
+			lit, err := c.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, lit)
+		case '\r', '\n', ')':
+			return nil, fmt.Errorf("unexpected %q in response", b)
+		default:
+			c.r.UnreadByte()
+			atom, err := c.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, atom)
+		}
+	}
+}
+
+// readAtom reads an atom. Brackets are part of atoms, so "BODY[]" is read as
+// one field.
+func (c *conn) readAtom() (string, error) {
+	b := &strings.Builder{}
+	for {
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case ' ', '(', ')', '"', '{', '\r', '\n':
+			c.r.UnreadByte()
+			if b.Len() == 0 {
+				return "", fmt.Errorf("unexpected %q in response", ch)
+			}
+			return b.String(), nil
+		}
+		b.WriteByte(ch)
+	}
+}
+
+func (c *conn) readQuoted() (string, error) {
+	b := &strings.Builder{}
+	for {
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch ch {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if ch, err = c.r.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", errors.New("unterminated quoted string in response")
+		}
+		b.WriteByte(ch)
+	}
+}
+
+// readLiteral reads a literal after the opening brace.
+func (c *conn) readLiteral() ([]byte, error) {
+	size, err := c.r.ReadString('}')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(size, "}"), 10, 64)
+	if err != nil || n < 0 || n > maxLiteral {
+		return nil, fmt.Errorf("invalid literal size {%s", size)
+	}
+	if err := c.expect('\r'); err != nil {
+		return nil, err
+	}
+	if err := c.expect('\n'); err != nil {
+		return nil, err
+	}
+	lit := make([]byte, n)
+	if _, err := io.ReadFull(c.r, lit); err != nil {
+		return nil, err
+	}
+	return lit, nil
+}
+
+func (c *conn) expect(want byte) error {
+	got, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("unexpected %q in response, want %q", got, want)
+	}
+	return nil
+}
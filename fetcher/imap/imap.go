@@ -0,0 +1,320 @@
+// Package imap fetches mailboxes from an IMAP server into Maildir directories.
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// IMAP downloads the messages in mailboxes into a Maildir per mailbox. Each
+// message's file name contains the mailbox's UIDVALIDITY and the message's
+// UID, so when the staging area is reused only new messages are downloaded.
+// Changes to the flags of downloaded messages are not updated.
+type IMAP struct {
+	// Server is host:port. The port defaults to 993.
+	Server string `json:"server"`
+	// StartTLS connects without TLS and upgrades the connection, which is
+	// usually on port 143. Otherwise the connection uses TLS from the
+	// start.
+	StartTLS bool   `json:"starttls,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Mailboxes defaults to INBOX. Other mailboxes are named as on the
+	// server, for example "Archive/2024" or "[Gmail]/Sent Mail".
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	// Dest is the directory in the staging area. Each mailbox is a Maildir
+	// inside it.
+	Dest string `json:"dest"`
+}
+
+// flagLetters maps IMAP flags to Maildir info letters, which must be in
+// ASCII order.
+var flagLetters = []struct {
+	flag   string
+	letter byte
+}{
+	{`\Draft`, 'D'},
+	{`\Flagged`, 'F'},
+	{`\Answered`, 'R'},
+	{`\Seen`, 'S'},
+	{`\Deleted`, 'T'},
+}
+
+func (m *IMAP) String() string {
+	return m.Username + "@" + m.server()
+}
+
+func (m *IMAP) Name() string {
+	return "IMAP"
+}
+
+func (m *IMAP) server() string {
+	if _, _, err := net.SplitHostPort(m.Server); err == nil {
+		return m.Server
+	}
+	if m.StartTLS {
+		return net.JoinHostPort(m.Server, "143")
+	}
+	return net.JoinHostPort(m.Server, "993")
+}
+
+func (m *IMAP) mailboxes() []string {
+	if len(m.Mailboxes) == 0 {
+		return []string{"INBOX"}
+	}
+	return m.Mailboxes
+}
+
+func (m *IMAP) Validate() error {
+	if m.Server == "" {
+		return errors.New("server is required")
+	}
+	if m.Username == "" {
+		return errors.New("username is required")
+	}
+	// Literals are not supported.
+	if !quotable(m.Username) || !quotable(m.Password) {
+		return errors.New("username and password must be printable ASCII")
+	}
+	for _, mailbox := range m.mailboxes() {
+		if !quotable(mailbox) {
+			return fmt.Errorf("mailbox %q must be printable ASCII, use the modified UTF-7 name from the server", mailbox)
+		}
+		if !filepath.IsLocal(mailbox) {
+			return fmt.Errorf("mailbox %q is not a valid directory name", mailbox)
+		}
+	}
+	if m.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", m.Dest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *IMAP) Destinations() []string {
+	return []string{m.Dest}
+}
+
+func (m *IMAP) Fetch(stagingDir string, rep *report.Source) error {
+	c, err := dial(m.server(), m.StartTLS)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.execute("LOGIN "+quote(m.Username)+" "+quote(m.Password), nil); err != nil {
+		return err
+	}
+	for _, mailbox := range m.mailboxes() {
+		dir := filepath.Join(stagingDir, m.Dest, filepath.FromSlash(mailbox))
+		if err := fetchMailbox(c, mailbox, dir, rep); err != nil {
+			return fmt.Errorf("mailbox %q: %v", mailbox, err)
+		}
+	}
+	return c.execute("LOGOUT", nil)
+}
+
+// fetchMailbox downloads the messages in mailbox which are not in the Maildir
+// dir.
+func fetchMailbox(c *conn, mailbox, dir string, rep *report.Source) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	// EXAMINE opens the mailbox read-only, so the messages stay unread.
+	var uidValidity uint32
+	exists := 0
+	err := c.execute("EXAMINE "+quote(mailbox), func(r *response) error {
+		if code, ok := strings.CutPrefix(r.text, "[UIDVALIDITY "); ok && r.status == "OK" {
+			code, _, _ = strings.Cut(code, "]")
+			n, err := strconv.ParseUint(code, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid UIDVALIDITY %q", code)
+			}
+			uidValidity = uint32(n)
+		}
+		if len(r.fields) == 2 && r.fields[1] == "EXISTS" {
+			exists, _ = strconv.Atoi(r.fields[0].(string))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if uidValidity == 0 {
+		return errors.New("server did not send UIDVALIDITY")
+	}
+
+	lastUID, others, err := scanMaildir(dir, uidValidity)
+	if err != nil {
+		return err
+	}
+	if lastUID == 0 && len(others) != 0 {
+		rep.Warnf("UIDVALIDITY of %q changed from %v to %d, downloading every message again", mailbox, others, uidValidity)
+	}
+	if exists == 0 {
+		return nil
+	}
+
+	// "n:*" always includes the last message, even if its UID is below n.
+	return c.execute(fmt.Sprintf("UID FETCH %d:* (UID FLAGS INTERNALDATE BODY.PEEK[])", lastUID+1), func(r *response) error {
+		if len(r.fields) != 3 || r.fields[1] != "FETCH" {
+			return nil
+		}
+		items, ok := r.fields[2].([]any)
+		if !ok {
+			return errors.New("invalid FETCH response")
+		}
+		msg, err := parseFetch(items)
+		if err != nil {
+			return err
+		}
+		if msg.uid <= lastUID {
+			return nil
+		}
+		if err := msg.write(dir, uidValidity); err != nil {
+			return err
+		}
+		rep.Count("messages", 1)
+		rep.Count("bytes", int64(len(msg.body)))
+		return nil
+	})
+}
+
+// scanMaildir returns the highest UID of the downloaded messages with
+// uidValidity, and the other UIDVALIDITY values in the Maildir.
+func scanMaildir(dir string, uidValidity uint32) (uint32, []uint32, error) {
+	lastUID := uint32(0)
+	others := map[uint32]bool{}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, e := range entries {
+			validity, uid, ok := parseFilename(e.Name())
+			switch {
+			case !ok:
+			case validity != uidValidity:
+				others[validity] = true
+			case uid > lastUID:
+				lastUID = uid
+			}
+		}
+	}
+	sorted := []uint32{}
+	for v := range others {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return lastUID, sorted, nil
+}
+
+// filename returns the Maildir file name of a message, for example
+// "3857529045.4827.imap:2,FS".
+func filename(uidValidity, uid uint32, flags []string) string {
+	info := []byte{}
+	for _, f := range flagLetters {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, f.flag) {
+				info = append(info, f.letter)
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("%d.%d.imap:2,%s", uidValidity, uid, info)
+}
+
+func parseFilename(name string) (uidValidity, uid uint32, ok bool) {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "imap") {
+		return 0, 0, false
+	}
+	v, err1 := strconv.ParseUint(parts[0], 10, 32)
+	u, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return uint32(v), uint32(u), true
+}
+
+// message is a downloaded message.
+type message struct {
+	uid          uint32
+	flags        []string
+	internalDate time.Time
+	body         []byte
+}
+
+// parseFetch parses the items of a FETCH response.
+func parseFetch(items []any) (*message, error) {
+	msg := &message{}
+	hasBody := false
+	for i := 0; i+1 < len(items); i += 2 {
+		name, _ := items[i].(string)
+		switch value := items[i+1]; strings.ToUpper(name) {
+		case "UID":
+			s, _ := value.(string)
+			uid, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UID %q", s)
+			}
+			msg.uid = uint32(uid)
+		case "FLAGS":
+			flags, _ := value.([]any)
+			for _, f := range flags {
+				if s, ok := f.(string); ok {
+					msg.flags = append(msg.flags, s)
+				}
+			}
+		case "INTERNALDATE":
+			s, _ := value.(string)
+			t, err := time.Parse("_2-Jan-2006 15:04:05 -0700", s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid INTERNALDATE %q", s)
+			}
+			msg.internalDate = t
+		case "BODY[]":
+			switch body := value.(type) {
+			case []byte:
+				msg.body = body
+			case string:
+				msg.body = []byte(body)
+			}
+			hasBody = true
+		}
+	}
+	if msg.uid == 0 || !hasBody {
+		return nil, errors.New("FETCH response without UID or body")
+	}
+	return msg, nil
+}
+
+// write delivers the message to the Maildir dir. The file's modification time
+// is the time the server received the message, which mail clients use.
+func (msg *message) write(dir string, uidValidity uint32) error {
+	name := filename(uidValidity, msg.uid, msg.flags)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg.body, 0600); err != nil {
+		return err
+	}
+	if !msg.internalDate.IsZero() {
+		if err := os.Chtimes(tmp, msg.internalDate, msg.internalDate); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, filepath.Join(dir, "cur", name))
+}
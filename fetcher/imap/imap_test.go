@@ -0,0 +1,387 @@
+package imap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+type fakeMessage struct {
+	uid   uint32
+	flags string
+	date  string
+	body  string
+}
+
+type fakeMailbox struct {
+	uidValidity uint32
+	messages    []fakeMessage
+}
+
+// fakeServer implements the commands used by the fetcher.
+type fakeServer struct {
+	t         *testing.T
+	ln        net.Listener
+	tls       *tls.Config
+	startTLS  bool
+	mu        sync.Mutex
+	mailboxes map[string]*fakeMailbox
+	commands  []string
+	// delay is the time before each message of a FETCH response.
+	delay time.Duration
+}
+
+// testTLSConfig returns the server config of a certificate for 127.0.0.1,
+// which the fetcher trusts during the test.
+func testTLSConfig(t *testing.T) *tls.Config {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	old := rootCAs
+	rootCAs = pool
+	t.Cleanup(func() { rootCAs = old })
+	return &tls.Config{Certificates: ts.TLS.Certificates}
+}
+
+func newFakeServer(t *testing.T, startTLS bool, mailboxes map[string]*fakeMailbox) *fakeServer {
+	s := &fakeServer{t: t, tls: testTLSConfig(t), startTLS: startTLS, mailboxes: mailboxes}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !startTLS {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	s.ln = ln
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+// parseArgs splits atoms and quoted strings.
+func parseArgs(s string) []string {
+	args := []string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			arg, rest, _ := strings.Cut(s, " ")
+			args = append(args, arg)
+			s = rest
+			continue
+		}
+		b := &strings.Builder{}
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+		args = append(args, b.String())
+		s = s[i+1:]
+	}
+	return args
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fmt.Fprint(c, "* OK IMAP4rev1 ready\r\n")
+	var selected *fakeMailbox
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+		args := parseArgs(command)
+
+		switch strings.ToUpper(args[0]) {
+		case "STARTTLS":
+			fmt.Fprintf(c, "%s OK Begin TLS negotiation now\r\n", tag)
+			tc := tls.Server(c, s.tls)
+			c, r = tc, bufio.NewReader(tc)
+		case "LOGIN":
+			if s.startTLS {
+				if _, ok := c.(*tls.Conn); !ok {
+					fmt.Fprintf(c, "%s NO [PRIVACYREQUIRED] Use STARTTLS\r\n", tag)
+					continue
+				}
+			}
+			if args[1] != "me@example.com" || args[2] != `pa"ss` {
+				fmt.Fprintf(c, "%s NO [AUTHENTICATIONFAILED] Invalid credentials\r\n", tag)
+				continue
+			}
+			fmt.Fprintf(c, "%s OK Logged in\r\n", tag)
+		case "EXAMINE":
+			s.mu.Lock()
+			selected = s.mailboxes[args[1]]
+			if selected == nil {
+				s.mu.Unlock()
+				fmt.Fprintf(c, "%s NO [NONEXISTENT] Mailbox doesn't exist\r\n", tag)
+				continue
+			}
+			fmt.Fprint(c, "* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n")
+			fmt.Fprintf(c, "* %d EXISTS\r\n", len(selected.messages))
+			fmt.Fprint(c, "* 0 RECENT\r\n")
+			fmt.Fprintf(c, "* OK [UIDVALIDITY %d] UIDs valid\r\n", selected.uidValidity)
+			s.mu.Unlock()
+			fmt.Fprintf(c, "%s OK [READ-ONLY] Examine completed\r\n", tag)
+		case "UID":
+			first, _ := strconv.ParseUint(strings.TrimSuffix(args[2], ":*"), 10, 32)
+			s.mu.Lock()
+			for i, m := range selected.messages {
+				// The last message is always included.
+				if m.uid >= uint32(first) || i == len(selected.messages)-1 {
+					time.Sleep(s.delay)
+					fmt.Fprintf(c, "* %d FETCH (UID %d FLAGS (%s) INTERNALDATE %q BODY[] {%d}\r\n%s)\r\n",
+						i+1, m.uid, m.flags, m.date, len(m.body), m.body)
+				}
+			}
+			s.mu.Unlock()
+			fmt.Fprintf(c, "%s OK Fetch completed\r\n", tag)
+		case "LOGOUT":
+			fmt.Fprintf(c, "* BYE Logging out\r\n%s OK Logout completed\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(c, "%s BAD Unknown command\r\n", tag)
+		}
+	}
+}
+
+func readMaildir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			data, err := os.ReadFile(filepath.Join(dir, sub, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[sub+"/"+e.Name()] = string(data)
+		}
+	}
+	return files
+}
+
+func TestFetch(t *testing.T) {
+	inbox := &fakeMailbox{uidValidity: 100, messages: []fakeMessage{
+		{1, `\Seen \Flagged`, "17-Jul-2024 02:44:25 -0700", "Subject: one\r\n\r\nHello\r\n"},
+		{3, ``, " 1-Aug-2024 10:00:00 +0000", "Subject: two\r\n\r\n{5}\r\n"},
+	}}
+	sent := &fakeMailbox{uidValidity: 7, messages: []fakeMessage{
+		{12, `\Seen \Answered \Draft`, "02-Jan-2024 03:04:05 +0000", "Subject: sent\r\n\r\n"},
+	}}
+	empty := &fakeMailbox{uidValidity: 1}
+	s := newFakeServer(t, false, map[string]*fakeMailbox{"INBOX": inbox, "[Gmail]/Sent Mail": sent, "Empty": empty})
+
+	m := &IMAP{
+		Server:    s.ln.Addr().String(),
+		Username:  "me@example.com",
+		Password:  `pa"ss`,
+		Mailboxes: []string{"INBOX", "[Gmail]/Sent Mail", "Empty"},
+		Dest:      "mail",
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := m.Fetch(stagingDir, rep.Source(m.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	inboxDir := filepath.Join(stagingDir, "mail", "INBOX")
+	want := map[string]string{
+		"cur/100.1.imap:2,FS": inbox.messages[0].body,
+		"cur/100.3.imap:2,":   inbox.messages[1].body,
+	}
+	if got := readMaildir(t, inboxDir); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("INBOX = %q; want %q", got, want)
+	}
+	fi, err := os.Stat(filepath.Join(inboxDir, "cur", "100.1.imap:2,FS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 7, 17, 9, 44, 25, 0, time.UTC); !fi.ModTime().Equal(want) {
+		t.Errorf("mtime = %v; want %v", fi.ModTime(), want)
+	}
+	want = map[string]string{"cur/7.12.imap:2,DRS": sent.messages[0].body}
+	if got := readMaildir(t, filepath.Join(stagingDir, "mail", "[Gmail]", "Sent Mail")); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Sent Mail = %q; want %q", got, want)
+	}
+	if got := readMaildir(t, filepath.Join(stagingDir, "mail", "Empty")); len(got) != 0 {
+		t.Errorf("Empty = %q", got)
+	}
+
+	// Only new messages are downloaded.
+	s.mu.Lock()
+	inbox.messages = append(inbox.messages, fakeMessage{4, `\Seen`, "02-Aug-2024 10:00:00 +0000", "Subject: three\r\n\r\n"})
+	s.commands = nil
+	s.mu.Unlock()
+	if err := m.Fetch(stagingDir, rep.Source(m.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMaildir(t, inboxDir); len(got) != 3 || got["cur/100.4.imap:2,S"] != "Subject: three\r\n\r\n" {
+		t.Errorf("INBOX = %q", got)
+	}
+	fetches := []string{}
+	for _, c := range s.commands {
+		if strings.HasPrefix(c, "UID FETCH") {
+			fetches = append(fetches, strings.Fields(c)[2])
+		}
+	}
+	if got, want := strings.Join(fetches, " "), "4:* 13:*"; got != want {
+		t.Errorf("fetched %q; want %q", got, want)
+	}
+	if got := rep.Counts[m.String()]["messages"]; got != 4 {
+		t.Errorf("counted %d messages; want 4", got)
+	}
+
+	// All messages are downloaded again if UIDVALIDITY changes.
+	s.mu.Lock()
+	inbox.uidValidity = 200
+	s.mu.Unlock()
+	rep = report.New()
+	if err := m.Fetch(stagingDir, rep.Source(m.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMaildir(t, inboxDir); len(got) != 6 || got["cur/200.1.imap:2,FS"] == "" {
+		t.Errorf("INBOX = %q", got)
+	}
+	if rep.Num(report.Warning) != 1 {
+		t.Errorf("%d warnings; want 1", rep.Num(report.Warning))
+	}
+}
+
+func TestFetchStartTLS(t *testing.T) {
+	s := newFakeServer(t, true, map[string]*fakeMailbox{"INBOX": {uidValidity: 1, messages: []fakeMessage{
+		{1, `\Seen`, "17-Jul-2024 02:44:25 -0700", "Subject: one\r\n\r\n"},
+	}}})
+	m := &IMAP{Server: s.ln.Addr().String(), StartTLS: true, Username: "me@example.com", Password: `pa"ss`, Dest: "mail"}
+	stagingDir := t.TempDir()
+	if err := m.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMaildir(t, filepath.Join(stagingDir, "mail", "INBOX")); len(got) != 1 {
+		t.Errorf("INBOX = %q", got)
+	}
+}
+
+func TestFetchSlowServer(t *testing.T) {
+	old := idleTimeout
+	idleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { idleTimeout = old })
+
+	messages := []fakeMessage{}
+	for uid := uint32(1); uid <= 5; uid++ {
+		messages = append(messages, fakeMessage{uid, `\Seen`, "17-Jul-2024 02:44:25 -0700", fmt.Sprintf("Subject: %d\r\n\r\n", uid)})
+	}
+	s := newFakeServer(t, false, map[string]*fakeMailbox{"INBOX": {uidValidity: 1, messages: messages}})
+	// The FETCH takes longer than the timeout, but the server is never idle
+	// for that long.
+	s.delay = 100 * time.Millisecond
+	m := &IMAP{Server: s.ln.Addr().String(), Username: "me@example.com", Password: `pa"ss`, Dest: "mail"}
+	stagingDir := t.TempDir()
+	if err := m.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMaildir(t, filepath.Join(stagingDir, "mail", "INBOX")); len(got) != 5 {
+		t.Errorf("INBOX = %q", got)
+	}
+
+	// A server which stops responding times out.
+	s.delay = time.Second
+	if err := m.Fetch(t.TempDir(), nil); err == nil {
+		t.Error("Fetch() succeeded; want timeout")
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	s := newFakeServer(t, false, map[string]*fakeMailbox{"INBOX": {uidValidity: 1}})
+	for _, m := range []*IMAP{
+		{Server: s.ln.Addr().String(), Username: "me@example.com", Password: "wrong", Dest: "mail"},
+		{Server: s.ln.Addr().String(), Username: "me@example.com", Password: `pa"ss`, Mailboxes: []string{"Missing"}, Dest: "mail"},
+	} {
+		if err := m.Fetch(t.TempDir(), nil); err == nil {
+			t.Errorf("Fetch() with %+v succeeded", m)
+		}
+	}
+}
+
+func TestFilename(t *testing.T) {
+	name := filename(3857529045, 4827, []string{`\Seen`, `\flagged`, `$Forwarded`})
+	if want := "3857529045.4827.imap:2,FS"; name != want {
+		t.Errorf("filename() = %q; want %q", name, want)
+	}
+	if v, uid, ok := parseFilename(name); v != 3857529045 || uid != 4827 || !ok {
+		t.Errorf("parseFilename(%q) = %d, %d, %v", name, v, uid, ok)
+	}
+	for _, name := range []string{"1700000000.M1P2.host:2,S", "a.1.imap:2,", "1.2"} {
+		if _, _, ok := parseFilename(name); ok {
+			t.Errorf("parseFilename(%q) succeeded", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		m  IMAP
+		ok bool
+	}{
+		{IMAP{Server: "imap.example.com", Username: "me", Password: "pw", Dest: "mail"}, true},
+		{IMAP{Server: "imap.example.com:143", StartTLS: true, Username: "me", Mailboxes: []string{"INBOX", "Archive/2024"}, Dest: "mail"}, true},
+		{IMAP{Username: "me", Dest: "mail"}, false},
+		{IMAP{Server: "imap.example.com", Dest: "mail"}, false},
+		{IMAP{Server: "imap.example.com", Username: "me", Password: "pässword", Dest: "mail"}, false},
+		{IMAP{Server: "imap.example.com", Username: "me", Mailboxes: []string{"../x"}, Dest: "mail"}, false},
+		{IMAP{Server: "imap.example.com", Username: "me", Dest: "/mail"}, false},
+	} {
+		if err := tt.m.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v; want ok=%v", tt.m, err, tt.ok)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	for _, tt := range []struct {
+		m    IMAP
+		want string
+	}{
+		{IMAP{Server: "imap.example.com"}, "imap.example.com:993"},
+		{IMAP{Server: "imap.example.com", StartTLS: true}, "imap.example.com:143"},
+		{IMAP{Server: "imap.example.com:1993"}, "imap.example.com:1993"},
+	} {
+		if got := tt.m.server(); got != tt.want {
+			t.Errorf("server() = %q; want %q", got, tt.want)
+		}
+	}
+}
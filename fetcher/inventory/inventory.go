@@ -0,0 +1,142 @@
+// Package inventory records the installed packages and the system
+// configuration, which are needed to rebuild a machine.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// commandTimeout is the time allowed for each command of a source.
+const commandTimeout = 5 * time.Minute
+
+// Inventory writes a JSON file describing the machine. Each source of the
+// inventory is recorded if its commands are installed, and skipped
+// otherwise.
+type Inventory struct {
+	// Sources limits the inventory to these sources, for example
+	// ["dpkg", "systemd"]. Every source is recorded by default.
+	Sources []string `json:"sources,omitempty"`
+	// Output is the file in the staging area. It defaults to
+	// <hostname>/inventory.json.
+	Output string `json:"output,omitempty"`
+}
+
+// inventory is the content of the output file.
+type inventory struct {
+	Hostname string    `json:"hostname"`
+	OS       string    `json:"os"`
+	Arch     string    `json:"arch"`
+	Time     time.Time `json:"time"`
+	// Sources maps the name of each recorded source to its data.
+	Sources map[string]any `json:"sources"`
+	// Skipped maps the name of each skipped source to the reason.
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+func (i *Inventory) String() string {
+	return "inventory " + i.output()
+}
+
+func (i *Inventory) Name() string {
+	return "Inventory"
+}
+
+func (i *Inventory) output() string {
+	if i.Output != "" {
+		return i.Output
+	}
+	return fetcher.HostDir("inventory.json")
+}
+
+func (i *Inventory) Validate() error {
+	for _, name := range i.Sources {
+		if !slices.ContainsFunc(sources, func(s source) bool { return s.name == name }) {
+			return fmt.Errorf("unknown source %q", name)
+		}
+	}
+	return fetcher.ValidateDest("output", i.output())
+}
+
+func (i *Inventory) Destinations() []string {
+	return []string{i.output()}
+}
+
+// run runs a command and returns its stdout.
+func run(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return out, fmt.Errorf("%s: %v: %s", name, err, msg)
+		}
+		return out, fmt.Errorf("%s: %v", name, err)
+	}
+	return out, nil
+}
+
+func (i *Inventory) Fetch(stagingDir string, rep *report.Source) error {
+	inv := &inventory{
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Time:    time.Now().UTC(),
+		Sources: map[string]any{},
+		Skipped: map[string]string{},
+	}
+	inv.Hostname, _ = os.Hostname()
+
+	for _, s := range sources {
+		if len(i.Sources) != 0 && !slices.Contains(i.Sources, s.name) {
+			continue
+		}
+		if missing := s.missing(); missing != "" {
+			rep.Infof("skipping %s: %s is not installed", s.name, missing)
+			inv.Skipped[s.name] = missing + " is not installed"
+			continue
+		}
+		data, err := s.collect()
+		if err != nil {
+			rep.Warnf("skipping %s: %v", s.name, err)
+			inv.Skipped[s.name] = err.Error()
+			continue
+		}
+		inv.Sources[s.name] = data
+		if v := reflect.ValueOf(data); v.Kind() == reflect.Slice {
+			rep.Count(s.name, int64(v.Len()))
+		}
+	}
+
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(stagingDir, i.output())
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	if len(inv.Sources) == 0 && len(inv.Skipped) != 0 {
+		// The file is still written, so the reasons are kept.
+		err = errors.New("no source of the inventory is installed")
+	}
+	if writeErr := os.WriteFile(dest, append(data, '\n'), 0600); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package inventory
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// fakeCommands replaces PATH with a directory of shell scripts, so every
+// other command is missing. The scripts may only use shell builtins.
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		i    Inventory
+		ok   bool
+	}{
+		{"defaults", Inventory{}, true},
+		{"sources", Inventory{Sources: []string{"dpkg", "systemd"}, Output: "host/inventory.json"}, true},
+		{"unknown source", Inventory{Sources: []string{"apk"}}, false},
+		{"output outside", Inventory{Output: "../inventory.json"}, false},
+		{"absolute output", Inventory{Output: "/inventory.json"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.i.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v; want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	etc := t.TempDir()
+	unchanged := filepath.Join(etc, "unchanged.conf")
+	modified := filepath.Join(etc, "modified.conf")
+	missing := filepath.Join(etc, "missing.conf")
+	if err := os.WriteFile(unchanged, []byte("a=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(modified, []byte("b=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("a=1\n"))
+	unchangedSum := hex.EncodeToString(sum[:])
+
+	fakeCommands(t, map[string]string{
+		"dpkg-query": fmt.Sprintf(`case "$*" in
+*binary:Package*)
+	printf 'zsh\t5.9-4\tamd64\tii \n'
+	printf 'bash\t5.2-1\tamd64\tii \n'
+	printf 'old\t1.0\tamd64\trc \n'
+	printf 'libc6:amd64\t2.36-9\tamd64\tii \n';;
+*)
+	echo 'bash	'
+	echo 'app	'
+	echo ' %s %s'
+	echo ' %s 00000000000000000000000000000000'
+	echo ' %s 00000000000000000000000000000000'
+	echo ' /etc/gone.conf 00000000000000000000000000000000 obsolete';;
+esac
+`, unchanged, unchangedSum, modified, missing),
+		"apt-mark":  `printf 'zsh\nlibc6\n'`,
+		"systemctl": `printf 'ssh.service enabled enabled\ncron.service enabled enabled\n'`,
+		"pip3":      `echo '[{"name": "requests", "version": "2.31.0"}]'`,
+		"npm":       `echo "npm ERR! failed" >&2; exit 1`,
+	})
+
+	r := report.New()
+	i := &Inventory{Output: "host/inventory.json"}
+	stagingDir := t.TempDir()
+	if err := i.Fetch(stagingDir, r.Source("inventory")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(stagingDir, "host", "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := struct {
+		Sources struct {
+			Dpkg          []pkg        `json:"dpkg"`
+			Pip           []pkg        `json:"pip"`
+			Systemd       []string     `json:"systemd"`
+			DpkgConffiles []configFile `json:"dpkg_conffiles"`
+		} `json:"sources"`
+		Skipped map[string]string `json:"skipped"`
+	}{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "[{bash 5.2-1 amd64 false} {libc6:amd64 2.36-9 amd64 true} {zsh 5.9-4 amd64 true}]"; fmt.Sprint(got.Sources.Dpkg) != want {
+		t.Errorf("dpkg = %v; want %v", got.Sources.Dpkg, want)
+	}
+	if want := "[{requests 2.31.0  false}]"; fmt.Sprint(got.Sources.Pip) != want {
+		t.Errorf("pip = %v; want %v", got.Sources.Pip, want)
+	}
+	if want := "[cron.service ssh.service]"; fmt.Sprint(got.Sources.Systemd) != want {
+		t.Errorf("systemd = %v; want %v", got.Sources.Systemd, want)
+	}
+	want := fmt.Sprint([]configFile{
+		{Path: missing, Package: "app", Status: "missing"},
+		// The hash of "b=2\n".
+		{Path: modified, Package: "app", Status: "modified", SHA256: "9bc63f3e495030aa3f5f79539e766bf76251cf19dde377a844e5f4f5d1a14bb8"},
+	})
+	if fmt.Sprint(got.Sources.DpkgConffiles) != want {
+		t.Errorf("dpkg_conffiles = %v; want %v", got.Sources.DpkgConffiles, want)
+	}
+
+	for _, name := range []string{"rpm", "homebrew", "go", "rpm_configfiles"} {
+		if got.Skipped[name] == "" {
+			t.Errorf("%s was not skipped", name)
+		}
+	}
+	if want := "npm: exit status 1: npm ERR! failed"; got.Skipped["npm"] != want {
+		t.Errorf("skipped npm = %q; want %q", got.Skipped["npm"], want)
+	}
+	if n := r.Num(report.Warning); n != 1 {
+		t.Errorf("warnings = %d; want 1", n)
+	}
+	if n := r.Counts["inventory"]["dpkg"]; n != 3 {
+		t.Errorf("dpkg count = %d; want 3", n)
+	}
+}
+
+func TestFetchNothingInstalled(t *testing.T) {
+	fakeCommands(t, nil)
+	i := &Inventory{Sources: []string{"rpm"}, Output: "inventory.json"}
+	stagingDir := t.TempDir()
+	if err := i.Fetch(stagingDir, nil); err == nil {
+		t.Error("Fetch() succeeded; want error")
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "inventory.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseGoVersion(t *testing.T) {
+	out := "/home/me/go/bin/gopls: go1.22.1\n" +
+		"\tpath\tgolang.org/x/tools/gopls\n" +
+		"\tmod\tgolang.org/x/tools/gopls\tv0.15.2\th1:abc=\n" +
+		"\tdep\tgolang.org/x/mod\tv0.16.0\th1:def=\n" +
+		"/home/me/go/bin/staticcheck: go1.21.0\n" +
+		"\tpath\thonnef.co/go/tools/cmd/staticcheck\n" +
+		"\tmod\thonnef.co/go/tools\tv0.4.6\th1:ghi=\n"
+	got := fmt.Sprint(parseGoVersion([]byte(out)))
+	want := "[{gopls golang.org/x/tools/gopls v0.15.2 go1.22.1} {staticcheck honnef.co/go/tools/cmd/staticcheck v0.4.6 go1.21.0}]"
+	if got != want {
+		t.Errorf("parseGoVersion() = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,347 @@
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// source is one part of the inventory.
+type source struct {
+	// name is the key in the inventory.
+	name string
+	// commands must be installed, otherwise the source is skipped.
+	commands []string
+	collect  func() (any, error)
+}
+
+// sources are recorded in this order.
+var sources = []source{
+	{"dpkg", []string{"dpkg-query"}, dpkgPackages},
+	{"rpm", []string{"rpm"}, rpmPackages},
+	{"homebrew", []string{"brew"}, brewPackages},
+	{"go", []string{"go"}, goTools},
+	{"pip", []string{"pip3"}, pipPackages},
+	{"npm", []string{"npm"}, npmPackages},
+	{"systemd", []string{"systemctl"}, systemdUnits},
+	{"dpkg_conffiles", []string{"dpkg-query"}, dpkgConffiles},
+	{"rpm_configfiles", []string{"rpm"}, rpmConfigFiles},
+}
+
+// missing returns the first command of the source which is not installed.
+func (s *source) missing() string {
+	for _, c := range s.commands {
+		if _, err := exec.LookPath(c); err != nil {
+			return c
+		}
+	}
+	return ""
+}
+
+// pkg is an installed package.
+type pkg struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+	// Manual is set if the package was installed explicitly, rather than
+	// as a dependency.
+	Manual bool `json:"manual,omitempty"`
+}
+
+func sortPackages(pkgs []pkg) []pkg {
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Name < pkgs[j].Name })
+	return pkgs
+}
+
+// lines returns the non-empty lines of out.
+func lines(out []byte) []string {
+	lines := []string{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if line := strings.TrimRight(s.Text(), "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func dpkgPackages() (any, error) {
+	out, err := run("dpkg-query", "-W", "-f=${binary:Package}\t${Version}\t${Architecture}\t${db:Status-Abbrev}\n")
+	if err != nil {
+		return nil, err
+	}
+	manual := map[string]bool{}
+	if _, err := exec.LookPath("apt-mark"); err == nil {
+		out, err := run("apt-mark", "showmanual")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range lines(out) {
+			manual[name] = true
+		}
+	}
+	pkgs := []pkg{}
+	for _, line := range lines(out) {
+		fields := strings.Split(line, "\t")
+		// Only installed packages, not removed packages with config files.
+		if len(fields) != 4 || !strings.HasPrefix(fields[3], "ii") {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], ":")
+		pkgs = append(pkgs, pkg{Name: fields[0], Version: fields[1], Arch: fields[2], Manual: manual[name] || manual[fields[0]]})
+	}
+	return sortPackages(pkgs), nil
+}
+
+func rpmPackages() (any, error) {
+	out, err := run("rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\n")
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []pkg{}
+	for _, line := range lines(out) {
+		if fields := strings.Split(line, "\t"); len(fields) == 3 {
+			pkgs = append(pkgs, pkg{Name: fields[0], Version: fields[1], Arch: fields[2]})
+		}
+	}
+	return sortPackages(pkgs), nil
+}
+
+// brewList parses the output of `brew list --versions`, which is a package
+// and its installed versions on each line.
+func brewList(out []byte, manual map[string]bool) []pkg {
+	pkgs := []pkg{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		pkgs = append(pkgs, pkg{Name: fields[0], Version: strings.Join(fields[1:], " "), Manual: manual[fields[0]]})
+	}
+	return sortPackages(pkgs)
+}
+
+func brewPackages() (any, error) {
+	formulae, err := run("brew", "list", "--formula", "--versions")
+	if err != nil {
+		return nil, err
+	}
+	casks, err := run("brew", "list", "--cask", "--versions")
+	if err != nil {
+		return nil, err
+	}
+	// Leaves are the formulae which are not dependencies of others.
+	leaves, err := run("brew", "leaves", "--installed-on-request")
+	if err != nil {
+		return nil, err
+	}
+	taps, err := run("brew", "tap")
+	if err != nil {
+		return nil, err
+	}
+	manual := map[string]bool{}
+	for _, name := range lines(leaves) {
+		manual[name] = true
+	}
+	return map[string]any{
+		"formulae": brewList(formulae, manual),
+		"casks":    brewList(casks, nil),
+		"taps":     lines(taps),
+	}, nil
+}
+
+// goTool is a program installed with `go install`.
+type goTool struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+}
+
+// parseGoVersion parses the output of `go version -m`.
+func parseGoVersion(out []byte) []goTool {
+	tools := []goTool{}
+	for _, line := range lines(out) {
+		if !strings.HasPrefix(line, "\t") {
+			file, goVersion, ok := strings.Cut(line, ": ")
+			if ok {
+				tools = append(tools, goTool{Name: filepath.Base(file), GoVersion: goVersion})
+			}
+			continue
+		}
+		if len(tools) == 0 {
+			continue
+		}
+		t := &tools[len(tools)-1]
+		switch fields := strings.Fields(line); {
+		case len(fields) >= 2 && fields[0] == "path":
+			t.Path = fields[1]
+		case len(fields) >= 3 && fields[0] == "mod":
+			t.Version = fields[2]
+		}
+	}
+	return tools
+}
+
+func goTools() (any, error) {
+	out, err := run("go", "env", "GOBIN", "GOPATH")
+	if err != nil {
+		return nil, err
+	}
+	env := strings.Split(string(out), "\n")
+	if len(env) < 2 {
+		return nil, errors.New("unexpected output of go env")
+	}
+	bin := strings.TrimSpace(env[0])
+	if bin == "" {
+		gopath := filepath.SplitList(strings.TrimSpace(env[1]))
+		if len(gopath) == 0 {
+			return nil, errors.New("GOPATH is not set")
+		}
+		bin = filepath.Join(gopath[0], "bin")
+	}
+	if _, err := os.Stat(bin); errors.Is(err, fs.ErrNotExist) {
+		return []goTool{}, nil
+	}
+	out, err = run("go", "version", "-m", bin)
+	if err != nil {
+		return nil, err
+	}
+	return parseGoVersion(out), nil
+}
+
+func pipPackages() (any, error) {
+	out, err := run("pip3", "list", "--format=json", "--disable-pip-version-check")
+	if err != nil {
+		return nil, err
+	}
+	pkgs := []pkg{}
+	if err := json.Unmarshal(out, &pkgs); err != nil {
+		return nil, err
+	}
+	return sortPackages(pkgs), nil
+}
+
+func npmPackages() (any, error) {
+	out, err := run("npm", "ls", "--global", "--depth=0", "--json")
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		Dependencies map[string]struct {
+			Version string `json:"version"`
+		} `json:"dependencies"`
+	}{}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+	pkgs := []pkg{}
+	for name, dep := range list.Dependencies {
+		pkgs = append(pkgs, pkg{Name: name, Version: dep.Version})
+	}
+	return sortPackages(pkgs), nil
+}
+
+func systemdUnits() (any, error) {
+	out, err := run("systemctl", "list-unit-files", "--state=enabled", "--no-legend", "--no-pager", "--plain")
+	if err != nil {
+		return nil, err
+	}
+	units := []string{}
+	for _, line := range lines(out) {
+		units = append(units, strings.Fields(line)[0])
+	}
+	sort.Strings(units)
+	return units, nil
+}
+
+// configFile is a configuration file of a package which differs from the
+// package's version. Its content is not recorded, since configuration files
+// may hold credentials.
+type configFile struct {
+	Path    string `json:"path"`
+	Package string `json:"package,omitempty"`
+	// Status is "modified", "missing" or "unreadable".
+	Status string `json:"status"`
+	// SHA256 is the hash of the modified file, if it is readable.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func modifiedConfigFile(path, pkg string, data []byte) configFile {
+	sum := sha256.Sum256(data)
+	return configFile{Path: path, Package: pkg, Status: "modified", SHA256: hex.EncodeToString(sum[:])}
+}
+
+func dpkgConffiles() (any, error) {
+	out, err := run("dpkg-query", "-W", "-f=${Package}\t${Conffiles}\n")
+	if err != nil {
+		return nil, err
+	}
+	files := []configFile{}
+	pkgName := ""
+	for _, line := range lines(out) {
+		if !strings.HasPrefix(line, " ") {
+			var rest string
+			pkgName, rest, _ = strings.Cut(line, "\t")
+			if line = rest; strings.TrimSpace(line) == "" {
+				continue
+			}
+		}
+		// For example " /etc/ssh/sshd_config 8d3d8a6b0a4e4c7a1f9c0b6d5e4f3a2b".
+		// Obsolete conffiles have a third field.
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 2 && fields[2] == "obsolete" {
+			continue
+		}
+		data, err := os.ReadFile(fields[0])
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			files = append(files, configFile{Path: fields[0], Package: pkgName, Status: "missing"})
+		case err != nil:
+			files = append(files, configFile{Path: fields[0], Package: pkgName, Status: "unreadable"})
+		default:
+			if sum := md5.Sum(data); hex.EncodeToString(sum[:]) != fields[1] {
+				files = append(files, modifiedConfigFile(fields[0], pkgName, data))
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+func rpmConfigFiles() (any, error) {
+	// rpm fails if any file differs, so the output is parsed anyway.
+	out, err := run("rpm", "-Va", "--nodeps", "--noscripts", "--nomtime")
+	if exitErr := (*exec.ExitError)(nil); err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	files := []configFile{}
+	for _, line := range lines(out) {
+		// For example "S.5......  c /etc/ssh/sshd_config" or
+		// "missing   c /etc/foo.conf".
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "c" {
+			continue
+		}
+		switch {
+		case fields[0] == "missing":
+			files = append(files, configFile{Path: fields[2], Status: "missing"})
+		case strings.Contains(fields[0], "5"):
+			data, err := os.ReadFile(fields[2])
+			if err != nil {
+				files = append(files, configFile{Path: fields[2], Status: "unreadable"})
+				continue
+			}
+			files = append(files, modifiedConfigFile(fields[2], "", data))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
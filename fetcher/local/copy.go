@@ -0,0 +1,278 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// copier copies a directory tree the same as
+// "rsync --archive --copy-unsafe-links" for hosts without rsync. Permissions,
+// modification times, symlinks and extended attributes are kept. Ownership is
+// only kept when running as root.
+//
+// Errors for individual files do not stop the copy. They are collected in
+// errs.
+type copier struct {
+	filter
+	maxFileSize   int64
+	oneFileSystem bool
+
+	errs  []error
+	files int64
+	bytes int64
+
+	// active is the set of directories being copied, used to detect loops
+	// through symlinks.
+	active map[fileID]bool
+}
+
+type fileID struct {
+	dev, ino uint64
+}
+
+func statID(fi fs.FileInfo) fileID {
+	st := fi.Sys().(*syscall.Stat_t)
+	return fileID{uint64(st.Dev), uint64(st.Ino)}
+}
+
+func (c *copier) fail(err error) {
+	c.errs = append(c.errs, err)
+}
+
+// copyTree copies the directory src to dest. Like rsync, src is followed if
+// it is a symlink.
+func (c *copier) copyTree(src, dest string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+	c.active = map[fileID]bool{}
+	c.copyDir(src, dest, ".", fi, statID(fi).dev)
+	return nil
+}
+
+// copyDir copies the directory src to dest. rel is the slash-separated path
+// of src relative to the root of the tree.
+func (c *copier) copyDir(src, dest, rel string, fi fs.FileInfo, dev uint64) {
+	id := statID(fi)
+	if c.active[id] {
+		c.fail(fmt.Errorf("%s: directory loop", src))
+		return
+	}
+	c.active[id] = true
+	defer delete(c.active, id)
+
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		c.fail(err)
+		return
+	}
+	// Attributes are set last so copying the contents does not change the
+	// modification time.
+	defer c.setAttrs(src, dest, fi)
+
+	// Like rsync, the directory of a different file system is created,
+	// but not its contents.
+	if c.oneFileSystem && id.dev != dev {
+		return
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	for _, e := range entries {
+		c.copyEntry(filepath.Join(src, e.Name()), filepath.Join(dest, e.Name()), path.Join(rel, e.Name()), dev)
+	}
+}
+
+func (c *copier) copyEntry(src, dest, rel string, dev uint64) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if isSafeLink(rel, target) {
+			if !c.excluded(rel, false) {
+				c.copySymlink(src, dest, target, fi)
+			}
+			return
+		}
+
+		// Unsafe links are replaced by their referent.
+		if src, err = filepath.EvalSymlinks(src); err != nil {
+			c.fail(err)
+			return
+		}
+		if fi, err = os.Lstat(src); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+
+	if c.excluded(rel, fi.IsDir()) {
+		return
+	}
+	switch {
+	case fi.IsDir():
+		c.copyDir(src, dest, rel, fi, dev)
+	case fi.Mode().IsRegular():
+		if c.maxFileSize > 0 && fi.Size() > c.maxFileSize {
+			return
+		}
+		c.copyFile(src, dest, fi)
+	default:
+		// Like rsync without root, devices, sockets and pipes are
+		// skipped.
+	}
+}
+
+// isSafeLink returns true if the symlink at rel points inside the tree.
+func isSafeLink(rel, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	resolved := path.Join(path.Dir(rel), filepath.ToSlash(target))
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+func (c *copier) copyFile(src, dest string, fi fs.FileInfo) {
+	r, err := os.Open(src)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	defer r.Close()
+
+	// Remove any existing file, which may be read-only.
+	os.Remove(dest)
+	w, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		c.fail(fmt.Errorf("%s: %v", src, err))
+		return
+	}
+	if err := w.Close(); err != nil {
+		c.fail(err)
+		return
+	}
+	c.files++
+	c.bytes += n
+	c.setAttrs(src, dest, fi)
+}
+
+func (c *copier) copySymlink(src, dest, target string, fi fs.FileInfo) {
+	os.Remove(dest)
+	if err := os.Symlink(target, dest); err != nil {
+		c.fail(err)
+		return
+	}
+	if os.Geteuid() == 0 {
+		st := fi.Sys().(*syscall.Stat_t)
+		if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+			c.fail(err)
+		}
+	}
+	mtime := unix.NsecToTimeval(fi.ModTime().UnixNano())
+	if err := unix.Lutimes(dest, []unix.Timeval{mtime, mtime}); err != nil {
+		c.fail(&fs.PathError{Op: "lutimes", Path: dest, Err: err})
+	}
+	if err := copyXattrs(src, dest); err != nil {
+		c.fail(err)
+	}
+	c.files++
+}
+
+// setAttrs copies the permissions, ownership, modification time and extended
+// attributes.
+func (c *copier) setAttrs(src, dest string, fi fs.FileInfo) {
+	if os.Geteuid() == 0 {
+		st := fi.Sys().(*syscall.Stat_t)
+		if err := os.Lchown(dest, int(st.Uid), int(st.Gid)); err != nil {
+			c.fail(err)
+		}
+	}
+	if err := copyXattrs(src, dest); err != nil {
+		c.fail(err)
+	}
+	// Chmod after chown because chown clears the setuid bit.
+	mode := fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := os.Chmod(dest, mode); err != nil {
+		c.fail(err)
+	}
+	if err := os.Chtimes(dest, time.Time{}, fi.ModTime()); err != nil {
+		c.fail(err)
+	}
+}
+
+// copyXattrs copies the extended attributes without following symlinks.
+// Attributes which are not supported by the destination, or which require
+// privileges, are skipped.
+func copyXattrs(src, dest string) error {
+	skip := func(err error) bool {
+		return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM)
+	}
+
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil {
+		if skip(err) {
+			return nil
+		}
+		return &fs.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return &fs.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		n, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return &fs.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(src, name, value); err != nil {
+			return &fs.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+		if err := unix.Lsetxattr(dest, name, value[:n], 0); err != nil && !skip(err) {
+			return &fs.PathError{Op: "setxattr", Path: dest, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package local
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// filter decides which files are copied. The patterns follow rsync's rules
+// for the simple cases:
+//
+//   - A pattern without a "/" is matched against the file's name.
+//   - A pattern starting with "/" is matched against the path relative to Dir.
+//   - Any other pattern is matched against the end of the path.
+//   - A pattern ending in "/" only matches directories.
+//
+// The syntax of each pattern is the same as filepath.Match. An include
+// pattern takes precedence over an exclude pattern. The contents of an
+// excluded directory are never copied.
+type filter struct {
+	include []string
+	exclude []string
+}
+
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(strings.Trim(p, "/"), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excluded returns true if the file at rel, a slash-separated path relative
+// to Dir, should not be copied.
+func (f *filter) excluded(rel string, isDir bool) bool {
+	for _, p := range f.include {
+		if match(p, rel, isDir) {
+			return false
+		}
+	}
+	for _, p := range f.exclude {
+		if match(p, rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, rel string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	name := rel
+	if anchored, ok := strings.CutPrefix(pattern, "/"); ok {
+		pattern = anchored
+	} else {
+		// Match the same number of trailing path elements as the
+		// pattern has.
+		n := strings.Count(pattern, "/") + 1
+		elems := strings.Split(rel, "/")
+		if len(elems) < n {
+			return false
+		}
+		name = strings.Join(elems[len(elems)-n:], "/")
+	}
+	ok, _ := filepath.Match(pattern, name)
+	return ok
+}
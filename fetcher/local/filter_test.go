@@ -0,0 +1,40 @@
+package local
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	f := &filter{
+		include: []string{"keep.log"},
+		exclude: []string{"*.log", ".DS_Store", "/build", "node_modules/", "a/cache"},
+	}
+	for _, tt := range []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"out.log", false, true},
+		{"sub/out.log", false, true},
+		{"sub/keep.log", false, false},
+		{"sub/.DS_Store", false, true},
+		{"build", true, true},
+		{"sub/build", true, false},
+		{"web/node_modules", true, true},
+		{"web/node_modules", false, false},
+		{"x/a/cache", true, true},
+		{"cache", true, false},
+	} {
+		if got := f.excluded(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("excluded(%q, %v) = %v; want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if err := validatePatterns([]string{"*.go", "/a/[bc]/"}); err != nil {
+		t.Errorf("validatePatterns() = %v", err)
+	}
+	if err := validatePatterns([]string{"[a"}); err == nil {
+		t.Error("validatePatterns() with bad pattern succeeded")
+	}
+}
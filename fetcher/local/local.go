@@ -1,13 +1,41 @@
 package local
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
 )
 
 type Local struct {
 	Dir string `json:"dir"`
+	// Dest is the directory in the staging area. It defaults to the
+	// hostname followed by the absolute path of Dir, for example
+	// "laptop/Users/me/notes".
+	Dest string `json:"dest,omitempty"`
+	// Exclude and Include are patterns of files to skip. See filter for
+	// the syntax. Include takes precedence over Exclude.
+	Exclude []string `json:"exclude,omitempty"`
+	Include []string `json:"include,omitempty"`
+	// MaxFileSize skips files larger than this number of bytes. Zero means
+	// no limit.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// OneFileSystem does not copy the contents of other mounted file
+	// systems.
+	OneFileSystem bool `json:"one_file_system,omitempty"`
+	// Backend is either "rsync" (the default) or "go" for hosts without
+	// rsync.
+	Backend string `json:"backend,omitempty"`
+	// PartialTransfer decides whether files which could not be copied fail
+	// the fetch. It is one of "error", "warn_vanished" (the default) or
+	// "warning". The files are always listed in the report.
+	PartialTransfer string `json:"partial_transfer,omitempty"`
 }
 
 func (l *Local) String() string {
@@ -22,11 +50,73 @@ func (l *Local) Validate() error {
 	if l.Dir == "" {
 		return errors.New("dir is required")
 	}
+	if l.Dest != "" {
+		if err := fetcher.ValidateDest("dest", l.Dest); err != nil {
+			return err
+		}
+	}
+	if err := validatePatterns(l.Exclude); err != nil {
+		return fmt.Errorf("invalid exclude pattern: %v", err)
+	}
+	if err := validatePatterns(l.Include); err != nil {
+		return fmt.Errorf("invalid include pattern: %v", err)
+	}
+	if l.MaxFileSize < 0 {
+		return errors.New("max_file_size must not be negative")
+	}
+	switch l.Backend {
+	case "", "rsync", "go":
+	default:
+		return fmt.Errorf("backend must be rsync or go, got %q", l.Backend)
+	}
+	switch l.PartialTransfer {
+	case "", PartialError, PartialWarnVanished, PartialWarning:
+	default:
+		return fmt.Errorf("partial_transfer must be %s, %s or %s, got %q", PartialError, PartialWarnVanished, PartialWarning, l.PartialTransfer)
+	}
 	return nil
 }
 
-func (l *Local) Fetch(stagingDir string) error {
-	return exec.Command("rsync",
+func (l *Local) Deps() map[string][]string {
+	if l.Backend == "go" {
+		return nil
+	}
+	return map[string][]string{"rsync": {"rsync", "--version"}}
+}
+
+func (l *Local) Destinations() []string {
+	return []string{l.dest()}
+}
+
+// dest returns the directory in the staging area relative to the staging
+// directory.
+func (l *Local) dest() string {
+	if l.Dest != "" {
+		return l.Dest
+	}
+	dir, err := filepath.Abs(l.Dir)
+	if err != nil {
+		dir = l.Dir
+	}
+	return fetcher.HostDir(dir)
+}
+
+func (l *Local) Fetch(stagingDir string, rep *report.Source) error {
+	// rsync only creates the last directory of the destination.
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(stagingDir, l.dest())), 0700); err != nil {
+		return err
+	}
+	if l.Backend == "go" {
+		return l.fetchGo(stagingDir, rep)
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("rsync", l.rsyncArgs(stagingDir)...)
+	cmd.Stderr = stderr
+	return rsyncResult(cmd.Run(), stderr.String(), l.PartialTransfer, rep)
+}
+
+func (l *Local) rsyncArgs(stagingDir string) []string {
+	args := []string{
 		// Archive mode, preserving file permissions, dates, etc..
 		"--archive",
 		// "This tells rsync to copy the referent of symbolic links that point
@@ -34,11 +124,44 @@ func (l *Local) Fetch(stagingDir string) error {
 		// ordinary files, and so are any symlinks in the source path itself
 		// when --relative is used." ~ man rsync
 		"--copy-unsafe-links",
-		// "A trailing slash on the source changes this behavior to avoid
-		// creating an additional directory level at the destination. You can
-		// think of a trailing / on a source as meaning 'copy the contents of
-		// this directory' as opposed to 'copy the directory by name', but in
-		// both cases the attributes of the containing directory are
-		// transferred to the containing directory on the destination." ~ man rsync
-		strings.TrimSuffix(l.Dir, "/"), stagingDir+"/").Run()
+	}
+	// rsync uses the first matching rule, so includes go first.
+	for _, p := range l.Include {
+		args = append(args, "--include="+p)
+	}
+	for _, p := range l.Exclude {
+		args = append(args, "--exclude="+p)
+	}
+	if l.MaxFileSize > 0 {
+		args = append(args, fmt.Sprintf("--max-size=%d", l.MaxFileSize))
+	}
+	if l.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	// "A trailing slash on the source changes this behavior to avoid
+	// creating an additional directory level at the destination. You can
+	// think of a trailing / on a source as meaning 'copy the contents of
+	// this directory' as opposed to 'copy the directory by name', but in
+	// both cases the attributes of the containing directory are
+	// transferred to the containing directory on the destination." ~ man rsync
+	//
+	// This way anchored patterns are relative to Dir.
+	return append(args, strings.TrimSuffix(l.Dir, "/")+"/", filepath.Join(stagingDir, l.dest())+"/")
+}
+
+func (l *Local) fetchGo(stagingDir string, rep *report.Source) error {
+	c := &copier{
+		filter:        filter{include: l.Include, exclude: l.Exclude},
+		maxFileSize:   l.MaxFileSize,
+		oneFileSystem: l.OneFileSystem,
+	}
+	if err := c.copyTree(l.Dir, filepath.Join(stagingDir, l.dest())); err != nil {
+		return err
+	}
+	rep.Count("files", c.files)
+	rep.Count("bytes", c.bytes)
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return copierErrors(c.errs).report(l.PartialTransfer, rep)
 }
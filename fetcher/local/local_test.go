@@ -0,0 +1,176 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func writeFile(t *testing.T, name, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchGo(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	writeFile(t, outside, "outside", 0644)
+
+	src := filepath.Join(t.TempDir(), "home")
+	writeFile(t, filepath.Join(src, "a.txt"), "hello", 0640)
+	writeFile(t, filepath.Join(src, "bin/run"), "#!/bin/sh", 0755)
+	writeFile(t, filepath.Join(src, "big.bin"), "0123456789", 0644)
+	writeFile(t, filepath.Join(src, "sub/out.log"), "log", 0644)
+	writeFile(t, filepath.Join(src, "node_modules/x.js"), "x", 0644)
+	if err := os.Symlink("a.txt", filepath.Join(src, "safe")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(src, "unsafe")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "bin"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Local{
+		Dir:         src + "/",
+		Exclude:     []string{"*.log", "node_modules/"},
+		MaxFileSize: 9,
+		Backend:     "go",
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if deps := l.Deps(); len(deps) != 0 {
+		t.Errorf("Deps() = %v; want none", deps)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := l.Fetch(stagingDir, rep.Source(l.String())); err != nil {
+		t.Fatal(err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(stagingDir, host, src)
+
+	var got []string
+	filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dest, p)
+		got = append(got, rel)
+		return nil
+	})
+	want := []string{".", "a.txt", "bin", "bin/run", "safe", "sub", "unsafe"}
+	if !slices.Equal(got, want) {
+		t.Errorf("copied %q; want %q", got, want)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "safe")); err != nil || target != "a.txt" {
+		t.Errorf("safe symlink = %q, %v; want a.txt", target, err)
+	}
+	fi, err := os.Lstat(filepath.Join(dest, "unsafe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() {
+		t.Errorf("unsafe symlink has mode %v; want a regular file", fi.Mode())
+	}
+
+	for _, tt := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"a.txt", 0640},
+		{"bin/run", 0755},
+	} {
+		fi, err := os.Stat(filepath.Join(dest, tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != tt.mode {
+			t.Errorf("%s has mode %v; want %v", tt.name, fi.Mode().Perm(), tt.mode)
+		}
+	}
+	for _, name := range []string{"a.txt", "bin"} {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s has mtime %v; want %v", name, fi.ModTime(), mtime)
+		}
+	}
+	if got := rep.Counts[l.String()]["files"]; got != 4 {
+		t.Errorf("counted %d files; want 4", got)
+	}
+}
+
+func TestFetchGoLoop(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "home")
+	writeFile(t, filepath.Join(src, "a.txt"), "hello", 0644)
+	// The parent of the tree is outside, so this is an unsafe link which
+	// is followed.
+	if err := os.Symlink(filepath.Dir(src), filepath.Join(src, "parent")); err != nil {
+		t.Fatal(err)
+	}
+	l := &Local{Dir: src, Backend: "go"}
+	rep := report.New()
+	if err := l.Fetch(t.TempDir(), rep.Source(l.String())); err == nil {
+		t.Fatal("Fetch() with a symlink loop succeeded")
+	}
+	if rep.Num(report.Warning) == 0 {
+		t.Error("no warnings reported")
+	}
+}
+
+func TestRsyncArgs(t *testing.T) {
+	l := &Local{
+		Dir:           "/home/user/",
+		Dest:          "laptop/user",
+		Exclude:       []string{"*.log"},
+		Include:       []string{"keep.log"},
+		MaxFileSize:   100,
+		OneFileSystem: true,
+	}
+	want := []string{
+		"--archive", "--copy-unsafe-links",
+		"--include=keep.log", "--exclude=*.log",
+		"--max-size=100", "--one-file-system",
+		"/home/user/", "/staging/laptop/user/",
+	}
+	if got := l.rsyncArgs("/staging"); !slices.Equal(got, want) {
+		t.Errorf("rsyncArgs() = %q; want %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, l := range []*Local{
+		{},
+		{Dir: "/a", Exclude: []string{"[a"}},
+		{Dir: "/a", MaxFileSize: -1},
+		{Dir: "/a", Backend: "cp"},
+		{Dir: "/a", Dest: "/abs"},
+		{Dir: "/a", Dest: "../up"},
+		{Dir: "/a", PartialTransfer: "ignore"},
+	} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", l)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// Policies for partial transfers.
+const (
+	// PartialError fails the fetch if any file was not copied.
+	PartialError = "error"
+	// PartialWarnVanished fails the fetch if a file could not be read,
+	// but files which were deleted during the copy are only warnings. This
+	// is the default.
+	PartialWarnVanished = "warn_vanished"
+	// PartialWarning only reports the files which were not copied as
+	// warnings.
+	PartialWarning = "warning"
+)
+
+// rsync exit codes for a partial transfer.
+const (
+	rsyncPartial  = 23
+	rsyncVanished = 24
+)
+
+// partialTransfer lists the files which were not copied.
+type partialTransfer struct {
+	// failed and vanished are messages which include the path.
+	failed   []string
+	vanished []string
+}
+
+// parseRsyncErrors reads rsync's stderr for the files which were not copied.
+func parseRsyncErrors(stderr string) partialTransfer {
+	p := partialTransfer{}
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "rsync error:"):
+			// The summary line only repeats the exit code.
+		case strings.HasPrefix(line, "file has vanished:"):
+			p.vanished = append(p.vanished, line)
+		default:
+			p.failed = append(p.failed, strings.TrimPrefix(line, "rsync: "))
+		}
+	}
+	return p
+}
+
+// copierErrors sorts the errors of the Go copier the same as rsync's.
+func copierErrors(errs []error) partialTransfer {
+	p := partialTransfer{}
+	for _, err := range errs {
+		if errors.Is(err, fs.ErrNotExist) {
+			p.vanished = append(p.vanished, fmt.Sprintf("file has vanished: %v", err))
+		} else {
+			p.failed = append(p.failed, err.Error())
+		}
+	}
+	return p
+}
+
+// report adds the files to the report and returns an error if the policy
+// counts them as errors.
+func (p partialTransfer) report(policy string, rep *report.Source) error {
+	for _, msg := range p.failed {
+		rep.Warnf("%s", msg)
+	}
+	for _, msg := range p.vanished {
+		rep.Warnf("%s", msg)
+	}
+	rep.Count("failed files", int64(len(p.failed)))
+	rep.Count("vanished files", int64(len(p.vanished)))
+
+	n := len(p.failed)
+	switch policy {
+	case PartialError:
+		n += len(p.vanished)
+	case PartialWarning:
+		n = 0
+	}
+	if n != 0 {
+		return fmt.Errorf("partial transfer: %d files failed, %d files vanished", len(p.failed), len(p.vanished))
+	}
+	return nil
+}
+
+// rsyncResult interprets the error from running rsync. Partial transfers are
+// handled by the policy. Any other failure is an error with rsync's output.
+func rsyncResult(err error, stderr, policy string, rep *report.Source) error {
+	if err == nil {
+		return nil
+	}
+	exitErr := &exec.ExitError{}
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case rsyncPartial, rsyncVanished:
+			return parseRsyncErrors(stderr).report(policy, rep)
+		}
+	}
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return fmt.Errorf("rsync: %v: %s", err, stderr)
+	}
+	return fmt.Errorf("rsync: %v", err)
+}
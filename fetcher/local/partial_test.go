@@ -0,0 +1,85 @@
+package local
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+const rsyncStderr = `rsync: [sender] send_files failed to open "/home/user/secret": Permission denied (13)
+file has vanished: "/home/user/.cache/tmp1"
+file has vanished: "/home/user/.cache/tmp2"
+rsync error: some files/attrs were not transferred (see previous errors) (code 23) at main.c(1338) [sender=3.2.7]
+`
+
+func TestParseRsyncErrors(t *testing.T) {
+	p := parseRsyncErrors(rsyncStderr)
+	if len(p.failed) != 1 || p.failed[0] != `[sender] send_files failed to open "/home/user/secret": Permission denied (13)` {
+		t.Errorf("failed = %q", p.failed)
+	}
+	if len(p.vanished) != 2 {
+		t.Errorf("vanished = %q; want 2", p.vanished)
+	}
+}
+
+func TestRsyncResult(t *testing.T) {
+	// exitErr runs a command which exits with the given code.
+	exitErr := func(code string) error {
+		return exec.Command("sh", "-c", "exit "+code).Run()
+	}
+	vanished := "file has vanished: \"/home/user/a\"\n"
+
+	for _, tt := range []struct {
+		name    string
+		code    string
+		stderr  string
+		policy  string
+		wantErr bool
+	}{
+		{"success", "0", "", "", false},
+		{"vanished", "24", vanished, "", false},
+		{"vanished strict", "24", vanished, PartialError, true},
+		{"partial", "23", rsyncStderr, "", true},
+		{"partial lenient", "23", rsyncStderr, PartialWarning, false},
+		{"other", "1", "rsync: syntax error\n", PartialWarning, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := report.New()
+			err := rsyncResult(exitErr(tt.code), tt.stderr, tt.policy, rep.Source("local"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rsyncResult() = %v; want error %v", err, tt.wantErr)
+			}
+			if tt.code == "23" {
+				if got := rep.Counts["local"]["failed files"]; got != 1 {
+					t.Errorf("counted %d failed files; want 1", got)
+				}
+				if got := rep.Num(report.Warning); got != 3 {
+					t.Errorf("got %d warnings; want 3", got)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchGoPartialTransfer(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), "hello", 0644)
+	// A broken unsafe symlink is the same as a file which vanished.
+	if err := os.Symlink("/nonexistent/file", filepath.Join(src, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []string{"", PartialError} {
+		l := &Local{Dir: src, Dest: "dest", Backend: "go", PartialTransfer: policy}
+		rep := report.New()
+		err := l.Fetch(t.TempDir(), rep.Source(l.String()))
+		if wantErr := policy == PartialError; (err != nil) != wantErr {
+			t.Errorf("Fetch() with policy %q = %v; want error %v", policy, err, wantErr)
+		}
+		if got := rep.Counts[l.String()]["vanished files"]; got != 1 {
+			t.Errorf("counted %d vanished files; want 1", got)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Package s3 fetches the objects in a bucket of Amazon S3 or a compatible
+// object store such as MinIO.
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// S3 downloads the objects under a prefix of a bucket into a directory of the
+// staging area. The metadata of the objects is saved in a sidecar file, which
+// is also used to skip unchanged objects when the staging area is reused.
+type S3 struct {
+	// Endpoint is the URL of the service. It defaults to Amazon S3 in
+	// Region, for example "http://localhost:9000" for MinIO.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region defaults to "us-east-1".
+	Region string `json:"region,omitempty"`
+	// PathStyle puts the bucket in the path instead of the host name,
+	// which is needed for most services other than Amazon S3.
+	PathStyle bool   `json:"path_style,omitempty"`
+	Bucket    string `json:"bucket"`
+	// Prefix is a folder in the bucket. A trailing slash is added if it is
+	// missing, so "backups" does not match "backupsX/".
+	Prefix string `json:"prefix,omitempty"`
+	// The requests are not signed if there is no access key.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+	// Dest is the directory in the staging area. The sidecar file is
+	// Dest + ".metadata.json".
+	Dest string `json:"dest"`
+}
+
+// object is the metadata of an object saved in the sidecar file.
+type object struct {
+	ETag         string            `json:"etag"`
+	Size         int64             `json:"size"`
+	LastModified time.Time         `json:"last_modified"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	ContentType  string            `json:"content_type,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// listBucketResult is the response to ListObjectsV2.
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+		StorageClass string    `xml:"StorageClass"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.Bucket + "/" + s.prefix()
+}
+
+func (s *S3) prefix() string {
+	if s.Prefix == "" || strings.HasSuffix(s.Prefix, "/") {
+		return s.Prefix
+	}
+	return s.Prefix + "/"
+}
+
+func (s *S3) Name() string {
+	return "S3"
+}
+
+func (s *S3) Validate() error {
+	if s.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if s.Endpoint != "" {
+		u, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint must be an http or https url, got %q", s.Endpoint)
+		}
+	}
+	if (s.AccessKeyID == "") != (s.SecretAccessKey == "") {
+		return errors.New("access_key_id and secret_access_key must be set together")
+	}
+	if s.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", s.Dest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *S3) Destinations() []string {
+	return []string{s.Dest, s.Dest + ".metadata.json"}
+}
+
+func (s *S3) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// url returns the URL of the object key, or the bucket if key is empty.
+func (s *S3) url(key string) (*url.URL, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region() + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.PathStyle {
+		base += "/" + s.Bucket
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = base + "/" + key
+	u.RawPath = uriEscape(u.Path, true)
+	return u, nil
+}
+
+// get sends a signed GET request.
+func (s *S3) get(u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.AccessKeyID != "" {
+		sign(req, s.AccessKeyID, s.SecretAccessKey, s.SessionToken, s.region(), time.Now())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("HTTP error: GET %s: %s: %s", u.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// list returns the objects under the prefix with ListObjectsV2.
+func (s *S3) list() (map[string]object, error) {
+	objects := map[string]object{}
+	token := ""
+	for {
+		u, err := s.url("")
+		if err != nil {
+			return nil, err
+		}
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix()}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+		resp, err := s.get(u)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", s, err)
+		}
+		for _, c := range result.Contents {
+			objects[c.Key] = object{
+				ETag:         c.ETag,
+				Size:         c.Size,
+				LastModified: c.LastModified,
+				StorageClass: c.StorageClass,
+			}
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, fmt.Errorf("listing %s: truncated without a continuation token", s)
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// relativePath returns the path of the key in Dest. Keys which are not a
+// clean relative path, such as folder markers ending in a slash, cannot be
+// saved as files.
+func (s *S3) relativePath(key string) (string, bool) {
+	rel := strings.TrimPrefix(key, s.prefix())
+	if rel == "" || path.Clean(rel) != rel || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", false
+	}
+	return filepath.FromSlash(rel), true
+}
+
+// download downloads the object key to dest and returns its metadata.
+func (s *S3) download(key, dest string, obj object) (object, error) {
+	u, err := s.url(key)
+	if err != nil {
+		return obj, err
+	}
+	resp, err := s.get(u)
+	if err != nil {
+		return obj, err
+	}
+	defer resp.Body.Close()
+
+	obj.ETag = resp.Header.Get("ETag")
+	obj.ContentType = resp.Header.Get("Content-Type")
+	obj.Metadata = nil
+	for k, v := range resp.Header {
+		if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok {
+			if obj.Metadata == nil {
+				obj.Metadata = map[string]string{}
+			}
+			obj.Metadata[name] = strings.Join(v, ",")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return obj, err
+	}
+	partial := dest + ".partial"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return obj, err
+	}
+	defer os.Remove(partial)
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return obj, err
+	}
+	obj.Size = n
+
+	// The ETag of an object uploaded in one part without KMS encryption is
+	// its MD5.
+	etag := strings.Trim(obj.ETag, `"`)
+	if len(etag) == 2*md5.Size && resp.Header.Get("X-Amz-Server-Side-Encryption") != "aws:kms" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(etag, sum) {
+			return obj, fmt.Errorf("checksum mismatch: got md5 %s, want %s", sum, etag)
+		}
+	}
+	return obj, os.Rename(partial, dest)
+}
+
+func (s *S3) Fetch(stagingDir string, rep *report.Source) error {
+	sidecar := filepath.Join(stagingDir, s.Dest+".metadata.json")
+	saved := map[string]object{}
+	if data, err := os.ReadFile(sidecar); err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			rep.Warnf("ignoring invalid %s: %v", sidecar, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	objects, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	// Objects which were deleted from the bucket are dropped from the
+	// sidecar, but their files stay like the files of other fetchers.
+	metadata := map[string]object{}
+	failed := 0
+	for key, obj := range objects {
+		rel, ok := s.relativePath(key)
+		if !ok {
+			if !strings.HasSuffix(key, "/") {
+				rep.Warnf("skipping object %q which is not a valid path", key)
+			}
+			continue
+		}
+		dest := filepath.Join(stagingDir, s.Dest, rel)
+		if prev, ok := saved[key]; ok && prev.ETag == obj.ETag && prev.Size == obj.Size {
+			if fi, err := os.Stat(dest); err == nil && fi.Size() == obj.Size {
+				metadata[key] = prev
+				rep.Count("unchanged objects", 1)
+				continue
+			}
+		}
+		obj, err := s.download(key, dest, obj)
+		if err != nil {
+			rep.Warnf("%s: %v", key, err)
+			failed++
+			continue
+		}
+		metadata[key] = obj
+		rep.Count("downloaded objects", 1)
+		rep.Count("downloaded bytes", obj.Size)
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sidecar), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sidecar, data, 0600); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to download %d objects", failed)
+	}
+	return nil
+}
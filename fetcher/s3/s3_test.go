@@ -0,0 +1,306 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+const (
+	testAccessKeyID     = "AKIDEXAMPLE"
+	testSecretAccessKey = "secret"
+	testRegion          = "eu-west-1"
+	testPageSize        = 2
+)
+
+// fakeS3 implements path-style ListObjectsV2 and GetObject for one bucket.
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]string
+	gets    []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verifySignature(r); err != nil {
+		f.t.Error(err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		f.list(w, r)
+		return
+	}
+	content, ok := f.objects[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.gets = append(f.gets, key)
+	sum := md5.Sum([]byte(content))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Amz-Meta-Owner", "me")
+	w.Write([]byte(content))
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		http.Error(w, "only ListObjectsV2 is supported", http.StatusBadRequest)
+		return
+	}
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) && k > q.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	result := listBucketResult{}
+	if len(keys) > testPageSize {
+		keys = keys[:testPageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		sum := md5.Sum([]byte(f.objects[k]))
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			LastModified time.Time `xml:"LastModified"`
+			ETag         string    `xml:"ETag"`
+			Size         int64     `xml:"Size"`
+			StorageClass string    `xml:"StorageClass"`
+		}{k, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), `"` + hex.EncodeToString(sum[:]) + `"`, int64(len(f.objects[k])), "STANDARD"})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verifySignature signs a copy of the received request and compares the
+// signatures.
+func (f *fakeS3) verifySignature(r *http.Request) error {
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("invalid X-Amz-Date: %v", err)
+	}
+	auth := r.Header.Get("Authorization")
+	_, signed, ok := strings.Cut(auth, "SignedHeaders=")
+	if !ok {
+		return fmt.Errorf("invalid Authorization %q", auth)
+	}
+	signed, _, _ = strings.Cut(signed, ",")
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range strings.Split(signed, ";") {
+		if h != "host" && h != "x-amz-date" && h != "x-amz-content-sha256" {
+			req.Header.Set(h, r.Header.Get(h))
+		}
+	}
+	sign(req, testAccessKeyID, testSecretAccessKey, "", testRegion, date)
+	if got := req.Header.Get("Authorization"); got != auth {
+		return fmt.Errorf("%s %s: Authorization = %q; want %q", r.Method, r.URL, auth, got)
+	}
+	return nil
+}
+
+func TestFetch(t *testing.T) {
+	srv := &fakeS3{t: t, bucket: "data", objects: map[string]string{
+		"backups/a.txt":            "a",
+		"backups/dir/b b.txt":      "b",
+		"backups/dir/été.txt":      "c",
+		"backups/dir/":             "",
+		"backups/x/../escape.txt":  "escape",
+		"other/not-included.txt":   "d",
+		"backups/nested/deep/e.md": "e",
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	s := &S3{
+		Endpoint:        ts.URL,
+		Region:          testRegion,
+		PathStyle:       true,
+		Bucket:          "data",
+		Prefix:          "backups/",
+		AccessKeyID:     testAccessKeyID,
+		SecretAccessKey: testSecretAccessKey,
+		Dest:            "minio/data",
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := s.Fetch(stagingDir, rep.Source(s.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a.txt":            "a",
+		"dir/b b.txt":      "b",
+		"dir/été.txt":      "c",
+		"nested/deep/e.md": "e",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(stagingDir, s.Dest, name))
+		if err != nil || string(data) != content {
+			t.Errorf("ReadFile(%q) = %q, %v; want %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "minio", "escape.txt")); err == nil {
+		t.Error("object outside of dest was downloaded")
+	}
+	if len(srv.gets) != len(want) {
+		t.Errorf("downloaded %q; want %d objects", srv.gets, len(want))
+	}
+
+	data, err := os.ReadFile(filepath.Join(stagingDir, s.Dest+".metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]object{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if got := metadata["backups/a.txt"]; got.ETag != `"0cc175b9c0f1b6a831c399e269772661"` || got.Size != 1 ||
+		got.ContentType != "text/plain" || got.Metadata["owner"] != "me" || got.StorageClass != "STANDARD" {
+		t.Errorf("metadata = %+v", got)
+	}
+
+	// Only the changed object is downloaded again.
+	srv.objects["backups/a.txt"] = "changed"
+	srv.gets = nil
+	if err := s.Fetch(stagingDir, rep.Source(s.String())); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.gets) != 1 || srv.gets[0] != "backups/a.txt" {
+		t.Errorf("downloaded %q; want only backups/a.txt", srv.gets)
+	}
+	if data, err := os.ReadFile(filepath.Join(stagingDir, s.Dest, "a.txt")); err != nil || string(data) != "changed" {
+		t.Errorf("ReadFile() = %q, %v; want %q", data, err, "changed")
+	}
+	counts := rep.Counts[s.String()]
+	if counts["downloaded objects"] != 5 || counts["unchanged objects"] != 3 {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func TestFetchPrefixWithoutSlash(t *testing.T) {
+	srv := &fakeS3{t: t, bucket: "data", objects: map[string]string{
+		"backups/a.txt":  "a",
+		"backupsX/b.txt": "b",
+	}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	s := &S3{
+		Endpoint:        ts.URL,
+		Region:          testRegion,
+		PathStyle:       true,
+		Bucket:          "data",
+		Prefix:          "backups",
+		AccessKeyID:     testAccessKeyID,
+		SecretAccessKey: testSecretAccessKey,
+		Dest:            "data",
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := s.Fetch(stagingDir, rep.Source(s.String())); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(stagingDir, "data", "a.txt")); err != nil || string(data) != "a" {
+		t.Errorf("ReadFile() = %q, %v; want %q", data, err, "a")
+	}
+	if len(srv.gets) != 1 {
+		t.Errorf("downloaded %q; want only backups/a.txt", srv.gets)
+	}
+	if n := rep.Num(report.Warning); n != 0 {
+		t.Errorf("warnings = %d; want 0", n)
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("list-type") == "2" {
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>a</Key><Size>1</Size><ETag>"0cc175b9c0f1b6a831c399e269772661"</ETag></Contents></ListBucketResult>`)
+			return
+		}
+		w.Header().Set("ETag", `"0cc175b9c0f1b6a831c399e269772661"`)
+		w.Write([]byte("b"))
+	}))
+	defer ts.Close()
+
+	s := &S3{Endpoint: ts.URL, PathStyle: true, Bucket: "data", Dest: "data"}
+	stagingDir := t.TempDir()
+	if err := s.Fetch(stagingDir, nil); err == nil {
+		t.Fatal("Fetch() succeeded; want checksum mismatch")
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "data", "a")); err == nil {
+		t.Error("Fetch() created the file")
+	}
+}
+
+func TestURL(t *testing.T) {
+	for _, tt := range []struct {
+		s    S3
+		key  string
+		want string
+	}{
+		{S3{Bucket: "data"}, "a b.txt", "https://data.s3.us-east-1.amazonaws.com/a%20b.txt"},
+		{S3{Bucket: "data", Region: "eu-west-1"}, "", "https://data.s3.eu-west-1.amazonaws.com/"},
+		{S3{Bucket: "data", Endpoint: "http://localhost:9000", PathStyle: true}, "dir/a+b.txt", "http://localhost:9000/data/dir/a%2Bb.txt"},
+	} {
+		u, err := tt.s.url(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.String(); got != tt.want {
+			t.Errorf("url(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		s  S3
+		ok bool
+	}{
+		{S3{Bucket: "data", Dest: "data"}, true},
+		{S3{Bucket: "data", Endpoint: "http://localhost:9000", AccessKeyID: "a", SecretAccessKey: "b", Dest: "data"}, true},
+		{S3{Dest: "data"}, false},
+		{S3{Bucket: "data"}, false},
+		{S3{Bucket: "data", Dest: "/data"}, false},
+		{S3{Bucket: "data", Endpoint: "localhost:9000", Dest: "data"}, false},
+		{S3{Bucket: "data", AccessKeyID: "a", Dest: "data"}, false},
+	} {
+		if err := tt.s.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v; want ok=%v", tt.s, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package secrets fetches private keys, such as ~/.ssh and ~/.gnupg, into a
+// per-machine directory of the staging area, and restores them.
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/internal/fsutil"
+	"github.com/rjoleary/backup/report"
+	"github.com/rjoleary/backup/staging"
+)
+
+// manifestFile lists the copied files and their modes.
+const manifestFile = "secrets.json"
+
+// defaultPaths are copied when no paths are configured.
+var defaultPaths = []string{"~/.ssh", "~/.gnupg"}
+
+// encrypted is overridden by tests.
+var encrypted = staging.Encrypted
+
+// Secrets copies files which must only be stored in an encrypted image.
+type Secrets struct {
+	// Paths are the files and directories to copy. A leading "~/" is the
+	// home directory. It defaults to ~/.ssh and ~/.gnupg.
+	Paths []string `json:"paths,omitempty"`
+	// Dest is the directory in the staging area. It defaults to the
+	// hostname followed by "secrets", for example "laptop/secrets".
+	Dest string `json:"dest,omitempty"`
+}
+
+// entry is a file or directory in the manifest.
+type entry struct {
+	// Path is the original absolute path. The copy is at the same path
+	// inside the destination directory.
+	Path string `json:"path"`
+	// Mode is the original permissions in octal.
+	Mode string `json:"mode"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+type manifest struct {
+	Files []entry `json:"files"`
+}
+
+func (s *Secrets) String() string {
+	return "secrets " + strings.Join(s.paths(), ", ")
+}
+
+func (s *Secrets) Name() string {
+	return "Secrets"
+}
+
+func (s *Secrets) Validate() error {
+	paths := []string{}
+	for _, p := range s.Paths {
+		if !filepath.IsAbs(p) && !strings.HasPrefix(p, "~/") {
+			return fmt.Errorf("path must be absolute or start with ~/, got %q", p)
+		}
+		src, err := expandHome(p)
+		if err != nil {
+			return err
+		}
+		// A file would be copied twice if it is in two of the paths.
+		for _, other := range paths {
+			if src == other || strings.HasPrefix(src, other+string(filepath.Separator)) || strings.HasPrefix(other, src+string(filepath.Separator)) {
+				return fmt.Errorf("paths %s and %s overlap", other, src)
+			}
+		}
+		paths = append(paths, src)
+	}
+	if s.Dest != "" {
+		if err := fetcher.ValidateDest("dest", s.Dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Secrets) Destinations() []string {
+	return []string{s.dest()}
+}
+
+func (s *Secrets) dest() string {
+	if s.Dest != "" {
+		return s.Dest
+	}
+	return DefaultDest()
+}
+
+// DefaultDest is the destination of this machine's secrets in the staging
+// area when none is configured.
+func DefaultDest() string {
+	return fetcher.HostDir("secrets")
+}
+
+func (s *Secrets) paths() []string {
+	if len(s.Paths) == 0 {
+		return defaultPaths
+	}
+	return s.Paths
+}
+
+func expandHome(p string) (string, error) {
+	rest, ok := strings.CutPrefix(p, "~/")
+	if !ok {
+		return filepath.Clean(p), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+func (s *Secrets) Fetch(stagingDir string, rep *report.Source) error {
+	ok, err := encrypted(stagingDir)
+	if err != nil {
+		return fmt.Errorf("checking the staging area is encrypted: %v", err)
+	}
+	if !ok {
+		return errors.New("refusing to copy secrets to an unencrypted staging area")
+	}
+
+	dest := filepath.Join(stagingDir, s.dest())
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	m := &manifest{Files: []entry{}}
+	for _, p := range s.paths() {
+		src, err := expandHome(p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+			if len(s.Paths) == 0 {
+				rep.Infof("skipping %s which does not exist", src)
+			} else {
+				rep.Warnf("skipping %s which does not exist", src)
+			}
+			continue
+		}
+		if err := copySecrets(src, dest, map[fileID]bool{}, m, rep); err != nil {
+			return err
+		}
+	}
+	rep.Count("files", int64(len(m.Files)))
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dest, manifestFile), data, 0600)
+}
+
+// fileID identifies a directory, to detect loops through symlinks.
+type fileID struct {
+	dev, ino uint64
+}
+
+// copySecrets copies src to the same path inside dest. Symlinks are followed.
+// Every copy is only accessible by the owner. Sockets, such as gpg-agent's,
+// are skipped. active is the set of directories being copied.
+func copySecrets(src, dest string, active map[fileID]bool, m *manifest, rep *report.Source) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		rep.Warnf("%v", err)
+		return nil
+	}
+	target := filepath.Join(dest, src)
+	switch {
+	case fi.IsDir():
+		st := fi.Sys().(*syscall.Stat_t)
+		id := fileID{uint64(st.Dev), uint64(st.Ino)}
+		if active[id] {
+			rep.Warnf("%s: directory loop", src)
+			return nil
+		}
+		active[id] = true
+		defer delete(active, id)
+		if err := os.MkdirAll(target, 0700); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := fsutil.CopyFile(src, target, os.O_EXCL, 0600); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	m.Files = append(m.Files, entry{
+		Path: src,
+		Mode: fmt.Sprintf("%04o", fi.Mode().Perm()),
+		Dir:  fi.IsDir(),
+	})
+	if !fi.IsDir() {
+		return nil
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := copySecrets(filepath.Join(src, e.Name()), dest, active, m, rep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore copies the secrets in dir, a destination of the fetcher in a
+// mounted backup image, back to their original paths under root. The
+// original modes are restored. Existing files are not overwritten.
+func Restore(dir, root string) error {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return fmt.Errorf("parsing %s: %v", manifestFile, err)
+	}
+
+	errs := []error{}
+	// The modes of directories are set after their contents are written,
+	// in case they are not writable.
+	dirs := []entry{}
+	for _, e := range m.Files {
+		mode, err := strconv.ParseUint(e.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q of %s", e.Mode, e.Path)
+		}
+		if !filepath.IsAbs(e.Path) {
+			return fmt.Errorf("invalid path %q", e.Path)
+		}
+		target := filepath.Join(root, e.Path)
+		// The parents are created private. Their modes are set when
+		// they are in the manifest.
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if e.Dir {
+			if err := os.Mkdir(target, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+				errs = append(errs, err)
+				continue
+			}
+			dirs = append(dirs, entry{Path: target, Mode: e.Mode})
+			continue
+		}
+		if err := fsutil.CopyFile(filepath.Join(dir, e.Path), target, os.O_EXCL, 0600); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Chmod(target, fs.FileMode(mode)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, d := range slices.Backward(dirs) {
+		// The mode was parsed above.
+		mode, _ := strconv.ParseUint(d.Mode, 8, 32)
+		if err := os.Chmod(d.Path, fs.FileMode(mode)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
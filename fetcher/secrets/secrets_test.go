@@ -0,0 +1,133 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func TestFetchAndRestore(t *testing.T) {
+	orig := encrypted
+	encrypted = func(string) (bool, error) { return true, nil }
+	t.Cleanup(func() { encrypted = orig })
+	home := t.TempDir()
+	ssh := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(ssh, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]os.FileMode{
+		"id_ed25519":     0600,
+		"id_ed25519.pub": 0644,
+	}
+	for name, mode := range files {
+		if err := os.WriteFile(filepath.Join(ssh, name), []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Secrets{Paths: []string{ssh, filepath.Join(home, "missing")}, Dest: "laptop/secrets"}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	rep := report.New()
+	if err := s.Fetch(stagingDir, rep.Source(s.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.Num(report.Warning); got != 1 {
+		t.Errorf("got %d warnings; want 1 for the missing path", got)
+	}
+
+	// Every copy is private.
+	dest := filepath.Join(stagingDir, s.Dest)
+	filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			t.Errorf("%s has mode %v", p, fi.Mode())
+		}
+		return nil
+	})
+
+	root := t.TempDir()
+	if err := Restore(dest, root); err != nil {
+		t.Fatal(err)
+	}
+	files["."] = 0700 | os.ModeDir
+	for name, mode := range files {
+		fi, err := os.Stat(filepath.Join(root, ssh, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("restored %s with mode %v; want %v", name, fi.Mode(), mode)
+		}
+	}
+
+	// Existing files are not overwritten.
+	if err := Restore(dest, root); err == nil {
+		t.Error("second Restore() succeeded")
+	}
+}
+
+func TestFetchUnencrypted(t *testing.T) {
+	orig := encrypted
+	encrypted = func(string) (bool, error) { return false, nil }
+	t.Cleanup(func() { encrypted = orig })
+	s := &Secrets{Paths: []string{t.TempDir()}}
+	if err := s.Fetch(t.TempDir(), nil); err == nil {
+		t.Fatal("Fetch() to an unencrypted staging area succeeded")
+	}
+}
+
+func TestFetchSymlinkLoop(t *testing.T) {
+	orig := encrypted
+	encrypted = func(string) (bool, error) { return true, nil }
+	t.Cleanup(func() { encrypted = orig })
+	gnupg := filepath.Join(t.TempDir(), ".gnupg")
+	if err := os.Mkdir(gnupg, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(gnupg, "pubring.kbx"), []byte("keys"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(gnupg, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Secrets{Paths: []string{gnupg}, Dest: "secrets"}
+	rep := report.New()
+	if err := s.Fetch(t.TempDir(), rep.Source(s.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := rep.Num(report.Warning); got != 1 {
+		t.Errorf("got %d warnings; want 1 for the loop", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []*Secrets{
+		{Paths: []string{"relative/.ssh"}},
+		{Paths: []string{"~/.ssh", "~/.ssh/config"}},
+		{Paths: []string{"/home/me/.gnupg/private-keys-v1.d", "/home/me/.gnupg"}},
+		{Dest: "/abs"},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", s)
+		}
+	}
+}
+
+func TestValidateOK(t *testing.T) {
+	s := &Secrets{Paths: []string{"~/.ssh", "~/.ssh-old", "/etc/ssh"}, Dest: "laptop/secrets"}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
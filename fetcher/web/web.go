@@ -0,0 +1,328 @@
+// Package web fetches files over HTTP, either a single URL such as an export
+// endpoint, or every file in a WebDAV collection such as a Nextcloud folder.
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+// stateFile records the validators of the downloaded files, so they are not
+// downloaded again when the staging area is reused.
+const stateFile = ".backup-state.json"
+
+// maxAttempts is the number of times a download is tried. Later attempts
+// resume the partial download.
+const maxAttempts = 3
+
+// Web downloads a URL or a WebDAV collection into the staging area.
+type Web struct {
+	URL string `json:"url"`
+	// WebDAV downloads every file in the collection at URL instead of the
+	// URL itself.
+	WebDAV bool `json:"webdav,omitempty"`
+	// Dest is the file, or for WebDAV the directory, in the staging area.
+	Dest string `json:"dest"`
+	// Username and Password are sent with basic auth.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Headers are added to every request, for example
+	// {"Authorization": "Bearer ..."}.
+	Headers map[string]string `json:"headers,omitempty"`
+	// SHA256 is the expected checksum in hex of a single URL.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// state is saved in the stateFile.
+type state struct {
+	// Files maps the path relative to Dest to the validators of the
+	// downloaded file.
+	Files map[string]validators `json:"files"`
+	// Partial maps the path to the validators of an unfinished download.
+	Partial map[string]validators `json:"partial,omitempty"`
+}
+
+// validators are the headers used for conditional requests.
+type validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (w *Web) String() string {
+	// Only the host and path, in case the URL contains a secret.
+	if u, err := url.Parse(w.URL); err == nil {
+		return u.Host + u.Path
+	}
+	return w.Dest
+}
+
+func (w *Web) Name() string {
+	if w.WebDAV {
+		return "WebDAV"
+	}
+	return "HTTP"
+}
+
+func (w *Web) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be http or https, got %q", w.URL)
+	}
+	if w.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", w.Dest); err != nil {
+		return err
+	}
+	if w.SHA256 != "" {
+		if w.WebDAV {
+			return errors.New("sha256 is only supported for a single url")
+		}
+		if b, err := hex.DecodeString(w.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 %q", w.SHA256)
+		}
+	}
+	return nil
+}
+
+func (w *Web) Destinations() []string {
+	if w.WebDAV {
+		return []string{w.Dest}
+	}
+	return []string{w.Dest, w.Dest + stateFile}
+}
+
+func (w *Web) stateFile(stagingDir string) string {
+	if w.WebDAV {
+		return filepath.Join(stagingDir, w.Dest, stateFile)
+	}
+	return filepath.Join(stagingDir, w.Dest+stateFile)
+}
+
+func (w *Web) newRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if w.Username != "" || w.Password != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (w *Web) Fetch(stagingDir string, rep *report.Source) error {
+	s := &state{Files: map[string]validators{}, Partial: map[string]validators{}}
+	file := w.stateFile(stagingDir)
+	if data, err := os.ReadFile(file); err == nil {
+		if err := json.Unmarshal(data, s); err != nil {
+			rep.Warnf("ignoring invalid %s: %v", file, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s.Partial == nil {
+		s.Partial = map[string]validators{}
+	}
+
+	var err error
+	if w.WebDAV {
+		err = w.fetchWebDAV(stagingDir, s, rep)
+	} else {
+		err = w.fetchFile(w.URL, filepath.Join(stagingDir, w.Dest), ".", w.SHA256, s, rep)
+	}
+
+	// The state is saved even on failure, so partial downloads are
+	// resumed.
+	data, jsonErr := json.MarshalIndent(s, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	if mkErr := os.MkdirAll(filepath.Dir(file), 0700); mkErr != nil {
+		return mkErr
+	}
+	if writeErr := os.WriteFile(file, data, 0600); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// fetchFile downloads u to dest unless it is unchanged since the last fetch.
+// key is the path of the file in the state.
+func (w *Web) fetchFile(u, dest, key, sha string, s *state, rep *report.Source) error {
+	var cond *validators
+	if prev, ok := s.Files[key]; ok && exists(dest) {
+		cond = &prev
+	}
+	partial := s.Partial[key]
+	v, modified, err := w.download(u, dest, cond, &partial, sha)
+	if err != nil {
+		if partial != (validators{}) {
+			s.Partial[key] = partial
+		}
+		return err
+	}
+	delete(s.Partial, key)
+	if !modified {
+		rep.Count("unchanged files", 1)
+		return nil
+	}
+	s.Files[key] = v
+	rep.Count("downloaded files", 1)
+	return nil
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// download downloads u to dest. If cond is set, the file is only downloaded
+// if it changed. partial is the validators of dest.partial, which is resumed
+// if the file did not change. It is updated as the download progresses.
+func (w *Web) download(u, dest string, cond, partial *validators, sha string) (validators, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return validators{}, false, err
+	}
+	partialFile := dest + ".partial"
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		r, modified, err := w.downloadAttempt(u, partialFile, cond, partial)
+		if err == nil && !modified {
+			return *cond, false, nil
+		}
+		if err == nil {
+			resp = r
+			break
+		}
+		if attempt == maxAttempts {
+			return validators{}, false, err
+		}
+	}
+
+	if err := verify(partialFile, sha, resp.Header); err != nil {
+		os.Remove(partialFile)
+		*partial = validators{}
+		return validators{}, false, err
+	}
+	if err := os.Rename(partialFile, dest); err != nil {
+		return validators{}, false, err
+	}
+	*partial = validators{}
+	return validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, true, nil
+}
+
+// downloadAttempt writes the response body to partialFile. It returns false
+// if the file was not modified.
+func (w *Web) downloadAttempt(u, partialFile string, cond, partial *validators) (*http.Response, bool, error) {
+	req, err := w.newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if cond != nil {
+		if cond.ETag != "" {
+			req.Header.Set("If-None-Match", cond.ETag)
+		} else if cond.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cond.LastModified)
+		}
+	}
+	// Resume if the partial file is of the same version.
+	offset := int64(0)
+	if fi, err := os.Stat(partialFile); err == nil && *partial != (validators{}) {
+		offset = fi.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if partial.ETag != "" {
+			req.Header.Set("If-Range", partial.ETag)
+		} else {
+			req.Header.Set("If-Range", partial.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cond != nil:
+		return nil, false, nil
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+	case resp.StatusCode == http.StatusPartialContent && offset != 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return nil, false, fmt.Errorf("%s: unexpected Content-Range %q", req.URL.Redacted(), resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	default:
+		return nil, false, fmt.Errorf("HTTP error: %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	*partial = validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	f, err := os.OpenFile(partialFile, flags, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, false, err
+	}
+	return resp, true, nil
+}
+
+// verify checks the file against the expected checksum in hex, and the
+// checksum in the Digest header if the server sent one.
+func verify(file, sha string, header http.Header) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := h.Sum(nil)
+
+	if sha != "" && !strings.EqualFold(sha, hex.EncodeToString(sum)) {
+		return fmt.Errorf("checksum mismatch: got sha256 %x, want %s", sum, sha)
+	}
+	// For example "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=".
+	for _, d := range strings.Split(header.Get("Digest"), ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if ok && strings.EqualFold(alg, "sha-256") && value != base64.StdEncoding.EncodeToString(sum) {
+			return fmt.Errorf("checksum mismatch: got sha-256 %s, want %s", base64.StdEncoding.EncodeToString(sum), value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// server serves content with an ETag and records the requests.
+type server struct {
+	mu       sync.Mutex
+	content  []byte
+	etag     string
+	requests []*http.Request
+	// truncate aborts the next response after this many bytes.
+	truncate int
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	content, etag, truncate := s.content, s.etag, s.truncate
+	s.truncate = 0
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", etag)
+	if truncate != 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:truncate])
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+func (s *server) lastRequest() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestFetchURL(t *testing.T) {
+	srv := &server{content: []byte("hello world"), etag: `"v1"`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	sum := sha256.Sum256(srv.content)
+	w := &Web{
+		URL:      ts.URL + "/export",
+		Dest:     "web/export.txt",
+		Username: "user",
+		Password: "secret",
+		Headers:  map[string]string{"X-Token": "token"},
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	stagingDir := t.TempDir()
+	dest := filepath.Join(stagingDir, w.Dest)
+
+	rep := report.New()
+	if err := w.Fetch(stagingDir, rep.Source(w.String())); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || string(data) != "hello world" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	req := srv.lastRequest()
+	if user, pass, _ := req.BasicAuth(); user != "user" || pass != "secret" {
+		t.Errorf("basic auth = %q, %q", user, pass)
+	}
+	if got := req.Header.Get("X-Token"); got != "token" {
+		t.Errorf("X-Token = %q", got)
+	}
+
+	// The second fetch is conditional.
+	if err := w.Fetch(stagingDir, rep.Source(w.String())); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.lastRequest().Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("If-None-Match = %q; want %q", got, `"v1"`)
+	}
+	counts := rep.Counts[w.String()]
+	if counts["downloaded files"] != 1 || counts["unchanged files"] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+
+	// A changed file is downloaded again.
+	srv.content, srv.etag = []byte("new content"), `"v2"`
+	w.SHA256 = ""
+	if err := w.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || string(data) != "new content" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	srv := &server{content: []byte(strings.Repeat("0123456789", 1000)), etag: `"v1"`, truncate: 4000}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	w := &Web{URL: ts.URL, Dest: "file"}
+	stagingDir := t.TempDir()
+	if err := w.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(stagingDir, "file"))
+	if err != nil || !bytes.Equal(data, srv.content) {
+		t.Fatalf("ReadFile() = %d bytes, %v; want %d bytes", len(data), err, len(srv.content))
+	}
+	req := srv.lastRequest()
+	if got := req.Header.Get("Range"); got != "bytes=4000-" {
+		t.Errorf("Range = %q; want %q", got, "bytes=4000-")
+	}
+	if got := req.Header.Get("If-Range"); got != `"v1"` {
+		t.Errorf("If-Range = %q; want %q", got, `"v1"`)
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "file.partial")); err == nil {
+		t.Error("partial file was not removed")
+	}
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	srv := &server{content: []byte("hello world"), etag: `"v1"`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	digest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte("something else"))
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		w.Write([]byte("hello world"))
+	}))
+	defer digest.Close()
+
+	for _, w := range []*Web{
+		{URL: ts.URL, Dest: "file", SHA256: strings.Repeat("00", sha256.Size)},
+		{URL: digest.URL, Dest: "file"},
+	} {
+		stagingDir := t.TempDir()
+		if err := w.Fetch(stagingDir, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("Fetch() of %s = %v; want checksum mismatch", w.URL, err)
+		}
+		if _, err := os.Stat(filepath.Join(stagingDir, "file")); err == nil {
+			t.Errorf("Fetch() of %s created the file", w.URL)
+		}
+	}
+}
+
+func TestFetchWebDAV(t *testing.T) {
+	fs := webdav.NewMemFS()
+	ctx := context.Background()
+	writeFile := func(name, content string) {
+		f, err := fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+	}
+	for _, dir := range []string{"/dav", "/dav/docs", "/dav/docs/old", "/dav/empty", "/other"} {
+		if err := fs.Mkdir(ctx, dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("/dav/a.txt", "a")
+	writeFile("/dav/docs/b b.txt", "b")
+	writeFile("/dav/docs/old/c.txt", "c")
+	writeFile("/other/d.txt", "d")
+
+	var mu sync.Mutex
+	gets := 0
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets++
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	w := &Web{URL: ts.URL + "/dav", WebDAV: true, Dest: "nextcloud"}
+	stagingDir := t.TempDir()
+	if err := w.Fetch(stagingDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a.txt":          "a",
+		"docs/b b.txt":   "b",
+		"docs/old/c.txt": "c",
+	}
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(stagingDir, "nextcloud", name))
+		if err != nil || string(data) != content {
+			t.Errorf("ReadFile(%q) = %q, %v; want %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(stagingDir, "nextcloud", "d.txt")); err == nil {
+		t.Error("file outside of the collection was downloaded")
+	}
+	if gets != 3 {
+		t.Errorf("%d GET requests; want 3", gets)
+	}
+
+	// Only the changed file is downloaded again.
+	time.Sleep(10 * time.Millisecond)
+	writeFile("/dav/docs/b b.txt", "b2")
+	gets = 0
+	rep := report.New()
+	if err := w.Fetch(stagingDir, rep.Source(w.String())); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 1 {
+		t.Errorf("%d GET requests; want 1", gets)
+	}
+	if data, err := os.ReadFile(filepath.Join(stagingDir, "nextcloud", "docs", "b b.txt")); err != nil || string(data) != "b2" {
+		t.Errorf("ReadFile() = %q, %v; want %q", data, err, "b2")
+	}
+	counts := rep.Counts[w.String()]
+	if counts["downloaded files"] != 1 || counts["unchanged files"] != 2 {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	for _, tt := range []struct {
+		root, p string
+		want    string
+		ok      bool
+	}{
+		{"/dav/", "/dav/a.txt", "a.txt", true},
+		{"/dav/", "/dav/docs/", "docs", true},
+		{"/dav/", "/dav/", "", false},
+		{"/dav/", "/other/a.txt", "", false},
+		{"/dav/", "/dav/../a.txt", "", false},
+		{"/dav/", "/davx/a.txt", "", false},
+		{"/dav/", "/dav/" + stateFile, "", false},
+	} {
+		got, ok := relativePath(tt.root, tt.p)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("relativePath(%q, %q) = %q, %v; want %q, %v", tt.root, tt.p, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		w  Web
+		ok bool
+	}{
+		{Web{URL: "https://example.com/export", Dest: "export.zip"}, true},
+		{Web{URL: "https://example.com/dav/", WebDAV: true, Dest: "dav"}, true},
+		{Web{URL: "https://example.com/export", Dest: "export.zip", SHA256: strings.Repeat("ab", 32)}, true},
+		{Web{URL: "ftp://example.com/export", Dest: "export.zip"}, false},
+		{Web{URL: "https://example.com/export"}, false},
+		{Web{URL: "https://example.com/export", Dest: "../export.zip"}, false},
+		{Web{URL: "https://example.com/export", Dest: "export.zip", SHA256: "abc"}, false},
+		{Web{URL: "https://example.com/dav/", WebDAV: true, Dest: "dav", SHA256: strings.Repeat("ab", 32)}, false},
+	} {
+		if err := tt.w.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v; want ok=%v", tt.w, err, tt.ok)
+		}
+	}
+}
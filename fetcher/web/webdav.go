@@ -0,0 +1,163 @@
+package web
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/report"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop>
+<resourcetype/><getetag/><getlastmodified/>
+</prop></propfind>`
+
+// multistatus is the response to a PROPFIND.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ETag         string `xml:"getetag"`
+				LastModified string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// entry is a member of a WebDAV collection.
+type entry struct {
+	// url is absolute.
+	url        *url.URL
+	collection bool
+	validators validators
+}
+
+// propfind lists the members of the collection at u.
+func (w *Web) propfind(u *url.URL) ([]entry, error) {
+	req, err := w.newRequest("PROPFIND", u.String(), strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	// Depth infinity is disabled on many servers.
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: %s", u.Redacted(), resp.Status)
+	}
+	ms := multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %v", u.Redacted(), err)
+	}
+
+	var entries []entry
+	for _, r := range ms.Responses {
+		href, err := u.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("PROPFIND %s: %v", u.Redacted(), err)
+		}
+		// The collection itself is included in the response.
+		if strings.TrimSuffix(href.Path, "/") == strings.TrimSuffix(u.Path, "/") {
+			continue
+		}
+		e := entry{url: href}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			e.collection = ps.Prop.ResourceType.Collection != nil
+			e.validators = validators{
+				ETag:         ps.Prop.ETag,
+				LastModified: ps.Prop.LastModified,
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// fetchWebDAV downloads the files in the collection recursively. Files whose
+// ETag is unchanged since the last fetch are skipped without a request. A
+// file which fails to download is reported and the walk continues.
+func (w *Web) fetchWebDAV(stagingDir string, s *state, rep *report.Source) error {
+	root, err := url.Parse(w.URL)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+
+	seen := map[string]bool{}
+	failed := 0
+	queue := []*url.URL{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		entries, err := w.propfind(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			rel, ok := relativePath(root.Path, e.url.Path)
+			if !ok {
+				rep.Warnf("skipping %s outside of the collection", e.url.Redacted())
+				continue
+			}
+			if e.collection {
+				if !seen[rel] {
+					seen[rel] = true
+					queue = append(queue, e.url)
+				}
+				continue
+			}
+			seen[rel] = true
+
+			dest := filepath.Join(stagingDir, w.Dest, filepath.FromSlash(rel))
+			if prev, ok := s.Files[rel]; ok && e.validators.ETag != "" && prev.ETag == e.validators.ETag && exists(dest) {
+				rep.Count("unchanged files", 1)
+				continue
+			}
+			if err := w.fetchFile(e.url.String(), dest, rel, "", s, rep); err != nil {
+				rep.Warnf("%s: %v", rel, err)
+				failed++
+			}
+		}
+	}
+
+	// Forget files which were deleted on the server, so they are not kept
+	// in the state file forever. They stay in the staging area like the
+	// files of other fetchers.
+	for rel := range s.Files {
+		if !seen[rel] {
+			delete(s.Files, rel)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to download %d files", failed)
+	}
+	return nil
+}
+
+// relativePath returns the slash separated path of p in the collection root.
+func relativePath(root, p string) (string, bool) {
+	rel, ok := strings.CutPrefix(path.Clean(p), path.Clean(root)+"/")
+	if !ok || rel == "" || !filepath.IsLocal(filepath.FromSlash(rel)) || rel == stateFile {
+		return "", false
+	}
+	return rel, true
+}
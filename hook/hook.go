@@ -0,0 +1,172 @@
+// Package hook runs user commands at points of the backup, for example to
+// dump a database before the fetchers run or to send a notification at the
+// end.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// Statuses passed in BACKUP_STATUS.
+const (
+	Running = "running"
+	Success = "success"
+	Failure = "failure"
+)
+
+// maxOutput is the number of bytes of output kept in the report.
+const maxOutput = 4096
+
+// defaultTimeout is how long a hook may run.
+const defaultTimeout = 10 * time.Minute
+
+// Hooks are the commands to run at each point of the backup.
+type Hooks struct {
+	// BeforeBackup runs after the staging area is mounted and before the
+	// fetchers.
+	BeforeBackup []Hook `json:"before_backup"`
+	// AfterFetch runs after each fetcher.
+	AfterFetch []Hook `json:"after_fetch"`
+	// BeforeArchive runs after the staging area is unmounted and before
+	// the archivers.
+	BeforeArchive []Hook `json:"before_archive"`
+	// AfterBackup runs at the end, whether the backup succeeded or not.
+	AfterBackup []Hook `json:"after_backup"`
+}
+
+func (h *Hooks) Validate() error {
+	for _, hook := range slices.Concat(h.BeforeBackup, h.BeforeArchive, h.AfterBackup) {
+		if err := hook.Validate(); err != nil {
+			return err
+		}
+		if hook.Fetcher != "" {
+			return errors.New("fetcher is only supported by after_fetch hooks")
+		}
+	}
+	for _, hook := range h.AfterFetch {
+		if err := hook.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hook is a command. It is passed these environment variables:
+//
+//   - BACKUP_EVENT: before_backup, after_fetch, before_archive or
+//     after_backup.
+//   - BACKUP_MOUNT_POINT: the mounted staging area, if it is mounted.
+//   - BACKUP_DISK_IMAGE: the disk image, once it is unmounted.
+//   - BACKUP_STATUS: running, success or failure. For after_fetch, it is
+//     the status of the fetcher.
+//   - BACKUP_FETCHER: the fetcher, for after_fetch.
+type Hook struct {
+	Command []string `json:"command"`
+	// Fetcher limits an after_fetch hook to the fetchers with this name
+	// (for example "local") or description (for example the directory of
+	// a local fetcher).
+	Fetcher string `json:"fetcher,omitempty"`
+	// TimeoutSeconds defaults to 10 minutes.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// AbortOnFailure stops the backup if the hook fails. Otherwise, the
+	// failure is a warning.
+	AbortOnFailure bool `json:"abort_on_failure,omitempty"`
+}
+
+func (h *Hook) String() string {
+	return strings.Join(h.Command, " ")
+}
+
+func (h *Hook) Validate() error {
+	if len(h.Command) == 0 {
+		return errors.New("hook command is required")
+	}
+	if h.TimeoutSeconds < 0 {
+		return errors.New("hook timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+// Env describes the state of the backup for the hooks.
+type Env struct {
+	Event      string
+	MountPoint string
+	DiskImage  string
+	Status     string
+	// Fetcher and FetcherName are the String() and Name() of the fetcher.
+	Fetcher     string
+	FetcherName string
+}
+
+func (e *Env) environ() []string {
+	return append(os.Environ(),
+		"BACKUP_EVENT="+e.Event,
+		"BACKUP_MOUNT_POINT="+e.MountPoint,
+		"BACKUP_DISK_IMAGE="+e.DiskImage,
+		"BACKUP_STATUS="+e.Status,
+		"BACKUP_FETCHER="+e.Fetcher,
+	)
+}
+
+// Run runs the hooks in order. Their output is added to the report. An error
+// is returned if a hook with AbortOnFailure fails, and the remaining hooks
+// are not run.
+func Run(ctx context.Context, hooks []Hook, env Env, rep *report.Report) error {
+	for _, h := range hooks {
+		if h.Fetcher != "" && h.Fetcher != env.Fetcher && !strings.EqualFold(h.Fetcher, env.FetcherName) {
+			continue
+		}
+		log.Printf("Running %s hook %s...", env.Event, &h)
+		src := rep.Source("hook " + h.String())
+		out, err := h.run(ctx, env)
+		prefix := env.Event
+		if env.Fetcher != "" {
+			prefix += " " + env.Fetcher
+		}
+		if len(out) != 0 {
+			src.Infof("%s: output:\n%s", prefix, out)
+		}
+		switch {
+		case err == nil:
+		case h.AbortOnFailure:
+			src.Errorf("%s: %v", prefix, err)
+			return fmt.Errorf("%s hook %s failed: %v", env.Event, &h, err)
+		default:
+			src.Warnf("%s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// run runs the hook and returns the end of its output.
+func (h *Hook) run(ctx context.Context, env Env) ([]byte, error) {
+	timeout := defaultTimeout
+	if h.TimeoutSeconds != 0 {
+		timeout = time.Duration(h.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = env.environ()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) > maxOutput {
+		out = append([]byte("..."), out[len(out)-maxOutput:]...)
+	}
+	return out, err
+}
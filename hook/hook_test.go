@@ -0,0 +1,69 @@
+package hook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rjoleary/backup/report"
+)
+
+func TestRun(t *testing.T) {
+	hooks := []Hook{
+		{Command: []string{"sh", "-c", "echo $BACKUP_EVENT $BACKUP_STATUS $BACKUP_MOUNT_POINT"}},
+		{Command: []string{"sh", "-c", "echo only git"}, Fetcher: "git"},
+		{Command: []string{"sh", "-c", "echo local; exit 1"}, Fetcher: "local"},
+	}
+	rep := report.New()
+	env := Env{Event: "after_fetch", MountPoint: "/Volumes/backup", Status: Success, Fetcher: "/home/me", FetcherName: "local"}
+	if err := Run(context.Background(), hooks, env, rep); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+
+	out := rep.Events[0].Message
+	if !strings.HasSuffix(out, "after_fetch success /Volumes/backup") {
+		t.Errorf("got output %q", out)
+	}
+	// The git hook is skipped, and the failure of the local hook is a
+	// warning.
+	if got := rep.Num(report.Info); got != 2 {
+		t.Errorf("got %d info entries; want 2", got)
+	}
+	if got := rep.Num(report.Warning); got != 1 {
+		t.Errorf("got %d warnings; want 1", got)
+	}
+}
+
+func TestRunAbort(t *testing.T) {
+	hooks := []Hook{
+		{Command: []string{"false"}, AbortOnFailure: true},
+		{Command: []string{"true"}},
+	}
+	rep := report.New()
+	if err := Run(context.Background(), hooks, Env{Event: "before_backup"}, rep); err == nil {
+		t.Fatal("Run() with a failed hook succeeded")
+	}
+	if got := len(rep.Events); got != 1 {
+		t.Errorf("got %d report events; want 1 because the second hook must not run", got)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	hooks := []Hook{{Command: []string{"sleep", "10"}, TimeoutSeconds: 1, AbortOnFailure: true}}
+	err := Run(context.Background(), hooks, Env{Event: "after_backup"}, report.New())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() = %v; want a timeout", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, h := range []*Hooks{
+		{BeforeBackup: []Hook{{}}},
+		{AfterBackup: []Hook{{Command: []string{"true"}, Fetcher: "local"}}},
+		{AfterFetch: []Hook{{Command: []string{"true"}, TimeoutSeconds: -1}}},
+	} {
+		if err := h.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", h)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Package fsutil contains file helpers shared by the fetchers and archivers.
+package fsutil
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// CopyFile copies src to dest. flag is combined with os.O_WRONLY|os.O_CREATE,
+// for example os.O_TRUNC to replace dest or os.O_EXCL to fail if it exists.
+// perm is the mode of a new file.
+func CopyFile(src, dest string, flag int, perm fs.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|flag, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// CountingWriter counts the bytes written to W.
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
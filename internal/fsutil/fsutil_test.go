@@ -0,0 +1,41 @@
+package fsutil
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyFile(src, dest, os.O_EXCL, 0600); err == nil {
+		t.Error("CopyFile() with O_EXCL replaced an existing file")
+	}
+	if err := CopyFile(src, dest, os.O_TRUNC, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || string(got) != "new" {
+		t.Errorf("dest = %q, %v; want %q", got, err, "new")
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &CountingWriter{W: buf}
+	io.WriteString(w, "hello ")
+	io.WriteString(w, "world")
+	if w.N != 11 || buf.String() != "hello world" {
+		t.Errorf("wrote %q and counted %d; want %q and 11", buf, w.N, "hello world")
+	}
+}
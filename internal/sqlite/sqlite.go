@@ -0,0 +1,42 @@
+// Package sqlite makes consistent copies of SQLite databases.
+package sqlite
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Backup copies the database src with the online backup API of sqlite3 to a
+// new temporary file in dir, and returns its name. Unlike a raw copy, the
+// backup is consistent even if another process writes to the database. The
+// caller removes the file.
+//
+// sqlite3 runs in dir, so src must be an absolute path.
+func Backup(src, dir string) (string, error) {
+	tmp, err := os.CreateTemp(dir, "sqlite-backup-*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+
+	// The temporary name does not need quoting in the dot-command.
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("sqlite3", "-readonly", src, ".backup "+filepath.Base(tmp.Name()))
+	cmd.Dir = dir
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("sqlite3: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	} else if stderr.Len() != 0 {
+		// sqlite3 exits successfully after some errors.
+		err = fmt.Errorf("sqlite3: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
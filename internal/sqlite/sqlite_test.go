@@ -0,0 +1,43 @@
+package sqlite
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	db := filepath.Join(t.TempDir(), "app.db")
+	if out, err := exec.Command("sqlite3", db, "CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('hello');").CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %v: %s", err, out)
+	}
+
+	dir := t.TempDir()
+	tmp, err := Backup(db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(tmp) != dir {
+		t.Errorf("Backup() = %q; want a file in %q", tmp, dir)
+	}
+	out, err := exec.Command("sqlite3", tmp, "SELECT v FROM t").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "hello" {
+		t.Errorf("backup contains %q; want %q", got, "hello")
+	}
+
+	// The temporary file is removed on failure.
+	if _, err := Backup(filepath.Join(dir, "missing.db"), dir); err == nil {
+		t.Error("Backup() of a missing database succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%s contains %d files; want 1", dir, len(entries))
+	}
+}
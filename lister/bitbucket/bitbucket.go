@@ -10,12 +10,19 @@ import (
 	"regexp"
 
 	"github.com/rjoleary/backup/fetcher"
+	bbfetcher "github.com/rjoleary/backup/fetcher/bitbucket"
 	"github.com/rjoleary/backup/fetcher/git"
 )
 
 type BitBucket struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Protocol is the git transport, either "ssh" (default) or "https".
+	Protocol string `json:"protocol,omitempty"`
+	// DeployKeys maps a repo's full name to an SSH private key which
+	// overrides ssh_key for that repo.
+	DeployKeys map[string]string `json:"deploy_keys,omitempty"`
+	git.Options
 }
 
 func (b *BitBucket) String() string {
@@ -40,7 +47,16 @@ func (b *BitBucket) Validate() error {
 	if !word.MatchString(b.Password) {
 		return errors.New("password is not a single word")
 	}
-	return nil
+	if b.Protocol != "" && b.Protocol != "ssh" && b.Protocol != "https" {
+		return fmt.Errorf("unknown protocol %q", b.Protocol)
+	}
+	for repo, key := range b.DeployKeys {
+		o := git.Options{SSHKey: key}
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("deploy key for %s: %v", repo, err)
+		}
+	}
+	return b.Options.Validate()
 }
 
 func (b *BitBucket) List() ([]fetcher.Fetcher, error) {
@@ -66,21 +82,73 @@ func (b *BitBucket) List() ([]fetcher.Fetcher, error) {
 		Values []struct {
 			FullName  string `json:"full_name"`
 			IsPrivate bool   `json:"is_private"`
+			HasIssues bool   `json:"has_issues"`
 		} `json:"values"`
 	}{}
 	if err := json.Unmarshal(body, &parsed); err != nil {
 		return nil, err
 	}
 
-	fetchers := make([]fetcher.Fetcher, 0, len(parsed.Values))
+	account := bbfetcher.Account{
+		Username: b.Username,
+		Password: b.Password,
+	}
+	fetchers := make([]fetcher.Fetcher, 0, 4*len(parsed.Values)+1)
 	for i := range parsed.Values {
 		r := parsed.Values[i]
-		fetchers = append(fetchers, &git.Git{
-			Dir:      r.FullName,
-			Url:      fmt.Sprintf("git@bitbucket.org:%s.git", r.FullName),
-			Protocol: "ssh",
-			Private:  r.IsPrivate,
+		if b.Protocol == "https" {
+			fetchers = append(fetchers, &git.Git{
+				Dir:      r.FullName,
+				Url:      fmt.Sprintf("https://bitbucket.org/%s.git", r.FullName),
+				Protocol: "https",
+				Private:  r.IsPrivate,
+				Username: b.Username,
+				Token:    b.Password,
+				Options:  b.options(r.FullName),
+			})
+		} else {
+			fetchers = append(fetchers, &git.Git{
+				Dir:      r.FullName,
+				Url:      fmt.Sprintf("git@bitbucket.org:%s.git", r.FullName),
+				Protocol: "ssh",
+				Private:  r.IsPrivate,
+				Options:  b.options(r.FullName),
+			})
+		}
+
+		// Metadata is saved next to the git mirror because the mirror
+		// directory must be empty for the initial clone.
+		metadataDir := r.FullName + ".metadata"
+		fetchers = append(fetchers, &bbfetcher.PullRequests{
+			Account: account,
+			Dir:     metadataDir,
+			Repo:    r.FullName,
+		}, &bbfetcher.Downloads{
+			Account: account,
+			Dir:     metadataDir,
+			Repo:    r.FullName,
 		})
+		if r.HasIssues {
+			fetchers = append(fetchers, &bbfetcher.Issues{
+				Account: account,
+				Dir:     metadataDir,
+				Repo:    r.FullName,
+			})
+		}
 	}
+	fetchers = append(fetchers, &bbfetcher.Snippets{
+		Account:   account,
+		Dir:       b.Username + ".snippets",
+		Workspace: b.Username,
+	})
 	return fetchers, nil
 }
+
+// options returns the git options for a repo.
+func (b *BitBucket) options(repo string) git.Options {
+	o := b.Options
+	if key, ok := b.DeployKeys[repo]; ok {
+		o.SSHKey = key
+	}
+	return o
+}
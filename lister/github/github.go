@@ -14,6 +14,12 @@ import (
 type GitHub struct {
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// Protocol is the git transport, either "ssh" (default) or "https".
+	Protocol string `json:"protocol,omitempty"`
+	// DeployKeys maps a repo's full name to an SSH private key which
+	// overrides ssh_key for that repo.
+	DeployKeys map[string]string `json:"deploy_keys,omitempty"`
+	git.Options
 }
 
 func (g *GitHub) String() string {
@@ -38,7 +44,16 @@ func (g *GitHub) Validate() error {
 	if !word.MatchString(g.Token) {
 		return errors.New("token is not a single word")
 	}
-	return nil
+	if g.Protocol != "" && g.Protocol != "ssh" && g.Protocol != "https" {
+		return fmt.Errorf("unknown protocol %q", g.Protocol)
+	}
+	for repo, key := range g.DeployKeys {
+		o := git.Options{SSHKey: key}
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("deploy key for %s: %v", repo, err)
+		}
+	}
+	return g.Options.Validate()
 }
 
 func (g *GitHub) List() ([]fetcher.Fetcher, error) {
@@ -63,14 +78,56 @@ func (g *GitHub) List() ([]fetcher.Fetcher, error) {
 	fetchers := make([]fetcher.Fetcher, 0, len(allRepos))
 	for i := range allRepos {
 		r := allRepos[i]
-		if r.FullName != nil && r.SSHURL != nil && r.Private != nil {
+		if r.FullName == nil || r.Private == nil {
+			continue
+		}
+		if g.Protocol == "https" {
+			if r.CloneURL != nil {
+				fetchers = append(fetchers, &git.Git{
+					Dir:      *r.FullName,
+					Url:      *r.CloneURL,
+					Protocol: "https",
+					Private:  *r.Private,
+					Username: g.Username,
+					Token:    g.Token,
+					Options:  g.options(*r.FullName),
+				})
+			}
+		} else if r.SSHURL != nil {
 			fetchers = append(fetchers, &git.Git{
 				Dir:      *r.FullName,
 				Url:      *r.SSHURL,
 				Protocol: "ssh",
 				Private:  *r.Private,
+				Options:  g.options(*r.FullName),
 			})
 		}
 	}
 	return fetchers, nil
 }
+
+// options returns the git options for a repo.
+func (g *GitHub) options(repo string) git.Options {
+	o := g.Options
+	if key, ok := g.DeployKeys[repo]; ok {
+		o.SSHKey = key
+	}
+	return o
+}
+
+// KnownHosts downloads GitHub's SSH host keys and returns them as
+// known_hosts lines.
+func KnownHosts(ctx context.Context) ([]string, error) {
+	meta, _, err := github.NewClient(nil).Meta.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.SSHKeys) == 0 {
+		return nil, errors.New("no SSH keys in the GitHub metadata")
+	}
+	lines := make([]string, 0, len(meta.SSHKeys))
+	for _, k := range meta.SSHKeys {
+		lines = append(lines, "github.com "+k)
+	}
+	return lines, nil
+}
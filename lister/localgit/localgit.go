@@ -0,0 +1,135 @@
+// Package localgit lists the git working copies in local directory trees.
+package localgit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/fetcher/git"
+)
+
+// LocalGit finds the git repos under the roots and creates a working copy
+// fetcher for each. The mirror of "<root>/a/b" is "<dest>/a/b".
+type LocalGit struct {
+	// Roots are the directories to search. A leading "~/" is the home
+	// directory.
+	Roots []string `json:"roots"`
+	// Exclude are patterns for filepath.Match. Directories whose path
+	// relative to the root matches are not searched.
+	Exclude []string `json:"exclude,omitempty"`
+	// Patch saves the uncommitted changes of each repo.
+	Patch bool   `json:"patch,omitempty"`
+	Dest  string `json:"dest"`
+}
+
+func (l *LocalGit) String() string {
+	return "local git repos in " + strings.Join(l.Roots, ", ")
+}
+
+func (l *LocalGit) Name() string {
+	return "Local git"
+}
+
+func (l *LocalGit) Deps() map[string][]string {
+	return map[string][]string{"git": {"git", "--version"}}
+}
+
+func (l *LocalGit) Validate() error {
+	if len(l.Roots) == 0 {
+		return errors.New("roots is required")
+	}
+	for _, r := range l.Roots {
+		if !filepath.IsAbs(r) && !strings.HasPrefix(r, "~/") {
+			return fmt.Errorf("root must be absolute or start with ~/, got %q", r)
+		}
+	}
+	for _, e := range l.Exclude {
+		if _, err := filepath.Match(e, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %v", e, err)
+		}
+	}
+	if l.Dest == "" {
+		return errors.New("dest is required")
+	}
+	if err := fetcher.ValidateDest("dest", l.Dest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func expandHome(p string) (string, error) {
+	rest, ok := strings.CutPrefix(p, "~/")
+	if !ok {
+		return filepath.Clean(p), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// isRepo returns true if dir is a working tree or a bare repo. In a linked
+// worktree or a submodule, ".git" is a file.
+func isRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *LocalGit) List() ([]fetcher.Fetcher, error) {
+	fetchers := []fetcher.Fetcher{}
+	for _, r := range l.Roots {
+		root, err := expandHome(r)
+		if err != nil {
+			return nil, err
+		}
+		// Symlinks are not followed, so the walk cannot loop.
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Skip directories which cannot be read.
+				if path != root && errors.Is(err, fs.ErrPermission) {
+					return fs.SkipDir
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			for _, e := range l.Exclude {
+				if ok, _ := filepath.Match(e, rel); ok {
+					return fs.SkipDir
+				}
+			}
+			if !isRepo(path) {
+				return nil
+			}
+			fetchers = append(fetchers, &git.WorkingCopy{
+				Path:  path,
+				Dir:   filepath.Join(l.Dest, rel),
+				Patch: l.Patch,
+			})
+			// Nested repos, such as submodules, are part of this repo.
+			return fs.SkipDir
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fetchers, nil
+}
@@ -0,0 +1,75 @@
+package localgit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rjoleary/backup/fetcher/git"
+)
+
+func TestList(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{
+		"a/.git",
+		// Submodules are part of the parent repo.
+		"a/sub/.git",
+		"b/c/.git",
+		"old/d/.git",
+		"bare.git/objects",
+		"bare.git/refs",
+		"notrepo/e",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "bare.git/HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &LocalGit{Roots: []string{root}, Exclude: []string{"old"}, Patch: true, Dest: "src"}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	fetchers, err := l.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, f := range fetchers {
+		w := f.(*git.WorkingCopy)
+		rel, err := filepath.Rel(root, w.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s:%s:%v", rel, w.Dir, w.Patch))
+	}
+	want := "[a:src/a:true b/c:src/b/c:true bare.git:src/bare.git:true]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("List() = %v; want %v", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		l    LocalGit
+		ok   bool
+	}{
+		{"ok", LocalGit{Roots: []string{"/src", "~/src"}, Dest: "src"}, true},
+		{"no roots", LocalGit{Dest: "src"}, false},
+		{"relative root", LocalGit{Roots: []string{"src"}, Dest: "src"}, false},
+		{"bad exclude", LocalGit{Roots: []string{"/src"}, Exclude: []string{"["}, Dest: "src"}, false},
+		{"no dest", LocalGit{Roots: []string{"/src"}}, false},
+		{"dest outside", LocalGit{Roots: []string{"/src"}, Dest: "../src"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.l.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate() = %v; want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
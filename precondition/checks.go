@@ -0,0 +1,278 @@
+package precondition
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ProcessNotRunning waits for a program to exit, for example a browser or a
+// virtual machine which holds files open.
+type ProcessNotRunning struct {
+	// Process is the exact name of the process.
+	Process string `json:"process"`
+	Options
+}
+
+func (p *ProcessNotRunning) String() string {
+	return p.Process + " is not running"
+}
+
+func (p *ProcessNotRunning) Name() string {
+	return "ProcessNotRunning"
+}
+
+func (p *ProcessNotRunning) Validate() error {
+	if p.Process == "" {
+		return errors.New("process is required")
+	}
+	return p.Options.validate()
+}
+
+func (p *ProcessNotRunning) Deps() map[string][]string {
+	// pgrep never matches itself, and the BSD pgrep on macOS has no
+	// version flag, so the shell looks it up instead.
+	return map[string][]string{"pgrep": {"sh", "-c", "command -v pgrep"}}
+}
+
+func (p *ProcessNotRunning) Check(ctx context.Context) error {
+	err := exec.CommandContext(ctx, "pgrep", "-x", p.Process).Run()
+	exitErr := &exec.ExitError{}
+	switch {
+	case err == nil:
+		return fmt.Errorf("%s is running", p.Process)
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		// No processes matched.
+		return nil
+	default:
+		return fmt.Errorf("pgrep: %v", err)
+	}
+}
+
+// syncClients are the status commands of the supported sync clients and
+// their output when idle.
+var syncClients = map[string]struct {
+	command []string
+	idle    string
+}{
+	"dropbox":  {[]string{"dropbox", "status"}, "Up to date"},
+	"maestral": {[]string{"maestral", "status"}, "Up to date"},
+}
+
+// SyncIdle waits for a sync client, such as Dropbox, to finish syncing.
+type SyncIdle struct {
+	// Client is "dropbox" or "maestral". Other clients are supported by
+	// setting Command and Idle instead.
+	Client string `json:"client,omitempty"`
+	// Socket is Dropbox's command socket. It defaults to
+	// ~/.dropbox/command_socket. If the socket does not exist, the
+	// dropbox command is run instead.
+	Socket string `json:"socket,omitempty"`
+	// Command prints the status of the client.
+	Command []string `json:"command,omitempty"`
+	// Idle is a string printed by Command when the client is idle.
+	Idle string `json:"idle,omitempty"`
+	Options
+}
+
+func (s *SyncIdle) String() string {
+	if s.Client != "" {
+		return s.Client + " is synced"
+	}
+	return strings.Join(s.Command, " ") + " is idle"
+}
+
+func (s *SyncIdle) Name() string {
+	return "SyncIdle"
+}
+
+func (s *SyncIdle) Validate() error {
+	if s.Client == "" {
+		if len(s.Command) == 0 || s.Idle == "" {
+			return errors.New("client, or command and idle are required")
+		}
+	} else if _, ok := syncClients[s.Client]; !ok {
+		return fmt.Errorf("unknown client %q", s.Client)
+	}
+	if s.Socket != "" && s.Client != "dropbox" {
+		return errors.New("socket is only supported by dropbox")
+	}
+	return s.Options.validate()
+}
+
+func (s *SyncIdle) Check(ctx context.Context) error {
+	if s.Client == "dropbox" {
+		socket := s.Socket
+		if socket == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			socket = filepath.Join(home, ".dropbox", "command_socket")
+		}
+		if _, err := os.Stat(socket); err == nil {
+			status, err := dropboxStatus(ctx, socket)
+			if err != nil {
+				return err
+			}
+			if status != syncClients["dropbox"].idle {
+				return fmt.Errorf("dropbox is not synced: %s", status)
+			}
+			return nil
+		}
+	}
+
+	command, idle := s.Command, s.Idle
+	if s.Client != "" {
+		command, idle = syncClients[s.Client].command, syncClients[s.Client].idle
+	}
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).Output()
+	if err != nil {
+		return fmt.Errorf("%s: %v", command[0], err)
+	}
+	if !bytes.Contains(out, []byte(idle)) {
+		status, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return fmt.Errorf("%s is not idle: %s", command[0], status)
+	}
+	return nil
+}
+
+// dropboxStatus asks Dropbox for its status over the command socket. This is
+// the protocol used by dropbox.py.
+func dropboxStatus(ctx context.Context, socket string) (string, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("get_dropbox_status\ndone\n")); err != nil {
+		return "", err
+	}
+	// The reply is "ok", then tab-separated key-values, then "done".
+	r := bufio.NewScanner(conn)
+	if !r.Scan() {
+		return "", fmt.Errorf("dropbox: no reply: %v", r.Err())
+	}
+	if r.Text() != "ok" {
+		return "", fmt.Errorf("dropbox: %s", r.Text())
+	}
+	for r.Scan() && r.Text() != "done" {
+		fields := strings.Split(r.Text(), "\t")
+		if fields[0] == "status" && len(fields) > 1 {
+			return strings.Join(fields[1:], ", "), nil
+		}
+	}
+	if err := r.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("dropbox: no status in reply")
+}
+
+// PathExists waits for a file or directory to exist.
+type PathExists struct {
+	Path string `json:"path"`
+	Options
+}
+
+func (p *PathExists) String() string {
+	return p.Path + " exists"
+}
+
+func (p *PathExists) Name() string {
+	return "PathExists"
+}
+
+func (p *PathExists) Validate() error {
+	if p.Path == "" {
+		return errors.New("path is required")
+	}
+	return p.Options.validate()
+}
+
+func (p *PathExists) Check(ctx context.Context) error {
+	_, err := os.Stat(p.Path)
+	return err
+}
+
+// Mounted waits for a file system to be mounted at a directory, for example
+// a network share or an external disk.
+type Mounted struct {
+	Path string `json:"path"`
+	Options
+}
+
+func (m *Mounted) String() string {
+	return m.Path + " is mounted"
+}
+
+func (m *Mounted) Name() string {
+	return "Mounted"
+}
+
+func (m *Mounted) Validate() error {
+	if m.Path == "" {
+		return errors.New("path is required")
+	}
+	return m.Options.validate()
+}
+
+func (m *Mounted) Check(ctx context.Context) error {
+	fi, err := os.Stat(m.Path)
+	if err != nil {
+		return err
+	}
+	parent, err := os.Stat(filepath.Join(m.Path, ".."))
+	if err != nil {
+		return err
+	}
+	st, pst := fi.Sys().(*syscall.Stat_t), parent.Sys().(*syscall.Stat_t)
+	// The root directory is its own parent.
+	if st.Dev != pst.Dev || st.Ino == pst.Ino {
+		return nil
+	}
+	return fmt.Errorf("%s is not a mount point", m.Path)
+}
+
+// Command waits for a command to exit successfully.
+type Command struct {
+	Command []string `json:"command"`
+	Options
+}
+
+func (c *Command) String() string {
+	return strings.Join(c.Command, " ") + " succeeds"
+}
+
+func (c *Command) Name() string {
+	return "Command"
+}
+
+func (c *Command) Validate() error {
+	if len(c.Command) == 0 {
+		return errors.New("command is required")
+	}
+	return c.Options.validate()
+}
+
+func (c *Command) Check(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...).CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) != 0 {
+			return fmt.Errorf("%s: %v: %s", c.Command[0], err, out)
+		}
+		return fmt.Errorf("%s: %v", c.Command[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package precondition checks that the machine is ready to be backed up, for
+// example that Dropbox has finished syncing.
+package precondition
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rjoleary/backup/report"
+)
+
+// pollInterval is how often a failing check is retried. It is overridden by
+// tests.
+var pollInterval = 10 * time.Second
+
+// defaultTimeout is how long to wait for a check to pass.
+const defaultTimeout = time.Minute
+
+// Policies for a check which does not pass before the timeout.
+const (
+	// Fail aborts the backup. This is the default.
+	Fail = "fail"
+	// Skip continues the backup with a warning.
+	Skip = "skip"
+)
+
+type Precondition interface {
+	fmt.Stringer
+	Name() string
+	Validate() error
+	// Check returns nil if the precondition holds, or an error describing
+	// why it does not.
+	Check(ctx context.Context) error
+	options() *Options
+}
+
+// Options are common to all preconditions.
+type Options struct {
+	// TimeoutSeconds is how long to wait for the check to pass. It
+	// defaults to one minute.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// OnFailure is "fail" (the default) or "skip".
+	OnFailure string `json:"on_failure,omitempty"`
+}
+
+func (o *Options) options() *Options {
+	return o
+}
+
+func (o *Options) validate() error {
+	if o.TimeoutSeconds < 0 {
+		return errors.New("timeout_seconds must not be negative")
+	}
+	switch o.OnFailure {
+	case "", Fail, Skip:
+	default:
+		return fmt.Errorf("on_failure must be %s or %s, got %q", Fail, Skip, o.OnFailure)
+	}
+	return nil
+}
+
+func (o *Options) timeout() time.Duration {
+	if o.TimeoutSeconds == 0 {
+		return defaultTimeout
+	}
+	return time.Duration(o.TimeoutSeconds) * time.Second
+}
+
+// Run waits for each precondition to pass. The outcomes are added to the
+// report. An error is returned if a precondition with the fail policy does
+// not pass before its timeout.
+func Run(ctx context.Context, preconditions []Precondition, rep *report.Report) error {
+	failed := 0
+	for _, p := range preconditions {
+		log.Printf("Checking %s...", p)
+		src := rep.Source(p.String())
+		start := time.Now()
+		err := wait(ctx, p)
+		switch {
+		case err == nil:
+			src.Infof("passed after %v", time.Since(start).Round(time.Second))
+		case p.options().OnFailure == Skip:
+			src.Warnf("skipped: %v", err)
+		default:
+			src.Errorf("failed: %v", err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d preconditions failed", failed)
+	}
+	return nil
+}
+
+// wait checks p until it passes or times out.
+func wait(ctx context.Context, p Precondition) error {
+	ctx, cancel := context.WithTimeout(ctx, p.options().timeout())
+	defer cancel()
+	for logged := false; ; logged = true {
+		err := p.Check(ctx)
+		if err == nil {
+			return nil
+		}
+		if !logged {
+			log.Printf("Waiting up to %v: %v", p.options().timeout(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pollInterval):
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package precondition
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rjoleary/backup/fetcher"
+	"github.com/rjoleary/backup/report"
+)
+
+func TestChecks(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		p    Precondition
+		want bool
+	}{
+		{&PathExists{Path: dir}, true},
+		{&PathExists{Path: filepath.Join(dir, "missing")}, false},
+		{&Mounted{Path: "/"}, true},
+		{&Mounted{Path: dir}, false},
+		{&Command{Command: []string{"true"}}, true},
+		{&Command{Command: []string{"false"}}, false},
+		{&ProcessNotRunning{Process: "no-such-process"}, true},
+		{&SyncIdle{Command: []string{"echo", "Status: Up to date"}, Idle: "Up to date"}, true},
+		{&SyncIdle{Command: []string{"echo", "Syncing 3 files"}, Idle: "Up to date"}, false},
+	} {
+		if err := tt.p.Validate(); err != nil {
+			t.Fatalf("%s: Validate() = %v", tt.p, err)
+		}
+		if err := tt.p.Check(context.Background()); (err == nil) != tt.want {
+			t.Errorf("%s: Check() = %v; want pass %v", tt.p, err, tt.want)
+		}
+	}
+}
+
+func TestDeps(t *testing.T) {
+	for _, p := range []Precondition{
+		&PathExists{}, &Mounted{}, &Command{}, &ProcessNotRunning{}, &SyncIdle{},
+	} {
+		d, ok := p.(fetcher.Dependent)
+		if !ok {
+			continue
+		}
+		for name, cmd := range d.Deps() {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Logf("skipping %s which is not installed", name)
+				continue
+			}
+			if err := exec.Command(cmd[0], cmd[1:]...).Run(); err != nil {
+				t.Errorf("%s: %v failed: %v", p.Name(), cmd, err)
+			}
+		}
+	}
+}
+
+// serveDropbox replies to status requests with each status in turn.
+func serveDropbox(t *testing.T, statuses ...string) string {
+	socket := filepath.Join(t.TempDir(), "command_socket")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for _, status := range statuses {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewScanner(conn)
+			for r.Scan() && r.Text() != "done" {
+			}
+			conn.Write([]byte("ok\nstatus\t" + status + "\ndone\n"))
+			conn.Close()
+		}
+	}()
+	return socket
+}
+
+func TestDropboxSocket(t *testing.T) {
+	pollInterval = time.Millisecond
+	s := &SyncIdle{Client: "dropbox", Socket: serveDropbox(t, "Syncing 2 files", "Up to date")}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rep := report.New()
+	if err := Run(context.Background(), []Precondition{s}, rep); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if got := rep.Num(report.Info); got != 1 {
+		t.Errorf("got %d info entries; want 1", got)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	pollInterval = time.Millisecond
+	missing := filepath.Join(t.TempDir(), "missing")
+	skipped := &PathExists{Path: missing, Options: Options{TimeoutSeconds: 1, OnFailure: Skip}}
+	failed := &PathExists{Path: missing, Options: Options{TimeoutSeconds: 1}}
+
+	rep := report.New()
+	if err := Run(context.Background(), []Precondition{skipped}, rep); err != nil {
+		t.Errorf("Run() with skip policy = %v", err)
+	}
+	if got := rep.Num(report.Warning); got != 1 {
+		t.Errorf("got %d warnings; want 1", got)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(missing, nil, 0666)
+	}()
+	if err := Run(context.Background(), []Precondition{failed}, rep); err != nil {
+		t.Errorf("Run() after the path was created = %v", err)
+	}
+
+	os.Remove(missing)
+	if err := Run(context.Background(), []Precondition{failed}, rep); err == nil {
+		t.Error("Run() with fail policy succeeded")
+	}
+	if got := rep.Num(report.Error); got != 1 {
+		t.Errorf("got %d errors; want 1", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, p := range []Precondition{
+		&ProcessNotRunning{},
+		&SyncIdle{Client: "onedrive"},
+		&SyncIdle{Command: []string{"status"}},
+		&SyncIdle{Client: "maestral", Socket: "/tmp/socket"},
+		&PathExists{Path: "/a", Options: Options{OnFailure: "ignore"}},
+		&Command{Command: []string{"true"}, Options: Options{TimeoutSeconds: -1}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", p)
+		}
+	}
+}
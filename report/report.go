@@ -0,0 +1,157 @@
+// Package report records what happened during a backup run. The report is
+// saved into the staging area and summarized at the end of the run.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Severity string
+
+const (
+	Info    Severity = "info"
+	Warning Severity = "warning"
+	Error   Severity = "error"
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Severity Severity  `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+type Report struct {
+	mu     sync.Mutex
+	Start  time.Time `json:"start"`
+	Events []Event   `json:"events"`
+	// Counts maps a source to its named counters, for example the number of
+	// objects fetched.
+	Counts map[string]map[string]int64 `json:"counts"`
+}
+
+func New() *Report {
+	return &Report{
+		Start:  time.Now().UTC(),
+		Events: []Event{},
+		Counts: map[string]map[string]int64{},
+	}
+}
+
+// Source returns a handle for adding events and counts attributed to the
+// named source, such as a fetcher.
+func (r *Report) Source(name string) *Source {
+	return &Source{r: r, name: name}
+}
+
+// Save writes the report as json.
+func (r *Report) Save(file string) error {
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0666)
+}
+
+// Num returns the number of events with the given severity.
+func (r *Report) Num(severity Severity) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, e := range r.Events {
+		if e.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary writes the warnings, errors and counts in a human readable format.
+func (r *Report) Summary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.Events {
+		if e.Severity != Info {
+			fmt.Fprintf(w, "%s: %s: %s\n", e.Severity, e.Source, e.Message)
+		}
+	}
+
+	sources := make([]string, 0, len(r.Counts))
+	for s := range r.Counts {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+	for _, s := range sources {
+		counters := make([]string, 0, len(r.Counts[s]))
+		for c := range r.Counts[s] {
+			counters = append(counters, c)
+		}
+		sort.Strings(counters)
+		for _, c := range counters {
+			fmt.Fprintf(w, "%s: %s: %d\n", s, c, r.Counts[s][c])
+		}
+	}
+}
+
+// Source adds events and counts to a report. Methods on a nil Source do
+// nothing.
+type Source struct {
+	r    *Report
+	name string
+}
+
+func (s *Source) add(severity Severity, format string, args ...any) {
+	if s == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if severity == Info {
+		log.Printf("%s: %s", s.name, msg)
+	} else {
+		log.Printf("%s: %s: %s", severity, s.name, msg)
+	}
+
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.Events = append(s.r.Events, Event{
+		Time:     time.Now().UTC(),
+		Source:   s.name,
+		Severity: severity,
+		Message:  msg,
+	})
+}
+
+func (s *Source) Infof(format string, args ...any) {
+	s.add(Info, format, args...)
+}
+
+func (s *Source) Warnf(format string, args ...any) {
+	s.add(Warning, format, args...)
+}
+
+func (s *Source) Errorf(format string, args ...any) {
+	s.add(Error, format, args...)
+}
+
+// Count adds n to the named counter.
+func (s *Source) Count(counter string, n int64) {
+	if s == nil {
+		return
+	}
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	if s.r.Counts[s.name] == nil {
+		s.r.Counts[s.name] = map[string]int64{}
+	}
+	s.r.Counts[s.name][counter] += n
+}
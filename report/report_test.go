@@ -0,0 +1,54 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	r := New()
+	s := r.Source("repo")
+	s.Infof("cloned")
+	s.Warnf("%d files vanished", 2)
+	s.Count("objects", 3)
+	s.Count("objects", 4)
+
+	if got := r.Num(Warning); got != 1 {
+		t.Errorf("Num(Warning) = %d; want 1", got)
+	}
+	if got := r.Counts["repo"]["objects"]; got != 7 {
+		t.Errorf("objects count = %d; want 7", got)
+	}
+
+	var sb strings.Builder
+	r.Summary(&sb)
+	want := "warning: repo: 2 files vanished\nrepo: objects: 7\n"
+	if sb.String() != want {
+		t.Errorf("Summary() = %q; want %q", sb.String(), want)
+	}
+
+	file := filepath.Join(t.TempDir(), "report.json")
+	if err := r.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := New()
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Events) != 2 {
+		t.Errorf("saved %d events; want 2", len(saved.Events))
+	}
+}
+
+func TestNilSource(t *testing.T) {
+	var s *Source
+	s.Warnf("ignored")
+	s.Count("ignored", 1)
+}
@@ -77,38 +77,47 @@ func Open(password string, fileName string) (*StagingArea, error) {
 	}, nil
 }
 
-func (sa *StagingArea) MountPoint() (string, error) {
-	// This is more complicated than just calling "mount" because there is a mapper to
+// hdiutilInfo lists the attached disk images.
+type hdiutilInfo struct {
+	Framework string `plist:"framework"`
+	Images    []struct {
+		AutoDiskMount  bool   `plist:"autodiskmount"`
+		BlockCount     int    `plist:"blockcount"`
+		BlockSize      int    `plist:"blocksize"`
+		DiskImages2    bool   `plist:"diskimages2"`
+		HDIDPID        int    `plist:"hdid-pid"`
+		IconPath       string `plist:"icon-path"`
+		ImageEncrypted bool   `plist:"image-encrypted"`
+		ImagePath      string `plist:"image-path"`
+		ImageType      string `plist:"image-type"`
+		OwnerMode      int    `plist:"owner-mode"`
+		OwnerUID       int    `plist:"owner-uid"`
+		Removable      bool   `plist:"removable"`
+		SystemEntities []struct {
+			ContentHint string `plist:"content-hint"`
+			DevEntry    string `plist:"dev-entry"`
+			MountPoint  string `plist:"mount-point"`
+		} `plist:"system-entities"`
+		Writeable bool `plist:"writeable"`
+	} `plist:"images"`
+}
+
+func getInfo() (*hdiutilInfo, error) {
 	output, err := exec.Command("hdiutil", "info", "-plist").Output()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	info := &hdiutilInfo{}
+	if err := plist.NewDecoder(bytes.NewReader(output)).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
 
-	info := struct {
-		Framework string `plist:"framework"`
-		Images    []struct {
-			AutoDiskMount  bool   `plist:"autodiskmount"`
-			BlockCount     int    `plist:"blockcount"`
-			BlockSize      int    `plist:"blocksize"`
-			DiskImages2    bool   `plist:"diskimages2"`
-			HDIDPID        int    `plist:"hdid-pid"`
-			IconPath       string `plist:"icon-path"`
-			ImageEncrypted bool   `plist:"image-encrypted"`
-			ImagePath      string `plist:"image-path"`
-			ImageType      string `plist:"image-type"`
-			OwnerMode      int    `plist:"owner-mode"`
-			OwnerUID       int    `plist:"owner-uid"`
-			Removable      bool   `plist:"removable"`
-			SystemEntities []struct {
-				ContentHint string `plist:"content-hint"`
-				DevEntry    string `plist:"dev-entry"`
-				MountPoint  string `plist:"mount-point"`
-			} `plist:"system-entities"`
-			Writeable bool `plist:"writeable"`
-		} `plist:"images"`
-	}{}
-
-	if err := plist.NewDecoder(bytes.NewReader(output)).Decode(&info); err != nil {
+func (sa *StagingArea) MountPoint() (string, error) {
+	// This is more complicated than just calling "mount" because there is a mapper to
+	info, err := getInfo()
+	if err != nil {
 		return "", err
 	}
 
@@ -125,6 +134,23 @@ func (sa *StagingArea) MountPoint() (string, error) {
 	return "", errors.New("could not find attached image")
 }
 
+// Encrypted returns true if the directory is the mount point of an encrypted
+// disk image. It returns false for any other directory.
+func Encrypted(mountPoint string) (bool, error) {
+	info, err := getInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, image := range info.Images {
+		for _, entity := range image.SystemEntities {
+			if entity.MountPoint != "" && filepath.Clean(entity.MountPoint) == filepath.Clean(mountPoint) {
+				return image.ImageEncrypted, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 // Unmount unmounts the filesystem and returns a path to the disk image.
 func (sa *StagingArea) Unmount() (string, error) {
 	mp, err := sa.MountPoint()
@@ -37,6 +37,9 @@ func TestStagingArea(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		if encrypted, err := Encrypted(mp); err != nil || !encrypted {
+			t.Errorf("Encrypted() = %v, %v; want true", encrypted, err)
+		}
 
 		if err := os.WriteFile(filepath.Join(mp, testFileName), []byte(testFileContent), 0664); err != nil {
 			t.Fatal(err)